@@ -12,10 +12,12 @@ import (
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/eth/downloader"
@@ -43,6 +45,10 @@ var (
 	// pssprotos = []*pss.Protocol{}
 	// get the incoming message
 	msgC = make(chan interface{})
+	// id of the last request sent, peers reply with it
+	requestID uint64
+	// last nonce of the node key, it starts from the last nonce used before the restart
+	nonce uint64
 
 	prompt          *promptui.Select
 	commands        []terminal.Command
@@ -50,8 +56,16 @@ var (
 	mining          bool
 	orderbookEngine *orderbook.Engine
 	nodeaddr        string
+	// sequencer orders the requests of all nodes, nil when each node processes them on arrival
+	sequencerConfig *protocol.SequencerConfig
+	sequencerAddr   string
 )
 
+// pair and max volume
+var allowedPairs = map[string]*big.Int{
+	"TOMO/WETH": big.NewInt(10e9),
+}
+
 func initPrompt(privateKeyName string) {
 
 	// default value for node2 if using keystore1 and vice versa
@@ -87,6 +101,22 @@ func initPrompt(privateKeyName string) {
 		{Name: "order_id", Value: "1"},
 	}, orderArguments...)
 
+	verifyArguments := []terminal.Argument{
+		{Name: "repair", Value: "false"},
+	}
+
+	pairArguments := []terminal.Argument{
+		{Name: "pair_name", Value: "TOMO/WETH"},
+	}
+
+	addPairArguments := append([]terminal.Argument{
+		{Name: "base_token", Value: "0x0000000000000000000000000000000000000001"},
+		{Name: "quote_token", Value: "0x0000000000000000000000000000000000000002"},
+		{Name: "base_decimals", Value: "18"},
+		{Name: "quote_decimals", Value: "18"},
+		{Name: "max_volume", Value: "10000000000"},
+	}, pairArguments...)
+
 	// init prompt commands
 	commands = []terminal.Command{
 		{
@@ -104,6 +134,40 @@ func initPrompt(privateKeyName string) {
 			Arguments:   cancelOrderArguments,
 			Description: "Cancel order, order_id must greater than 0",
 		},
+		{
+			Name:        "massCancel",
+			Arguments:   pairArguments,
+			Description: "Cancel all orders of this node, in all pairs when pair_name is empty",
+		},
+		{
+			Name:        "verify",
+			Arguments:   verifyArguments,
+			Description: "Verify the storage of orderbooks, repair aggregate fields when repair is true",
+		},
+		{
+			Name:        "listPairs",
+			Description: "List registered pairs",
+		},
+		{
+			Name:        "addPair",
+			Arguments:   addPairArguments,
+			Description: "Register a new pair",
+		},
+		{
+			Name:        "suspendPair",
+			Arguments:   pairArguments,
+			Description: "Suspend a pair, resting orders can still be cancelled",
+		},
+		{
+			Name:        "resumePair",
+			Arguments:   pairArguments,
+			Description: "Resume a suspended or delisted pair",
+		},
+		{
+			Name:        "delistPair",
+			Arguments:   pairArguments,
+			Description: "Delist a pair and cancel all its resting orders",
+		},
 		{
 			Name:        "nodeAddr",
 			Description: "Get Node address",
@@ -128,6 +192,7 @@ func init() {
 			Action: func(c *cli.Context) error {
 				privateKeyName := path.Base(c.String("privateKey"))
 				mining = c.Bool("mining")
+				sequencerAddr = c.String("sequencer")
 				// init prompt
 				initPrompt(privateKeyName)
 				// must return export function
@@ -141,6 +206,17 @@ func init() {
 				cli.StringFlag{Name: "name, n", Value: "node1"},
 				cli.StringFlag{Name: "privateKey, pvk"},
 				cli.BoolFlag{Name: "mining, m"},
+				cli.StringFlag{Name: "sequencer, seq", Usage: "Address of the sequencer, the node with its key orders the requests"},
+			},
+		},
+		cli.Command{
+			Name:  "migrate",
+			Usage: "Rewrite the orderbook database to the latest encoding, the node must be stopped",
+			Action: func(c *cli.Context) error {
+				return migrate(c.Int("p2pPort"))
+			},
+			Flags: []cli.Flag{
+				cli.IntFlag{Name: "p2pPort, p1", Value: demo.P2pPort},
 			},
 		},
 	}
@@ -212,12 +288,57 @@ func Start(p2pPort int, httpPort int, wsPort int, name string, privateKey string
 			case "updateOrder":
 				demo.LogInfo("-> Update order", "payload", results)
 				// put message on channel
-				go processOrder(results)
+				go amendOrder(results)
 			case "cancelOrder":
 				demo.LogInfo("-> Cancel order", "payload", results)
 				// put message on channel
 				go cancelOrder(results)
 
+			case "massCancel":
+				demo.LogInfo("-> Cancel all orders", "payload", results)
+				go massCancel(results)
+
+			case "verify":
+				demo.LogInfo("-> Verify orderbooks", "payload", results)
+				report := orderbookEngine.Verify(results["repair"] == "true")
+				demo.LogInfo(fmt.Sprintf("-> Verify result: %s", report), "ok", report.OK())
+
+			case "listPairs":
+				for _, pair := range orderbookEngine.ListPairs() {
+					demo.LogInfo(fmt.Sprintf("-> Pair: %s", pair))
+				}
+
+			case "addPair":
+				demo.LogInfo("-> Add pair", "payload", results)
+				if err := changePair(func() error { return addPair(results) }); err != nil {
+					demo.LogError("Add pair failed", "err", err)
+				}
+
+			case "suspendPair":
+				demo.LogInfo("-> Suspend pair", "payload", results)
+				if err := changePair(func() error { return orderbookEngine.SuspendPair(results["pair_name"]) }); err != nil {
+					demo.LogError("Suspend pair failed", "err", err)
+				}
+
+			case "resumePair":
+				demo.LogInfo("-> Resume pair", "payload", results)
+				if err := changePair(func() error { return orderbookEngine.ResumePair(results["pair_name"]) }); err != nil {
+					demo.LogError("Resume pair failed", "err", err)
+				}
+
+			case "delistPair":
+				demo.LogInfo("-> Delist pair", "payload", results)
+				var count uint64
+				err := changePair(func() (err error) {
+					count, err = orderbookEngine.DelistPair(results["pair_name"])
+					return err
+				})
+				if err != nil {
+					demo.LogError("Delist pair failed", "err", err)
+				} else {
+					demo.LogInfo("-> Pair delisted", "cancelled", count)
+				}
+
 			case "nodeAddr":
 				demo.LogInfo(fmt.Sprintf("-> Node Address: %s\n", nodeAddr()))
 
@@ -259,19 +380,53 @@ func nodeAddr() string {
 	return thisNode.Server().Self().String()
 }
 
+// setOwner : orders from the terminal are owned by the node key, each one with the next nonce
+func setOwner(payload map[string]string) {
+	payload["timestamp"] = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	payload["owner"] = crypto.PubkeyToAddress(privkey.PublicKey).Hex()
+	payload["nonce"] = strconv.FormatUint(atomic.AddUint64(&nonce, 1), 10)
+	payload["request_id"] = strconv.FormatUint(atomic.AddUint64(&requestID, 1), 10)
+}
+
+// broadcast : sign the message with the node key then send it to the peers
+func broadcast(msg protocol.SignedMsg) error {
+	if err := msg.Sign(privkey); err != nil {
+		return err
+	}
+	msgC <- msg
+	return nil
+}
+
 func processOrder(payload map[string]string) error {
 	// add order at this current node first
-	// get timestamp in milliseconds
-	payload["timestamp"] = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	setOwner(payload)
 	msg, err := protocol.NewOrderbookMsg(payload)
 	if err == nil {
 		// try to store into model, if success then process at local and broad cast
-		trades, orderInBook := orderbookEngine.ProcessOrder(payload)
-		demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook)
+		// with a sequencer, the order is processed when it comes back sequenced
+		if sequencerConfig == nil {
+			trades, orderInBook := orderbookEngine.ProcessOrder(payload)
+			demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook)
+		}
 
 		// broad cast message
-		msgC <- msg
+		err = broadcast(msg)
+	}
+
+	return err
+}
 
+func amendOrder(payload map[string]string) error {
+	setOwner(payload)
+	msg, err := protocol.NewOrderbookAmendMsg(payload)
+	if err == nil {
+		if sequencerConfig == nil {
+			trades, orderInBook := orderbookEngine.ProcessOrder(payload)
+			demo.LogInfo("Orderbook amend result", "Trade", trades, "OrderInBook", orderInBook)
+		}
+
+		// broad cast message
+		err = broadcast(msg)
 	}
 
 	return err
@@ -279,22 +434,74 @@ func processOrder(payload map[string]string) error {
 
 func cancelOrder(payload map[string]string) error {
 	// add order at this current node first
-	// get timestamp in milliseconds
-	payload["timestamp"] = strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
-	msg, err := protocol.NewOrderbookMsg(payload)
+	setOwner(payload)
+	msg, err := protocol.NewOrderbookCancelMsg(payload)
 	if err == nil {
 		// try to store into model, if success then process at local and broad cast
-		err := orderbookEngine.CancelOrder(payload)
-		demo.LogInfo("Orderbook cancel result", "err", err, "msg", msg)
+		if sequencerConfig == nil {
+			err := orderbookEngine.CancelOrder(payload)
+			demo.LogInfo("Orderbook cancel result", "err", err, "msg", msg)
+		}
 
 		// broad cast message
-		msgC <- msg
+		return broadcast(msg)
+	}
+
+	return err
+}
 
+func massCancel(payload map[string]string) error {
+	setOwner(payload)
+	msg, err := protocol.NewOrderbookMassCancelMsg(payload)
+	if err == nil {
+		if sequencerConfig == nil {
+			count, err := orderbookEngine.CancelOrdersBelowNonce(payload)
+			demo.LogInfo("Orderbook mass cancel result", "cancelled", count, "err", err)
+		}
+
+		// broad cast message
+		return broadcast(msg)
 	}
 
 	return err
 }
 
+// changePair : add a pair or change its status on this node only. It decides which requests are accepted and
+// delisting cancels the orders, so it is rejected when the requests are sequenced, the nodes would not apply
+// the same ones
+func changePair(change func() error) error {
+	if sequencerConfig != nil {
+		return fmt.Errorf("Pair can not be changed when the requests are sequenced by %s", sequencerConfig.Address.Hex())
+	}
+	return change()
+}
+
+func addPair(payload map[string]string) error {
+	if !common.IsHexAddress(payload["base_token"]) || !common.IsHexAddress(payload["quote_token"]) {
+		return fmt.Errorf("Token address is not correct :%s, %s", payload["base_token"], payload["quote_token"])
+	}
+	baseDecimals, err := strconv.ParseUint(payload["base_decimals"], 10, 64)
+	if err != nil {
+		return err
+	}
+	quoteDecimals, err := strconv.ParseUint(payload["quote_decimals"], 10, 64)
+	if err != nil {
+		return err
+	}
+	maxVolume, ok := new(big.Int).SetString(payload["max_volume"], 10)
+	if !ok {
+		return fmt.Errorf("Max volume is not correct :%s", payload["max_volume"])
+	}
+	return orderbookEngine.AddPair(&orderbook.PairItem{
+		Name:          payload["pair_name"],
+		BaseToken:     common.HexToAddress(payload["base_token"]),
+		QuoteToken:    common.HexToAddress(payload["quote_token"]),
+		BaseDecimals:  baseDecimals,
+		QuoteDecimals: quoteDecimals,
+		MaxVolume:     maxVolume,
+	})
+}
+
 func updateEthService() {
 	// make full node after start the node, then later register swarm service over that node
 	ethConfig, err := initGenesis(thisNode)
@@ -345,6 +552,27 @@ func updateExtraService(rpcapi []string) {
 
 }
 
+// rewrite the orderbook database of the node to the latest encoding, the node must be stopped
+func migrate(p2pPort int) error {
+	dataDir := fmt.Sprintf("%s%d", demo.DatadirPrefix, p2pPort)
+	orderbookDir := path.Join(dataDir, "orderbook")
+	backend, err := orderbook.NewLDBBackend(orderbookDir)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	var pairNames []string
+	for pairName := range allowedPairs {
+		pairNames = append(pairNames, pairName)
+	}
+	if err := orderbook.Migrate(backend, pairNames); err != nil {
+		return err
+	}
+	demo.LogInfo("Migrated orderbook database", "datadir", orderbookDir, "version", orderbook.EncodingVersion)
+	return nil
+}
+
 // simple ping and receive protocol
 func startup(p2pPort int, httpPort int, wsPort int, name string, privateKey string) {
 
@@ -353,6 +581,18 @@ func startup(p2pPort int, httpPort int, wsPort int, name string, privateKey stri
 	// get private key
 	privkey, err = crypto.LoadECDSA(privateKey)
 
+	if sequencerAddr != "" {
+		if !common.IsHexAddress(sequencerAddr) {
+			demo.LogCrit("Sequencer address is not correct", "sequencer", sequencerAddr)
+		}
+		sequencerConfig = &protocol.SequencerConfig{Address: common.HexToAddress(sequencerAddr)}
+		// this node is the sequencer
+		if crypto.PubkeyToAddress(privkey.PublicKey) == sequencerConfig.Address {
+			sequencerConfig.Key = privkey
+		}
+		demo.LogInfo("Requests are sequenced", "sequencer", sequencerConfig.Address.Hex(), "leader", sequencerConfig.Key != nil)
+	}
+
 	// register pss and orderbook service
 	rpcapi := []string{
 		// "eth",
@@ -361,14 +601,12 @@ func startup(p2pPort int, httpPort int, wsPort int, name string, privateKey stri
 	}
 	dataDir := fmt.Sprintf("%s%d", demo.DatadirPrefix, p2pPort)
 	orderbookDir := path.Join(dataDir, "orderbook")
-	allowedPairs := map[string]*big.Int{
-		"TOMO/WETH": big.NewInt(10e9),
-	}
 	orderbookEngine = orderbook.NewEngine(orderbookDir, allowedPairs)
+	nonce = orderbookEngine.GetNonce(crypto.PubkeyToAddress(privkey.PublicKey))
 
 	thisNode, err = demo.NewServiceNodeWithPrivateKeyAndDataDir(privkey, dataDir, p2pPort, httpPort, wsPort, rpcapi...)
 	// register normal service, protocol is for p2p, service is for rpc calls
-	service := protocol.NewService(msgC, quitC, orderbookEngine)
+	service := protocol.NewService(msgC, quitC, orderbookEngine, sequencerConfig, nil)
 	err = thisNode.Register(service)
 
 	if err != nil {
@@ -0,0 +1,300 @@
+package orderbook
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Backend : raw key-value storage used by BatchDatabase, missing keys return leveldb.ErrNotFound
+type Backend interface {
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	// NewBatch : group puts and deletes, so they are written at once
+	NewBatch() BackendBatch
+	// Iterate : call fn for each key with the prefix in ascending order, stop when fn returns false
+	Iterate(prefix []byte, fn func(key, value []byte) bool) error
+	// Snapshot : read-only view at this point, later writes are not seen
+	Snapshot() (BackendSnapshot, error)
+	Close()
+}
+
+// BackendSnapshot : must be released after use
+type BackendSnapshot interface {
+	Get(key []byte) ([]byte, error)
+	Has(key []byte) (bool, error)
+	Iterate(prefix []byte, fn func(key, value []byte) bool) error
+	Release()
+}
+
+// BackendBatch : writes are applied only when Write is called
+type BackendBatch interface {
+	Put(key []byte, value []byte)
+	Delete(key []byte)
+	Len() int
+	Write() error
+}
+
+// LDBBackend : leveldb storage on disk
+type LDBBackend struct {
+	db *ethdb.LDBDatabase
+}
+
+func NewLDBBackend(datadir string) (*LDBBackend, error) {
+	db, err := ethdb.NewLDBDatabase(datadir, 128, 1024)
+	if err != nil {
+		return nil, err
+	}
+	return &LDBBackend{db: db}, nil
+}
+
+func (backend *LDBBackend) Get(key []byte) ([]byte, error) {
+	return backend.db.Get(key)
+}
+
+func (backend *LDBBackend) Has(key []byte) (bool, error) {
+	return backend.db.Has(key)
+}
+
+func (backend *LDBBackend) Put(key []byte, value []byte) error {
+	return backend.db.Put(key, value)
+}
+
+func (backend *LDBBackend) Delete(key []byte) error {
+	return backend.db.Delete(key)
+}
+
+// NewBatch : ethdb batch does not support deletion, so use leveldb batch directly
+func (backend *LDBBackend) NewBatch() BackendBatch {
+	return &ldbBatch{db: backend.db.LDB(), batch: new(leveldb.Batch)}
+}
+
+func (backend *LDBBackend) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	it := backend.db.LDB().NewIterator(util.BytesPrefix(prefix), nil)
+	defer it.Release()
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Error()
+}
+
+func (backend *LDBBackend) Snapshot() (BackendSnapshot, error) {
+	snapshot, err := backend.db.LDB().GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &ldbSnapshot{snapshot: snapshot}, nil
+}
+
+func (backend *LDBBackend) Close() {
+	backend.db.Close()
+}
+
+type ldbSnapshot struct {
+	snapshot *leveldb.Snapshot
+}
+
+func (s *ldbSnapshot) Get(key []byte) ([]byte, error) {
+	return s.snapshot.Get(key, nil)
+}
+
+func (s *ldbSnapshot) Has(key []byte) (bool, error) {
+	return s.snapshot.Has(key, nil)
+}
+
+func (s *ldbSnapshot) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	it := s.snapshot.NewIterator(util.BytesPrefix(prefix), nil)
+	defer it.Release()
+	for it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			break
+		}
+	}
+	return it.Error()
+}
+
+func (s *ldbSnapshot) Release() {
+	s.snapshot.Release()
+}
+
+type ldbBatch struct {
+	db    *leveldb.DB
+	batch *leveldb.Batch
+}
+
+func (b *ldbBatch) Put(key []byte, value []byte) {
+	b.batch.Put(key, value)
+}
+
+func (b *ldbBatch) Delete(key []byte) {
+	b.batch.Delete(key)
+}
+
+func (b *ldbBatch) Len() int {
+	return b.batch.Len()
+}
+
+func (b *ldbBatch) Write() error {
+	return b.db.Write(b.batch, nil)
+}
+
+// MemBackend : in-memory storage for tests, simulations and benchmarks, it is safe for concurrent use
+type MemBackend struct {
+	lock sync.RWMutex
+	data map[string][]byte
+}
+
+func NewMemBackend() *MemBackend {
+	return &MemBackend{
+		data: make(map[string][]byte),
+	}
+}
+
+func (backend *MemBackend) Get(key []byte) ([]byte, error) {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	if value, ok := backend.data[string(key)]; ok {
+		return common.CopyBytes(value), nil
+	}
+	return nil, leveldb.ErrNotFound
+}
+
+func (backend *MemBackend) Has(key []byte) (bool, error) {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	_, ok := backend.data[string(key)]
+	return ok, nil
+}
+
+func (backend *MemBackend) Put(key []byte, value []byte) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.data[string(key)] = common.CopyBytes(value)
+	return nil
+}
+
+func (backend *MemBackend) Delete(key []byte) error {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	delete(backend.data, string(key))
+	return nil
+}
+
+func (backend *MemBackend) NewBatch() BackendBatch {
+	return &memBatch{backend: backend}
+}
+
+// Iterate : iterate over a copy of the matched items, so fn can write to the backend
+func (backend *MemBackend) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	backend.lock.RLock()
+	keys := sortedKeys(backend.data, prefix)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = common.CopyBytes(backend.data[key])
+	}
+	backend.lock.RUnlock()
+
+	for i, key := range keys {
+		if !fn([]byte(key), values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Snapshot : copy all items, it is only meant for tests and simulations
+func (backend *MemBackend) Snapshot() (BackendSnapshot, error) {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+	data := make(map[string][]byte, len(backend.data))
+	for key, value := range backend.data {
+		// values are never changed in place, so they can be shared
+		data[key] = value
+	}
+	return &memSnapshot{data: data}, nil
+}
+
+func (backend *MemBackend) Close() {}
+
+func sortedKeys(data map[string][]byte, prefix []byte) []string {
+	var keys []string
+	for key := range data {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type memSnapshot struct {
+	data map[string][]byte
+}
+
+func (s *memSnapshot) Get(key []byte) ([]byte, error) {
+	if value, ok := s.data[string(key)]; ok {
+		return common.CopyBytes(value), nil
+	}
+	return nil, leveldb.ErrNotFound
+}
+
+func (s *memSnapshot) Has(key []byte) (bool, error) {
+	_, ok := s.data[string(key)]
+	return ok, nil
+}
+
+func (s *memSnapshot) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	for _, key := range sortedKeys(s.data, prefix) {
+		if !fn([]byte(key), common.CopyBytes(s.data[key])) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memSnapshot) Release() {}
+
+type memWrite struct {
+	key     []byte
+	value   []byte
+	deleted bool
+}
+
+type memBatch struct {
+	backend *MemBackend
+	writes  []memWrite
+}
+
+func (b *memBatch) Put(key []byte, value []byte) {
+	b.writes = append(b.writes, memWrite{key: common.CopyBytes(key), value: common.CopyBytes(value)})
+}
+
+func (b *memBatch) Delete(key []byte) {
+	b.writes = append(b.writes, memWrite{key: common.CopyBytes(key), deleted: true})
+}
+
+func (b *memBatch) Len() int {
+	return len(b.writes)
+}
+
+func (b *memBatch) Write() error {
+	b.backend.lock.Lock()
+	defer b.backend.lock.Unlock()
+	for _, write := range b.writes {
+		if write.deleted {
+			delete(b.backend.data, string(write.key))
+		} else {
+			b.backend.data[string(write.key)] = write.value
+		}
+	}
+	return nil
+}
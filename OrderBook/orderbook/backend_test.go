@@ -0,0 +1,94 @@
+package orderbook
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+)
+
+func testBackend(t *testing.T, backend Backend) {
+	backend.Put([]byte("a/1"), []byte("1"))
+	backend.Put([]byte("a/3"), []byte("3"))
+	backend.Put([]byte("b/1"), []byte("x"))
+
+	batch := backend.NewBatch()
+	batch.Put([]byte("a/2"), []byte("2"))
+	batch.Delete([]byte("a/3"))
+	if ok, _ := backend.Has([]byte("a/2")); ok {
+		t.Error("batch must not be applied before write")
+	}
+	if err := batch.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, _ := backend.Has([]byte("a/3")); ok {
+		t.Error("key must be deleted by batch")
+	}
+	if _, err := backend.Get([]byte("a/3")); err == nil {
+		t.Error("get deleted key must return error")
+	}
+	if value, _ := backend.Get([]byte("a/2")); !bytes.Equal(value, []byte("2")) {
+		t.Errorf("value incorrect, got: %s, want: %s.", value, "2")
+	}
+
+	var keys []string
+	backend.Iterate([]byte("a/"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if len(keys) != 2 || keys[0] != "a/1" || keys[1] != "a/2" {
+		t.Errorf("iterate keys incorrect, got: %v", keys)
+	}
+
+	snapshot, err := backend.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	backend.Delete([]byte("a/1"))
+	if ok, _ := backend.Has([]byte("a/1")); ok {
+		t.Error("key must be deleted")
+	}
+	if value, _ := snapshot.Get([]byte("a/1")); !bytes.Equal(value, []byte("1")) {
+		t.Errorf("snapshot must not see later writes, got: %s", value)
+	}
+}
+
+func TestMemBackend(t *testing.T) {
+	testBackend(t, NewMemBackend())
+}
+
+func TestLDBBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orderbook-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend, err := NewLDBBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	testBackend(t, backend)
+}
+
+func TestEngineInMemory(t *testing.T) {
+	engine := NewEngineWithBackend(NewMemBackend(), map[string]*big.Int{"mem/test": ToBigInt("1")})
+	ob, err := engine.GetOrderBook("MEM/TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob.ProcessOrder(map[string]string{
+		"type": Limit, "side": Ask, "quantity": "5", "price": "101", "trade_id": "1",
+	}, false)
+	if err := engine.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if ob.Asks.Item.Volume.Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("volume incorrect, got: %s, want: %s.", ob.Asks.Item.Volume, "5")
+	}
+}
@@ -3,11 +3,13 @@ package orderbook
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"reflect"
+	"sync"
 
-	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/rlp"
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
 const (
@@ -15,20 +17,39 @@ const (
 	defaultMaxPending = 1024
 )
 
-// BatchItem : currently we do not support deletion batch, so ignore it
+// BatchItem : pending write, a deleted item is a tombstone that removes the key at next commit
 type BatchItem struct {
-	Value interface{}
-	// Deleted bool
+	Value   interface{}
+	Deleted bool
+	// snapshot : encoded value when a transaction begins, to restore it when the transaction is rolled back
+	snapshot []byte
 }
 
+// BatchTransaction : group the writes of one operation, like an order and all its fills,
+// so that they are applied or discarded together. Writes are kept apart from the pending items
+// until commit, so a rollback only discards them. Objects may be changed in place by the transaction,
+// pending ones are restored and the ones it read are dropped from the caches on rollback
+type BatchTransaction struct {
+	db    *BatchDatabase
+	items map[string]*BatchItem
+	reads map[string]bool
+}
+
+// BatchDatabase : pending items and transaction are guarded by a lock, so the database can be shared,
+// but a transaction must still be used by one writer at a time
 type BatchDatabase struct {
-	db             *ethdb.LDBDatabase
-	itemCacheLimit int
+	lock           sync.RWMutex
+	db             Backend
+	cacheConfig    *CacheConfig
 	itemMaxPending int
 	emptyKey       []byte
 	pendingItems   map[string]*BatchItem
-	cacheItems     *lru.Cache // Cache for reading
-	Debug          bool
+	// caches of decoded objects, filled when reading and committing
+	nodeCache  *itemCache
+	orderCache *itemCache
+	itemCache  *itemCache
+	tx         *BatchTransaction
+	Debug      bool
 
 	EncodeToBytes EncodeToBytes
 	DecodeBytes   DecodeBytes
@@ -41,25 +62,38 @@ func NewBatchDatabase(datadir string, cacheLimit, maxPending int) *BatchDatabase
 
 // batchdatabase is a fast cache db to retrieve in-mem object
 func NewBatchDatabaseWithEncode(datadir string, cacheLimit, maxPending int, encode EncodeToBytes, decode DecodeBytes) *BatchDatabase {
-	db, _ := ethdb.NewLDBDatabase(datadir, 128, 1024)
-	itemCacheLimit := defaultCacheLimit
-	if cacheLimit > 0 {
-		itemCacheLimit = cacheLimit
+	db, err := NewLDBBackend(datadir)
+	if err != nil {
+		fmt.Println("Can not open database :", err)
+		return nil
+	}
+	return NewBatchDatabaseWithBackend(db, cacheLimit, maxPending, encode, decode)
+}
+
+// NewBatchDatabaseWithBackend : batch database on top of any storage, like the in-memory backend
+func NewBatchDatabaseWithBackend(db Backend, cacheLimit, maxPending int, encode EncodeToBytes, decode DecodeBytes) *BatchDatabase {
+	return NewBatchDatabaseWithConfig(db, DefaultCacheConfig(cacheLimit), maxPending, encode, decode)
+}
+
+// NewBatchDatabaseWithConfig : batch database with a cache budget for each kind of item
+func NewBatchDatabaseWithConfig(db Backend, cacheConfig *CacheConfig, maxPending int, encode EncodeToBytes, decode DecodeBytes) *BatchDatabase {
+	if cacheConfig == nil {
+		cacheConfig = DefaultCacheConfig(0)
 	}
 	itemMaxPending := defaultMaxPending
 	if maxPending > 0 {
 		itemMaxPending = maxPending
 	}
 
-	cacheItems, _ := lru.New(defaultCacheLimit)
-
 	batchDB := &BatchDatabase{
 		db:             db,
 		EncodeToBytes:  encode,
 		DecodeBytes:    decode,
-		itemCacheLimit: itemCacheLimit,
+		cacheConfig:    cacheConfig,
 		itemMaxPending: itemMaxPending,
-		cacheItems:     cacheItems,
+		nodeCache:      newItemCache("node", cacheConfig.Nodes),
+		orderCache:     newItemCache("order", cacheConfig.Orders),
+		itemCache:      newItemCache("item", cacheConfig.Items),
 		emptyKey:       EmptyKey(), // pre alloc for comparison
 		pendingItems:   make(map[string]*BatchItem),
 	}
@@ -68,6 +102,33 @@ func NewBatchDatabaseWithEncode(datadir string, cacheLimit, maxPending int, enco
 
 }
 
+// cacheFor : each kind of item has its own cache, so orders can not evict the nodes of the price trees
+func (db *BatchDatabase) cacheFor(val interface{}) *itemCache {
+	switch val.(type) {
+	case *Item:
+		return db.nodeCache
+	case *OrderItem:
+		return db.orderCache
+	default:
+		return db.itemCache
+	}
+}
+
+func (db *BatchDatabase) removeFromCache(cacheKey string) {
+	db.nodeCache.Remove(cacheKey)
+	db.orderCache.Remove(cacheKey)
+	db.itemCache.Remove(cacheKey)
+}
+
+// CacheStats : counters of the caches by kind of item
+func (db *BatchDatabase) CacheStats() map[string]CacheStats {
+	return map[string]CacheStats{
+		"node":  db.nodeCache.Stats(),
+		"order": db.orderCache.Stats(),
+		"item":  db.itemCache.Stats(),
+	}
+}
+
 func (db *BatchDatabase) IsEmptyKey(key []byte) bool {
 	return key == nil || len(key) == 0 || bytes.Equal(key, db.emptyKey)
 }
@@ -76,18 +137,42 @@ func (db *BatchDatabase) getCacheKey(key []byte) string {
 	return hex.EncodeToString(key)
 }
 
+// pending : write of the key in the transaction, else in the pending items. Lock must be held by the caller
+func (db *BatchDatabase) pending(cacheKey string) (*BatchItem, bool) {
+	if db.tx != nil {
+		if item, ok := db.tx.items[cacheKey]; ok {
+			return item, true
+		}
+	}
+	item, ok := db.pendingItems[cacheKey]
+	return item, ok
+}
+
+// write : put the item in the transaction, else in the pending items. Lock must be held by the caller
+func (db *BatchDatabase) write(cacheKey string, item *BatchItem) error {
+	if db.tx != nil {
+		db.tx.items[cacheKey] = item
+		return nil
+	}
+	db.pendingItems[cacheKey] = item
+	return db.commitIfFull()
+}
+
 func (db *BatchDatabase) Has(key []byte) (bool, error) {
 	if db.IsEmptyKey(key) {
 		return false, nil
 	}
 	cacheKey := db.getCacheKey(key)
 
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
 	// has in pending and is not deleted
-	if _, ok := db.pendingItems[cacheKey]; ok { // && !pendingItem.Deleted {
-		return true, nil
+	if pendingItem, ok := db.pending(cacheKey); ok {
+		return !pendingItem.Deleted, nil
 	}
 
-	if db.cacheItems.Contains(cacheKey) {
+	if db.nodeCache.Contains(cacheKey) || db.orderCache.Contains(cacheKey) || db.itemCache.Contains(cacheKey) {
 		return true, nil
 	}
 
@@ -103,15 +188,33 @@ func (db *BatchDatabase) Get(key []byte, val interface{}) (interface{}, error) {
 
 	cacheKey := db.getCacheKey(key)
 
+	// hold the lock while reading the backend, so a commit can not happen in between
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if db.tx != nil {
+		if txItem, ok := db.tx.items[cacheKey]; ok {
+			if txItem.Deleted {
+				return nil, leveldb.ErrNotFound
+			}
+			return txItem.Value, nil
+		}
+	}
 	if pendingItem, ok := db.pendingItems[cacheKey]; ok {
-		// if pendingItem.Deleted {
-		// 	return nil, nil
-		// }
+		// deleted but not committed yet, same as not found in database
+		if pendingItem.Deleted {
+			return nil, leveldb.ErrNotFound
+		}
+		// the transaction may change it in place, its snapshot is dropped when the transaction is committed
+		if db.tx != nil {
+			db.tx.reads[cacheKey] = true
+		}
 		// we get value from the pending item
 		return pendingItem.Value, nil
 	}
 
-	if cached, ok := db.cacheItems.Get(cacheKey); ok {
+	cache := db.cacheFor(val)
+	if cached, ok := cache.Get(cacheKey); ok {
 		val = cached
 		if db.Debug {
 			fmt.Println("Cache hit :", cacheKey)
@@ -137,10 +240,14 @@ func (db *BatchDatabase) Get(key []byte, val interface{}) (interface{}, error) {
 		}
 
 		// update cache when reading
-		db.cacheItems.Add(cacheKey, val)
+		cache.Add(cacheKey, val)
 		// fmt.Println("DONE !!!!", cacheKey, val, err)
 
 	}
+	// cached object may be changed in place by the transaction
+	if db.tx != nil {
+		db.tx.reads[cacheKey] = true
+	}
 
 	return val, nil
 }
@@ -156,56 +263,62 @@ func (db *BatchDatabase) Put(key []byte, val interface{}) error {
 	// }
 
 	// fmt.Println("PUT", cacheKey, val)
-	db.pendingItems[cacheKey] = &BatchItem{Value: val}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.write(cacheKey, &BatchItem{Value: val})
+}
 
-	if len(db.pendingItems) >= db.itemMaxPending {
-		return db.Commit()
+// commit pending items when there are too many, but do not flush a half applied transaction,
+// lock must be held by the caller
+func (db *BatchDatabase) commitIfFull() error {
+	if db.tx == nil && len(db.pendingItems) >= db.itemMaxPending {
+		return db.commit()
 	}
 
 	// return db.Commit()
 	return nil
 }
 
-func (db *BatchDatabase) Delete(key []byte, force bool) error {
+// Delete : mark the key as deleted, it is removed from database with the next commit,
+// together with the pending puts, so a crash can not leave half of an update on disk
+func (db *BatchDatabase) Delete(key []byte) error {
 
-	// by default, we force delete both db and cache,
-	// for better performance, we can mark a Deleted flag, to do batch delete
 	cacheKey := db.getCacheKey(key)
 
-	// force delete everything
-	if force {
-		delete(db.pendingItems, cacheKey)
-		db.cacheItems.Remove(cacheKey)
-	} else {
-		if _, ok := db.pendingItems[cacheKey]; ok {
-			// item.Deleted = true
-			db.db.Delete(key)
-
-			// delete from pending Items
-			delete(db.pendingItems, cacheKey)
-			// remove cache key as well
-			db.cacheItems.Remove(cacheKey)
-			return nil
-		}
-	}
-
-	// cache not found, or force delete, must delete from database
-	return db.db.Delete(key)
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	// remove cache key as well
+	db.removeFromCache(cacheKey)
+	return db.write(cacheKey, &BatchItem{Deleted: true})
 }
 
 func (db *BatchDatabase) Commit() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.commit()
+}
 
+func (db *BatchDatabase) commit() error {
+
+	if db.tx != nil {
+		return errors.New("Can not commit database while transaction is in progress")
+	}
+
+	// puts and deletes are written at once
 	batch := db.db.NewBatch()
 	for cacheKey, item := range db.pendingItems {
 		key, _ := hex.DecodeString(cacheKey)
 
 		// fmt.Printf("key :%x, cacheKey :%s\n", key, cacheKey)
 
-		// if item.Deleted {
-		// 	db.db.Delete(key)
-		// 	// cache already has this item removed
-		// 	continue
-		// }
+		if item.Deleted {
+			batch.Delete(key)
+			// cache already has this item removed
+			if db.Debug {
+				fmt.Printf("Delete %x\n", key)
+			}
+			continue
+		}
 
 		value, err := db.EncodeToBytes(item.Value)
 		if err != nil {
@@ -214,13 +327,88 @@ func (db *BatchDatabase) Commit() error {
 		}
 
 		batch.Put(key, value)
+		// keep the object, so reading it again does not need decoding
+		db.cacheFor(item.Value).Add(cacheKey, item.Value)
 
 		if db.Debug {
 			fmt.Printf("Save %x, value :%s\n", key, ToJSON(item.Value))
 		}
 	}
-	// commit pending items does not affect the cache
 	db.pendingItems = make(map[string]*BatchItem)
 	// db.cacheItems.Purge()
 	return batch.Write()
 }
+
+// Begin : start a transaction, its writes are kept apart from the pending items of previous operations.
+// Pending items are encoded once, so they can be restored if the transaction changes them in place
+func (db *BatchDatabase) Begin() (*BatchTransaction, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.tx != nil {
+		return nil, errors.New("Transaction is already in progress")
+	}
+	for _, item := range db.pendingItems {
+		if item.Deleted || item.snapshot != nil {
+			continue
+		}
+		snapshot, err := db.EncodeToBytes(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		item.snapshot = snapshot
+	}
+	db.tx = &BatchTransaction{db: db, items: make(map[string]*BatchItem), reads: make(map[string]bool)}
+	return db.tx, nil
+}
+
+// Commit : add the writes of the transaction to the pending items, they are flushed with the next database commit
+func (tx *BatchTransaction) Commit() error {
+	db := tx.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.tx != tx {
+		return errors.New("Transaction is not in progress")
+	}
+	db.tx = nil
+
+	// objects read may have been changed in place, their snapshot is taken again by the next transaction
+	for cacheKey := range tx.reads {
+		if item, ok := db.pendingItems[cacheKey]; ok {
+			item.snapshot = nil
+		}
+	}
+	for cacheKey, item := range tx.items {
+		db.pendingItems[cacheKey] = item
+	}
+	return db.commitIfFull()
+}
+
+// Rollback : discard the writes of the transaction. Objects it read are shared with the caller and may have
+// been modified in place, cached ones are dropped and pending ones are restored
+func (tx *BatchTransaction) Rollback() error {
+	db := tx.db
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.tx != tx {
+		return errors.New("Transaction is not in progress")
+	}
+	db.tx = nil
+
+	for cacheKey := range tx.items {
+		db.removeFromCache(cacheKey)
+	}
+	for cacheKey := range tx.reads {
+		db.removeFromCache(cacheKey)
+	}
+	for _, item := range db.pendingItems {
+		if item.snapshot == nil {
+			continue
+		}
+		value := reflect.New(reflect.TypeOf(item.Value).Elem()).Interface()
+		if err := db.DecodeBytes(item.snapshot, value); err != nil {
+			return err
+		}
+		item.Value = value
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package orderbook
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBatchTransactionRollback(t *testing.T) {
+	key := []byte(fmt.Sprintf("TX/%d", time.Now().UnixNano()))
+	item := &OrderItem{Quantity: ToBigInt("10"), Price: ToBigInt("100")}
+	testDB.Put(key, item)
+
+	tx, err := testDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testDB.Begin(); err == nil {
+		t.Error("nested transaction must be rejected")
+	}
+
+	otherKey := append(key, []byte("/other")...)
+	testDB.Put(otherKey, &OrderItem{Quantity: ToBigInt("1"), Price: ToBigInt("1")})
+	testDB.Delete(key)
+	if ok, _ := testDB.Has(key); ok {
+		t.Error("deleted key must not be visible inside the transaction")
+	}
+	tx.Rollback()
+
+	if ok, _ := testDB.Has(otherKey); ok {
+		t.Error("put must be discarded by rollback")
+	}
+	val, err := testDB.Get(key, &OrderItem{})
+	if err != nil || val.(*OrderItem).Quantity.Cmp(item.Quantity) != 0 {
+		t.Errorf("deleted key must be restored by rollback, got: %v, %v", val, err)
+	}
+
+	tx, _ = testDB.Begin()
+	testDB.Delete(key)
+	tx.Commit()
+	if ok, _ := testDB.Has(key); ok {
+		t.Error("deleted key must be removed after commit")
+	}
+}
+
+func TestBatchTransactionPending(t *testing.T) {
+	db := NewBatchDatabaseWithBackend(NewMemBackend(), 0, 0, EncodeBytesItem, DecodeBytesItem)
+	key, otherKey := []byte("pending"), []byte("other")
+	db.Put(key, &OrderItem{Quantity: ToBigInt("10"), Price: ToBigInt("100")})
+	db.Put(otherKey, &OrderItem{Quantity: ToBigInt("1"), Price: ToBigInt("1")})
+
+	// pending items are batched, a transaction does not write them
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := db.db.Has(key); ok {
+		t.Error("pending items must not be written when a transaction begins")
+	}
+	// changed in place, then the transaction fails before the put
+	val, _ := db.Get(key, &OrderItem{})
+	val.(*OrderItem).Quantity = ToBigInt("3")
+	tx.Rollback()
+
+	val, err = db.Get(key, &OrderItem{})
+	if err != nil || val.(*OrderItem).Quantity.Cmp(ToBigInt("10")) != 0 {
+		t.Errorf("pending item must be restored by rollback, got: %v, %v", val, err)
+	}
+	if ok, _ := db.Has(otherKey); !ok || len(db.pendingItems) != 2 {
+		t.Errorf("rollback must keep the pending items, got: %d", len(db.pendingItems))
+	}
+
+	tx, _ = db.Begin()
+	db.Put(otherKey, &OrderItem{Quantity: ToBigInt("2"), Price: ToBigInt("1")})
+	tx.Commit()
+	if ok, _ := db.db.Has(otherKey); ok || len(db.pendingItems) != 2 {
+		t.Error("writes of the transaction must be pending after commit")
+	}
+	db.Commit()
+	val, err = NewBatchDatabaseWithBackend(db.db, 0, 0, EncodeBytesItem, DecodeBytesItem).Get(otherKey, &OrderItem{})
+	if err != nil || val.(*OrderItem).Quantity.Cmp(ToBigInt("2")) != 0 {
+		t.Errorf("committed item incorrect, got: %v, %v", val, err)
+	}
+}
+
+func TestOrderBookAtomicRollback(t *testing.T) {
+	// the test database is kept between runs, so use a fresh pair
+	orderBook := NewOrderBook(fmt.Sprintf("ATOMIC/%d", time.Now().UnixNano()), testDB)
+	orderBook.SetClock(FixedClock(1))
+	orderBook.ProcessOrder(map[string]string{
+		"type": Limit, "side": Ask, "quantity": "5", "price": "101", "trade_id": "1",
+	}, false)
+	root := orderBook.StateRoot()
+
+	err := orderBook.atomic(func() error {
+		orderBook.ProcessOrder(map[string]string{
+			"type": Limit, "side": Bid, "quantity": "2", "price": "101", "trade_id": "2",
+		}, false)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nested transaction fails, so the order is not applied
+	if orderBook.Asks.Item.Volume.Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("nested order must be rejected, got volume: %s", orderBook.Asks.Item.Volume)
+	}
+
+	err = orderBook.atomic(func() error {
+		orderBook.Asks.RemovePrice(ToBigInt("101"))
+		return errors.New("failed")
+	})
+	if err == nil || orderBook.StateRoot() != root {
+		t.Errorf("book must be restored after error, got: %v", err)
+	}
+
+	err = orderBook.atomic(func() error {
+		orderBook.Bids.InsertOrder(map[string]string{
+			"type": Limit, "side": Bid, "quantity": "1", "price": "90", "trade_id": "3",
+			"timestamp": "1", "order_id": "100",
+		})
+		panic("crash")
+	})
+	if err == nil || orderBook.StateRoot() != root || orderBook.Bids.Depth() != 0 {
+		t.Errorf("book must be restored after panic, got: %v", err)
+	}
+}
+
+func TestBatchDatabaseDelete(t *testing.T) {
+	key := []byte(fmt.Sprintf("DELETE/%d", time.Now().UnixNano()))
+	testDB.Put(key, &OrderItem{Quantity: ToBigInt("10"), Price: ToBigInt("100")})
+	testDB.Commit()
+
+	testDB.Delete(key)
+	if ok, _ := testDB.Has(key); ok {
+		t.Error("deleted key must not be visible before commit")
+	}
+	if val, err := testDB.Get(key, &OrderItem{}); err == nil {
+		t.Errorf("deleted key must not be found, got: %v", val)
+	}
+	// still in database until commit
+	if ok, _ := testDB.db.Has(key); !ok {
+		t.Error("deletion must wait for the commit")
+	}
+
+	testDB.Commit()
+	if ok, _ := testDB.db.Has(key); ok {
+		t.Error("deleted key must be removed from database after commit")
+	}
+
+	// put after delete restores the key
+	testDB.Delete(key)
+	testDB.Put(key, &OrderItem{Quantity: ToBigInt("1"), Price: ToBigInt("100")})
+	testDB.Commit()
+	if ok, _ := testDB.db.Has(key); !ok {
+		t.Error("key must be written again after put")
+	}
+}
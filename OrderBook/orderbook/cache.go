@@ -0,0 +1,113 @@
+package orderbook
+
+import (
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// CacheConfig : number of decoded objects kept in memory for each kind of item
+type CacheConfig struct {
+	Nodes      int // nodes of the price trees
+	OrderLists int // order lists of each order tree
+	Orders     int
+	Items      int // others like orderbook and order tree information
+}
+
+// DefaultCacheConfig : same budget for every kind of item, default limit is used when limit is not set
+func DefaultCacheConfig(limit int) *CacheConfig {
+	if limit <= 0 {
+		limit = defaultCacheLimit
+	}
+	return &CacheConfig{
+		Nodes:      limit,
+		OrderLists: limit,
+		Orders:     limit,
+		Items:      limit,
+	}
+}
+
+// CacheStats : counters of a cache, they are also exported as metrics under orderbook/cache/<name>
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// itemCache : lru cache of decoded objects with hit, miss and eviction counters
+type itemCache struct {
+	cache *lru.Cache
+	stats CacheStats
+	// objects removed on purpose are not counted as evictions
+	removing bool
+
+	hitCounter      metrics.Counter
+	missCounter     metrics.Counter
+	evictionCounter metrics.Counter
+}
+
+func newItemCache(name string, limit int) *itemCache {
+	if limit <= 0 {
+		limit = defaultCacheLimit
+	}
+	c := &itemCache{
+		hitCounter:      metrics.GetOrRegisterCounter("orderbook/cache/"+name+"/hits", nil),
+		missCounter:     metrics.GetOrRegisterCounter("orderbook/cache/"+name+"/misses", nil),
+		evictionCounter: metrics.GetOrRegisterCounter("orderbook/cache/"+name+"/evictions", nil),
+	}
+	c.cache, _ = lru.NewWithEvict(limit, func(key interface{}, value interface{}) {
+		if c.removing {
+			return
+		}
+		atomic.AddUint64(&c.stats.Evictions, 1)
+		c.evictionCounter.Inc(1)
+	})
+	return c
+}
+
+func (c *itemCache) Get(key string) (interface{}, bool) {
+	value, ok := c.cache.Get(key)
+	if ok {
+		atomic.AddUint64(&c.stats.Hits, 1)
+		c.hitCounter.Inc(1)
+	} else {
+		atomic.AddUint64(&c.stats.Misses, 1)
+		c.missCounter.Inc(1)
+	}
+	return value, ok
+}
+
+func (c *itemCache) Add(key string, value interface{}) {
+	c.cache.Add(key, value)
+}
+
+func (c *itemCache) Contains(key string) bool {
+	return c.cache.Contains(key)
+}
+
+func (c *itemCache) Remove(key string) {
+	c.removing = true
+	c.cache.Remove(key)
+	c.removing = false
+}
+
+// Purge : drop all objects, it is not counted as eviction
+func (c *itemCache) Purge() {
+	// purge calls the eviction callback for each item
+	c.removing = true
+	c.cache.Purge()
+	c.removing = false
+}
+
+func (c *itemCache) Len() int {
+	return c.cache.Len()
+}
+
+func (c *itemCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:      atomic.LoadUint64(&c.stats.Hits),
+		Misses:    atomic.LoadUint64(&c.stats.Misses),
+		Evictions: atomic.LoadUint64(&c.stats.Evictions),
+	}
+}
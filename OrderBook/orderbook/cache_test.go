@@ -0,0 +1,52 @@
+package orderbook
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBatchDatabaseCache(t *testing.T) {
+	config := DefaultCacheConfig(0)
+	config.Orders = 2
+	db := NewBatchDatabaseWithConfig(NewMemBackend(), config, 0, EncodeBytesItem, DecodeBytesItem)
+
+	// commit each order, so they are cached in order and the first one is evicted
+	for i := 0; i < 3; i++ {
+		db.Put([]byte(fmt.Sprintf("order%d", i)), &OrderItem{Quantity: ToBigInt("1"), Price: ToBigInt("1")})
+		db.Commit()
+	}
+	db.Put([]byte("node"), &Item{Keys: &KeyMeta{}, Value: []byte("value")})
+	db.Commit()
+
+	// committed objects are kept in their own cache, only the orders are evicted
+	stats := db.CacheStats()
+	if stats["order"].Evictions != 1 || stats["node"].Evictions != 0 {
+		t.Errorf("evictions incorrect, got: %v", stats)
+	}
+
+	db.Get([]byte("order2"), &OrderItem{})
+	db.Get([]byte("order0"), &OrderItem{})
+	db.Get([]byte("node"), &Item{})
+	stats = db.CacheStats()
+	if stats["order"].Hits != 1 || stats["order"].Misses != 1 || stats["node"].Hits != 1 {
+		t.Errorf("hits and misses incorrect, got: %v", stats)
+	}
+}
+
+func TestOrderListCache(t *testing.T) {
+	orderBook := NewOrderBook("CACHE/TEST", NewBatchDatabaseWithBackend(NewMemBackend(), 0, 0, EncodeBytesItem, DecodeBytesItem))
+	orderBook.ProcessOrder(map[string]string{
+		"type": Limit, "side": Ask, "quantity": "5", "price": "101", "trade_id": "1",
+	}, false)
+
+	before := orderBook.Asks.CacheStats()
+	orderList := orderBook.Asks.PriceList(ToBigInt("101"))
+	if orderList == nil || orderBook.Asks.CacheStats().Hits != before.Hits+1 {
+		t.Errorf("order list must be cached, got: %v", orderBook.Asks.CacheStats())
+	}
+
+	orderBook.Asks.RemovePrice(ToBigInt("101"))
+	if orderBook.Asks.PriceList(ToBigInt("101")) != nil {
+		t.Error("removed order list must not be cached")
+	}
+}
@@ -0,0 +1,36 @@
+package orderbook
+
+import (
+	"strconv"
+	"time"
+)
+
+// Clock : source of time for the orderbook, inject a custom one to make processing deterministic
+// for replication and replay, or to assert on times in tests
+type Clock interface {
+	// Now returns current timestamp, in the same unit as the order timestamps
+	Now() uint64
+}
+
+// SystemClock : default clock, using local time in seconds
+type SystemClock struct{}
+
+func (clock SystemClock) Now() uint64 {
+	return uint64(time.Now().Unix())
+}
+
+// FixedClock : always return the same timestamp
+type FixedClock uint64
+
+func (clock FixedClock) Now() uint64 {
+	return uint64(clock)
+}
+
+// get timestamp from the quote, 0 mean the quote does not carry any timestamp
+func quoteTimestamp(quote map[string]string) uint64 {
+	timestamp, err := strconv.ParseUint(quote["timestamp"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return timestamp
+}
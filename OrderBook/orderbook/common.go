@@ -12,6 +12,9 @@ type EncodeToBytes func(interface{}) ([]byte, error)
 type DecodeBytes func([]byte, interface{}) error
 type FormatBytes func([]byte) string
 
+// Weight : volume of a stored value, used by the price tree statistics
+type Weight func([]byte) *big.Int
+
 const (
 	TrueByte  = byte(1)
 	FalseByte = byte(0)
@@ -127,14 +130,6 @@ func BigIntToBigFloat(a *big.Int) *big.Float {
 	return b
 }
 
-func ToDecimal(value *big.Int) float64 {
-	bigFloatValue := BigIntToBigFloat(value)
-	result := DivFloat(bigFloatValue, big.NewFloat(1e18))
-
-	floatValue, _ := result.Float64()
-	return floatValue
-}
-
 func DivFloat(x, y *big.Float) *big.Float {
 	return big.NewFloat(0).Quo(x, y)
 }
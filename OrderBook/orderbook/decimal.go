@@ -0,0 +1,120 @@
+package orderbook
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// DefaultDecimals : decimals of a token when the pair does not configure them, like ether
+const DefaultDecimals uint64 = 18
+
+// MaxDecimals : more decimals are rejected, so the scale stays in a reasonable range
+const MaxDecimals uint64 = 77
+
+// Prices are in quote units for one whole base token, so a pair with 18 base decimals and
+// 6 quote decimals has price 1500000 for 1.5 quote per base.
+// Quantities are in base units.
+
+// DecimalScale : 10^decimals
+func DecimalScale(decimals uint64) *big.Int {
+	return Exp(big.NewInt(10), new(big.Int).SetUint64(decimals))
+}
+
+// ToUnits : convert a decimal string like "1.25" to integer units of a token with decimals,
+// more fractional digits than decimals are rejected instead of rounded
+func ToUnits(value string, decimals uint64) (*big.Int, error) {
+	if decimals > MaxDecimals {
+		return nil, fmt.Errorf("Decimals %d is greater than %d", decimals, MaxDecimals)
+	}
+	value = strings.TrimSpace(value)
+	negative := strings.HasPrefix(value, "-")
+	if negative {
+		value = value[1:]
+	}
+
+	parts := strings.Split(value, ".")
+	if len(parts) > 2 || value == "" || value == "." {
+		return nil, fmt.Errorf("Decimal is not correct :%s", value)
+	}
+	integer, fraction := parts[0], ""
+	if len(parts) == 2 {
+		fraction = strings.TrimRight(parts[1], "0")
+	}
+	if uint64(len(fraction)) > decimals {
+		return nil, fmt.Errorf("Decimal %s has more than %d fractional digits", value, decimals)
+	}
+	digits := integer + fraction + strings.Repeat("0", int(decimals)-len(fraction))
+	if strings.ContainsAny(digits, "+-") {
+		return nil, fmt.Errorf("Decimal is not correct :%s", value)
+	}
+	result, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return nil, fmt.Errorf("Decimal is not correct :%s", value)
+	}
+	if negative {
+		result.Neg(result)
+	}
+	return result, nil
+}
+
+// FromUnits : convert integer units of a token with decimals to a decimal string, trailing zeros
+// of the fraction are removed
+func FromUnits(value *big.Int, decimals uint64) string {
+	if value == nil {
+		return "0"
+	}
+	if decimals == 0 {
+		return value.String()
+	}
+	integer, fraction := new(big.Int).QuoRem(new(big.Int).Abs(value), DecimalScale(decimals), new(big.Int))
+	result := integer.String()
+	if fraction.Sign() > 0 {
+		digits := fraction.String()
+		digits = strings.Repeat("0", int(decimals)-len(digits)) + digits
+		result += "." + strings.TrimRight(digits, "0")
+	}
+	if value.Sign() < 0 {
+		result = "-" + result
+	}
+	return result
+}
+
+// ToDecimal : approximate value of integer units of a token with decimals, for display only
+func ToDecimal(value *big.Int, decimals uint64) float64 {
+	bigFloatValue := BigIntToBigFloat(value)
+	result := DivFloat(bigFloatValue, BigIntToBigFloat(DecimalScale(decimals)))
+
+	floatValue, _ := result.Float64()
+	return floatValue
+}
+
+// Notional : value of quantity base units at price, in quote units. It is rounded down
+func (pair *PairItem) Notional(price, quantity *big.Int) *big.Int {
+	return Div(Mul(price, quantity), DecimalScale(pair.BaseDecimals))
+}
+
+// ParsePrice : price in quote per base like "1.5" to the raw price
+func (pair *PairItem) ParsePrice(value string) (*big.Int, error) {
+	return ToUnits(value, pair.QuoteDecimals)
+}
+
+// FormatPrice : raw price to quote per base
+func (pair *PairItem) FormatPrice(price *big.Int) string {
+	return FromUnits(price, pair.QuoteDecimals)
+}
+
+// ParseQuantity : amount of base token like "2.5" to base units
+func (pair *PairItem) ParseQuantity(value string) (*big.Int, error) {
+	return ToUnits(value, pair.BaseDecimals)
+}
+
+// FormatQuantity : base units to amount of base token
+func (pair *PairItem) FormatQuantity(quantity *big.Int) string {
+	return FromUnits(quantity, pair.BaseDecimals)
+}
+
+// FormatNotional : quote units to amount of quote token
+func (pair *PairItem) FormatNotional(notional *big.Int) string {
+	return FromUnits(notional, pair.QuoteDecimals)
+}
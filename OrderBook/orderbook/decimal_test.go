@@ -0,0 +1,59 @@
+package orderbook
+
+import (
+	"testing"
+)
+
+func TestDecimalUnits(t *testing.T) {
+	valid := []struct {
+		value    string
+		decimals uint64
+		units    string
+		decimal  string
+	}{
+		{"1.25", 18, "1250000000000000000", "1.25"},
+		{"0.000001", 6, "1", "0.000001"},
+		{".5", 1, "5", "0.5"},
+		{"3.", 2, "300", "3"},
+		{"2.500", 2, "250", "2.5"},
+		{"-1.5", 6, "-1500000", "-1.5"},
+		{"42", 0, "42", "42"},
+	}
+	for _, test := range valid {
+		units, err := ToUnits(test.value, test.decimals)
+		if err != nil || units.String() != test.units {
+			t.Errorf("ToUnits(%s, %d) incorrect, got: %v, %v, want: %s.", test.value, test.decimals, units, err, test.units)
+			continue
+		}
+		if decimal := FromUnits(units, test.decimals); decimal != test.decimal {
+			t.Errorf("FromUnits(%s, %d) incorrect, got: %s, want: %s.", units, test.decimals, decimal, test.decimal)
+		}
+	}
+
+	for _, value := range []string{"", ".", "1.2.3", "1.234", "abc", "1e5", "--1", "1.-2"} {
+		if _, err := ToUnits(value, 2); err == nil {
+			t.Errorf("ToUnits(%s) must be rejected", value)
+		}
+	}
+}
+
+func TestPairNotional(t *testing.T) {
+	// 18 decimals base, 6 decimals quote like TOMO/USDT
+	pair := &PairItem{Name: "tomo/usdt", BaseDecimals: 18, QuoteDecimals: 6}
+	price, _ := pair.ParsePrice("1.5")
+	quantity, _ := pair.ParseQuantity("2.5")
+	if price.String() != "1500000" {
+		t.Errorf("price incorrect, got: %s", price)
+	}
+
+	notional := pair.Notional(price, quantity)
+	if notional.String() != "3750000" || pair.FormatNotional(notional) != "3.75" {
+		t.Errorf("notional incorrect, got: %s", notional)
+	}
+	if pair.FormatPrice(price) != "1.5" || pair.FormatQuantity(quantity) != "2.5" {
+		t.Errorf("format incorrect, got: %s, %s", pair.FormatPrice(price), pair.FormatQuantity(quantity))
+	}
+	if value := ToDecimal(quantity, pair.BaseDecimals); value != 2.5 {
+		t.Errorf("ToDecimal incorrect, got: %v", value)
+	}
+}
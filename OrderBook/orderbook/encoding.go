@@ -2,24 +2,55 @@ package orderbook
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
+// Every encoded item starts with a version header byte, so that a layout can be changed later
+// while existing databases can still be decoded. Items written before the header was introduced
+// are version 0, they are only decoded by DecodeLegacyBytesItem when migrating the database.
+// When a layout changes, bump its version, keep the decoder of the old one, bump EncodingVersion
+// and register a migration.
+const (
+	nodeItemVersion      byte = 2 // version 2 adds subtree size and volume
+	orderItemVersion     byte = 2 // version 2 adds owner and nonce
+	orderListItemVersion byte = 1
+	orderTreeItemVersion byte = 1
+	orderBookItemVersion byte = 1
+
+	versionHeaderLength = 1
+)
+
+// allocate the encoded bytes with version header, and return the part after the header for the layout
+func newEncodedBytes(version byte, length int) ([]byte, []byte) {
+	encoded := make([]byte, versionHeaderLength+length)
+	encoded[0] = version
+	return encoded, encoded[versionHeaderLength:]
+}
+
+func splitEncodedBytes(bytes []byte) (byte, []byte, error) {
+	if len(bytes) < versionHeaderLength {
+		return 0, nil, errors.New("Encoded item is empty")
+	}
+	return bytes[0], bytes[versionHeaderLength:], nil
+}
+
 // Node item
 func EncodeBytesNodeItem(item *Item) ([]byte, error) {
 	// try with order item
 	start := 3 * common.HashLength
 
-	// red-black is 1 byte
-	totalLength := start + 1
+	// red-black is 1 byte, size is 8 bytes then volume
+	totalLength := start + 1 + 8 + common.HashLength
 	if item.Value != nil {
 		totalLength += len(item.Value)
 	}
 
-	returnBytes := make([]byte, totalLength)
+	encoded, returnBytes := newEncodedBytes(nodeItemVersion, totalLength)
 
 	if item.Keys != nil {
 		copy(returnBytes[0:common.HashLength], item.Keys.Left)
@@ -30,16 +61,58 @@ func EncodeBytesNodeItem(item *Item) ([]byte, error) {
 	start++
 	// returnBytes[start] = bool2byte(item.Deleted)
 	// start++
+	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.Size)
+	start += 8
+	if item.Volume != nil {
+		copy(returnBytes[start:start+common.HashLength], common.BigToHash(item.Volume).Bytes())
+	}
+	start += common.HashLength
 	if start < totalLength {
 		copy(returnBytes[start:], item.Value)
 	}
 
 	// fmt.Printf("value :%x\n", returnBytes)
 
-	return returnBytes, nil
+	return encoded, nil
 }
 
 func DecodeBytesNodeItem(bytes []byte, item *Item) error {
+	version, body, err := splitEncodedBytes(bytes)
+	if err != nil {
+		return err
+	}
+	switch version {
+	case 1:
+		return decodeNodeItemBody(body, item)
+	case nodeItemVersion:
+		return decodeNodeItemBodyV2(body, item)
+	}
+	return fmt.Errorf("Unsupported node item encoding version :%d", version)
+}
+
+// layout of version 2, statistics are stored between the color and the value
+func decodeNodeItemBodyV2(bytes []byte, item *Item) error {
+	start := 3*common.HashLength + 1
+	if len(bytes) < start+8+common.HashLength {
+		return errors.New("Node item is too short")
+	}
+	// keys and color have the same layout as version 1
+	if err := decodeNodeItemBody(bytes[:start], item); err != nil {
+		return err
+	}
+	item.Size = binary.BigEndian.Uint64(bytes[start : start+8])
+	start += 8
+	item.Volume = new(big.Int).SetBytes(bytes[start : start+common.HashLength])
+	start += common.HashLength
+	if start < len(bytes) {
+		item.Value = make([]byte, len(bytes)-start)
+		copy(item.Value, bytes[start:])
+	}
+	return nil
+}
+
+// layout without version header, used by version 0 and 1
+func decodeNodeItemBody(bytes []byte, item *Item) error {
 	// try with OrderItem
 	start := 3 * common.HashLength
 	totalLength := len(bytes)
@@ -77,11 +150,12 @@ func EncodeBytesOrderItem(item *OrderItem) ([]byte, error) {
 	start := 2 * common.HashLength
 	totalLength := start + 3*common.HashLength // next, prev, orderlist
 	// uint64 is 8 byte
-	totalLength += 8 // timestamp
+	totalLength += 8                        // timestamp
+	totalLength += common.AddressLength + 8 // owner, nonce
 	// the left is tradeID, maybe fix byte
 	totalLength += len(item.TradeID)
 
-	returnBytes := make([]byte, totalLength)
+	encoded, returnBytes := newEncodedBytes(orderItemVersion, totalLength)
 
 	if item.Quantity != nil {
 		copy(returnBytes[0:common.HashLength], common.BigToHash(item.Quantity).Bytes())
@@ -102,6 +176,12 @@ func EncodeBytesOrderItem(item *OrderItem) ([]byte, error) {
 	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.Timestamp)
 	start += 8
 
+	copy(returnBytes[start:start+common.AddressLength], item.Owner.Bytes())
+	start += common.AddressLength
+
+	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.Nonce)
+	start += 8
+
 	// returnBytes[start] = bool2byte(item.Deleted)
 	// start++
 	if start < totalLength {
@@ -110,10 +190,46 @@ func EncodeBytesOrderItem(item *OrderItem) ([]byte, error) {
 
 	// fmt.Printf("value :%x\n", returnBytes)
 
-	return returnBytes, nil
+	return encoded, nil
 }
 
 func DecodeBytesOrderItem(bytes []byte, item *OrderItem) error {
+	version, body, err := splitEncodedBytes(bytes)
+	if err != nil {
+		return err
+	}
+	switch version {
+	case 1:
+		return decodeOrderItemBody(body, item)
+	case orderItemVersion:
+		return decodeOrderItemBodyV2(body, item)
+	}
+	return fmt.Errorf("Unsupported order item encoding version :%d", version)
+}
+
+// layout of version 2, owner and nonce are between timestamp and tradeID
+func decodeOrderItemBodyV2(bytes []byte, item *OrderItem) error {
+	start := 5*common.HashLength + 8
+	if len(bytes) < start+common.AddressLength+8 {
+		return fmt.Errorf("Order item is too short :%d", len(bytes))
+	}
+	// fixed fields are the same as version 1, tradeID is decoded again below
+	if err := decodeOrderItemBody(bytes[:start], item); err != nil {
+		return err
+	}
+
+	item.Owner = common.BytesToAddress(bytes[start : start+common.AddressLength])
+	start += common.AddressLength
+
+	item.Nonce = binary.BigEndian.Uint64(bytes[start : start+8])
+	start += 8
+
+	item.TradeID = string(bytes[start:])
+	return nil
+}
+
+// layout without version header, used by version 0 and 1
+func decodeOrderItemBody(bytes []byte, item *OrderItem) error {
 	// try with OrderItem
 	start := 0
 	totalLength := len(bytes)
@@ -175,7 +291,7 @@ func EncodeBytesOrderListItem(item *OrderListItem) ([]byte, error) {
 	// uint64 is 8 byte
 	totalLength += 8 // length
 
-	returnBytes := make([]byte, totalLength)
+	encoded, returnBytes := newEncodedBytes(orderListItemVersion, totalLength)
 
 	if item.Volume != nil {
 		copy(returnBytes[0:common.HashLength], common.BigToHash(item.Volume).Bytes())
@@ -190,10 +306,23 @@ func EncodeBytesOrderListItem(item *OrderListItem) ([]byte, error) {
 	start += common.HashLength
 	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.Length)
 
-	return returnBytes, nil
+	return encoded, nil
 }
 
 func DecodeBytesOrderListItem(bytes []byte, item *OrderListItem) error {
+	version, body, err := splitEncodedBytes(bytes)
+	if err != nil {
+		return err
+	}
+	switch version {
+	case orderListItemVersion:
+		return decodeOrderListItemBody(body, item)
+	}
+	return fmt.Errorf("Unsupported order list item encoding version :%d", version)
+}
+
+// layout without version header, used by version 0 and 1
+func decodeOrderListItemBody(bytes []byte, item *OrderListItem) error {
 	// try with OrderItem
 	start := 0
 	// make it crash it wrong format, no need to check length
@@ -243,7 +372,7 @@ func EncodeBytesOrderTreeItem(item *OrderTreeItem) ([]byte, error) {
 	// uint64 is 8 byte
 	totalLength += 8 * 2 // NumOrders and PriceTreeSize
 
-	returnBytes := make([]byte, totalLength)
+	encoded, returnBytes := newEncodedBytes(orderTreeItemVersion, totalLength)
 
 	if item.Volume != nil {
 		copy(returnBytes[0:common.HashLength], common.BigToHash(item.Volume).Bytes())
@@ -257,10 +386,23 @@ func EncodeBytesOrderTreeItem(item *OrderTreeItem) ([]byte, error) {
 
 	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.PriceTreeSize)
 
-	return returnBytes, nil
+	return encoded, nil
 }
 
 func DecodeBytesOrderTreeItem(bytes []byte, item *OrderTreeItem) error {
+	version, body, err := splitEncodedBytes(bytes)
+	if err != nil {
+		return err
+	}
+	switch version {
+	case orderTreeItemVersion:
+		return decodeOrderTreeItemBody(body, item)
+	}
+	return fmt.Errorf("Unsupported order tree item encoding version :%d", version)
+}
+
+// layout without version header, used by version 0 and 1
+func decodeOrderTreeItemBody(bytes []byte, item *OrderTreeItem) error {
 	// try with OrderItem
 	start := 0
 	// make it crash it wrong format, no need to check length
@@ -300,7 +442,7 @@ func EncodeBytesOrderBookItem(item *OrderBookItem) ([]byte, error) {
 	totalLength := start + 2*8 // Timestamp and NextOrderID
 	totalLength += len(item.Name)
 
-	returnBytes := make([]byte, totalLength)
+	encoded, returnBytes := newEncodedBytes(orderBookItemVersion, totalLength)
 
 	binary.BigEndian.PutUint64(returnBytes[start:start+8], item.Timestamp)
 	start += 8
@@ -311,10 +453,23 @@ func EncodeBytesOrderBookItem(item *OrderBookItem) ([]byte, error) {
 		copy(returnBytes[start:], item.Name)
 	}
 
-	return returnBytes, nil
+	return encoded, nil
 }
 
 func DecodeBytesOrderBookItem(bytes []byte, item *OrderBookItem) error {
+	version, body, err := splitEncodedBytes(bytes)
+	if err != nil {
+		return err
+	}
+	switch version {
+	case orderBookItemVersion:
+		return decodeOrderBookItemBody(body, item)
+	}
+	return fmt.Errorf("Unsupported order book item encoding version :%d", version)
+}
+
+// layout without version header, used by version 0 and 1
+func decodeOrderBookItemBody(bytes []byte, item *OrderBookItem) error {
 	// try with OrderItem
 	start := 0
 	totalLength := len(bytes)
@@ -369,3 +524,22 @@ func DecodeBytesItem(bytes []byte, val interface{}) error {
 	}
 
 }
+
+// DecodeLegacyBytesItem : decode items written before the version header was introduced
+func DecodeLegacyBytesItem(bytes []byte, val interface{}) error {
+
+	switch val.(type) {
+	case *Item:
+		return decodeNodeItemBody(bytes, val.(*Item))
+	case *OrderItem:
+		return decodeOrderItemBody(bytes, val.(*OrderItem))
+	case *OrderListItem:
+		return decodeOrderListItemBody(bytes, val.(*OrderListItem))
+	case *OrderTreeItem:
+		return decodeOrderTreeItemBody(bytes, val.(*OrderTreeItem))
+	case *OrderBookItem:
+		return decodeOrderBookItemBody(bytes, val.(*OrderBookItem))
+	default:
+		return rlp.DecodeBytes(bytes, val)
+	}
+}
@@ -5,67 +5,201 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	demo "github.com/tomochain/orderbook/common"
 )
 
-// Engine : singleton orderbook for testing
+// Engine : singleton orderbook for testing.
+// It is safe for concurrent use, each pair has its own database on the shared backend and its own lock,
+// so writes to one pair are serialized while different pairs are processed in parallel
 type Engine struct {
+	// lock guards the map of loaded orderbooks, the pair registry and the clock
+	lock       sync.RWMutex
 	Orderbooks map[string]*OrderBook
-	db         *BatchDatabase
-	// pair and max volume ...
-	allowedPairs map[string]*big.Int
+	// db is used for the schema version and the pair registry, orderbooks use the database of their pair
+	db *BatchDatabase
+	// registered pairs by lower case name, loaded from the database
+	pairs map[string]*PairItem
+	clock Clock
+	// nonceLock serializes the nonce checks of an owner across pairs
+	nonceLock sync.Mutex
+	// last nonce of the owners, nonces of the operations in progress and the pairs where nonces are stored
+	nonces      map[common.Address]uint64
+	usingNonces map[common.Address]map[uint64]bool
+	noncePairs  map[string]bool
+	// sequence of the last applied operation and the last operations, see Sequence and Journal
+	sequenceLock   sync.Mutex
+	sequence       uint64
+	journalEntries []*JournalEntry
+	// pairSequences : sequence of the pairs synced from a peer, the engine is at it when all pairs are synced
+	pairSequences map[string]uint64
+	// journalFrom : the book of the pair was imported at the sequence, operations before are not in the journal
+	journalFrom map[string]uint64
+	// journalPruned : operations up to the sequence are not in the journal, they are dropped or before a restart
+	journalPruned uint64
 }
 
+// NewEngine : allowed pairs with their max volume are registered as active pairs with default decimals
+// when they are not in the registry yet, other pairs can be added at runtime
 func NewEngine(datadir string, allowedPairs map[string]*big.Int) *Engine {
 	// demo.LogDebug("Creating model", "signerAddress", signer.Address().Hex())
 	batchDB := NewBatchDatabaseWithEncode(datadir, 0, 0,
 		EncodeBytesItem, DecodeBytesItem)
+	return newEngine(batchDB, allowedPairs)
+}
 
-	fixAllowedPairs := make(map[string]*big.Int)
-	for key, value := range allowedPairs {
-		fixAllowedPairs[strings.ToLower(key)] = value
+// NewEngineWithBackend : engine on top of the given storage, use NewMemBackend to run fully in memory
+func NewEngineWithBackend(backend Backend, allowedPairs map[string]*big.Int) *Engine {
+	batchDB := NewBatchDatabaseWithBackend(backend, 0, 0,
+		EncodeBytesItem, DecodeBytesItem)
+	return newEngine(batchDB, allowedPairs)
+}
+
+func newEngine(batchDB *BatchDatabase, allowedPairs map[string]*big.Int) *Engine {
+	// older database can not be decoded with current layout
+	if err := checkSchemaVersion(batchDB); err != nil {
+		demo.LogCrit("Orderbook database is not up to date", "err", err)
 	}
 
 	orderbooks := &Engine{
-		Orderbooks:   make(map[string]*OrderBook),
-		db:           batchDB,
-		allowedPairs: fixAllowedPairs,
+		Orderbooks: make(map[string]*OrderBook),
+		db:         batchDB,
+		pairs:      make(map[string]*PairItem),
+		clock:      SystemClock{},
+
+		nonces:      make(map[common.Address]uint64),
+		usingNonces: make(map[common.Address]map[uint64]bool),
+		noncePairs:  make(map[string]bool),
+
+		pairSequences: make(map[string]uint64),
+		journalFrom:   make(map[string]uint64),
+	}
+
+	if err := orderbooks.loadPairs(); err != nil {
+		demo.LogCrit("Pair registry can not be loaded", "err", err)
+	}
+	orderbooks.sequence = orderbooks.loadSequence()
+	orderbooks.journalPruned = orderbooks.sequence
+
+	// delisted pairs stay delisted even if they are still configured
+	for key, value := range allowedPairs {
+		name := strings.ToLower(key)
+		if _, ok := orderbooks.pairs[name]; ok {
+			continue
+		}
+		err := orderbooks.AddPair(&PairItem{
+			Name:          name,
+			BaseDecimals:  DefaultDecimals,
+			QuoteDecimals: DefaultDecimals,
+			MaxVolume:     value,
+		})
+		if err != nil {
+			demo.LogCrit("Register pair failed", "pair", name, "err", err)
+		}
 	}
 
 	return orderbooks
 }
 
+// SetClock : inject the clock for all orderbooks, both loaded and created later
+func (engine *Engine) SetClock(clock Clock) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	engine.clock = clock
+	for _, ob := range engine.Orderbooks {
+		ob.lock.Lock()
+		ob.SetClock(clock)
+		ob.lock.Unlock()
+	}
+}
+
+// GetOrderBook : the orderbook is returned without lock, use ReadOrderBook or WithOrderBook
+// when the engine is used by other goroutines
 func (engine *Engine) GetOrderBook(pairName string) (*OrderBook, error) {
 	return engine.getAndCreateIfNotExisted(pairName)
 }
 
-func (engine *Engine) hasOrderBook(name string) bool {
-	_, ok := engine.Orderbooks[name]
-	return ok
+// ReadOrderBook : call fn with the shared lock of the orderbook, for queries that do not change it
+func (engine *Engine) ReadOrderBook(pairName string, fn func(ob *OrderBook) error) error {
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return err
+	}
+	ob.lock.RLock()
+	defer ob.lock.RUnlock()
+	return fn(ob)
+}
+
+// WithOrderBook : call fn with the exclusive lock of the orderbook, for updates and for queries
+// that update cached states like state root and proofs
+func (engine *Engine) WithOrderBook(pairName string, fn func(ob *OrderBook) error) error {
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return err
+	}
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	return fn(ob)
 }
 
 // commit for all orderbooks
 func (engine *Engine) Commit() error {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	for _, ob := range engine.Orderbooks {
+		ob.lock.Lock()
+		err := ob.db.Commit()
+		ob.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
 	return engine.db.Commit()
 }
 
+// newPairDatabase : each pair has its own pending items, cache and transaction, on the same backend
+func (engine *Engine) newPairDatabase() *BatchDatabase {
+	return NewBatchDatabaseWithConfig(engine.db.db, engine.db.cacheConfig, engine.db.itemMaxPending,
+		engine.db.EncodeToBytes, engine.db.DecodeBytes)
+}
+
 func (engine *Engine) getAndCreateIfNotExisted(pairName string) (*OrderBook, error) {
 
 	name := strings.ToLower(pairName)
 
-	if !engine.hasOrderBook(name) {
-		// check allow pair
-		if _, ok := engine.allowedPairs[name]; !ok {
-			return nil, fmt.Errorf("Orderbook not found for pair :%s", pairName)
-		}
+	engine.lock.RLock()
+	ob, ok := engine.Orderbooks[name]
+	engine.lock.RUnlock()
+	if ok {
+		return ob, nil
+	}
 
-		// then create one
-		ob := NewOrderBook(name, engine.db)
-		if ob != nil {
-			ob.Restore()
-			engine.Orderbooks[name] = ob
-		}
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	// created by another goroutine while waiting for the lock
+	if ob, ok := engine.Orderbooks[name]; ok {
+		return ob, nil
+	}
+
+	// check registered pair, a delisted pair is kept only while it is loaded
+	pair, ok := engine.pairs[name]
+	if !ok {
+		return nil, fmt.Errorf("Orderbook not found for pair :%s", pairName)
+	}
+	if pair.Status == PairDelisted {
+		return nil, fmt.Errorf("Pair is delisted :%s", pairName)
+	}
+
+	// then create one
+	ob = NewOrderBook(name, engine.newPairDatabase())
+	if ob != nil {
+		ob.SetClock(engine.clock)
+		ob.status = pair.Status
+		ob.Restore()
+		engine.Orderbooks[name] = ob
 	}
 
 	// return from map
@@ -73,57 +207,166 @@ func (engine *Engine) getAndCreateIfNotExisted(pairName string) (*OrderBook, err
 }
 
 func (engine *Engine) GetOrder(pairName, orderID string) *Order {
-	ob, _ := engine.getAndCreateIfNotExisted(pairName)
-	if ob == nil {
+	var order *Order
+	engine.ReadOrderBook(pairName, func(ob *OrderBook) error {
+		order = ob.GetOrder(GetKeyFromString(orderID))
 		return nil
-	}
-	key := GetKeyFromString(orderID)
-	return ob.GetOrder(key)
+	})
+	return order
 }
 
-func (engine *Engine) ProcessOrder(quote map[string]string) ([]map[string]string, map[string]string) {
+// StateRoot : merkle root over the state roots of all pairs that are not delisted, ordered by pair name.
+// The root of a pair is read with the shared lock, the exclusive lock is only taken when it changed
+func (engine *Engine) StateRoot() common.Hash {
+	return PairsRoot(engine.PairRoots())
+}
 
-	ob, _ := engine.getAndCreateIfNotExisted(quote["pair_name"])
-	var trades []map[string]string
-	var orderInBook map[string]string
+// PairRoots : names of the pairs that are not delisted, ordered by name, and the state root of each,
+// pairs that can not be read are left out
+func (engine *Engine) PairRoots() ([]string, []common.Hash) {
+	names := engine.pairNames()
 
-	if ob != nil {
-		// get map as general input, we can set format later to make sure there is no problem
-		orderID, err := strconv.ParseUint(quote["order_id"], 10, 64)
-		if err == nil {
-			// insert
-			if orderID == 0 {
-				demo.LogInfo("Process order")
-				trades, orderInBook = ob.ProcessOrder(quote, true)
-			} else {
-				demo.LogInfo("Update order")
-				err = ob.UpdateOrder(quote)
-				if err != nil {
-					demo.LogInfo("Update order failed", "quote", quote, "err", err)
-				}
+	pairs := make([]string, 0, len(names))
+	roots := make([]common.Hash, 0, len(names))
+	for _, name := range names {
+		var root common.Hash
+		cached := false
+		err := engine.ReadOrderBook(name, func(ob *OrderBook) error {
+			root, cached = ob.cachedStateRoot()
+			return nil
+		})
+		if err != nil {
+			continue
+		}
+		if !cached {
+			err = engine.WithOrderBook(name, func(ob *OrderBook) error {
+				root = ob.StateRoot()
+				return nil
+			})
+			if err != nil {
+				continue
 			}
 		}
+		pairs = append(pairs, name)
+		roots = append(roots, root)
+	}
+	return pairs, roots
+}
 
+// PairsRoot : state root of the engine from the roots of its pairs, empty hash if they do not match
+func PairsRoot(names []string, roots []common.Hash) common.Hash {
+	if len(names) != len(roots) {
+		return common.Hash{}
+	}
+	leaves := make([]common.Hash, 0, len(names))
+	for i, name := range names {
+		leaves = append(leaves, crypto.Keccak256Hash([]byte(name), roots[i].Bytes()))
 	}
+	return MerkleRoot(leaves)
+}
 
-	return trades, orderInBook
+// GetOrderProof : merkle proof of the order in the orderbook of the pair
+func (engine *Engine) GetOrderProof(pairName, orderID string) (*OrderProof, error) {
+	var proof *OrderProof
+	err := engine.WithOrderBook(pairName, func(ob *OrderBook) (err error) {
+		proof, err = ob.GetOrderProof(GetKeyFromString(orderID))
+		return err
+	})
+	return proof, err
+}
 
+func (engine *Engine) ProcessOrder(quote map[string]string) ([]map[string]string, map[string]string) {
+	trades, orderInBook, err := engine.ProcessQuote(quote)
+	if err != nil {
+		demo.LogInfo("Order rejected", "quote", quote, "err", err)
+	}
+	return trades, orderInBook
 }
 
-func (engine *Engine) CancelOrder(quote map[string]string) error {
+// ProcessQuote : like ProcessOrder, also return why the quote is rejected. A new order gets its order id
+// in the quote, an update with order id greater than 0 does not return trades
+func (engine *Engine) ProcessQuote(quote map[string]string) ([]map[string]string, map[string]string, error) {
+	// the quote is changed by matching
+	original := copyQuote(quote)
 	ob, err := engine.getAndCreateIfNotExisted(quote["pair_name"])
-	if ob != nil {
-		orderID, err := strconv.ParseUint(quote["order_id"], 10, 64)
-		if err == nil {
+	if ob == nil {
+		return nil, nil, err
+	}
 
-			price, ok := new(big.Int).SetString(quote["price"], 10)
-			if !ok {
-				return fmt.Errorf("Price is not correct :%s", quote["price"])
-			}
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	trades, orderInBook, err := engine.processQuote(ob, quote, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	return trades, orderInBook, engine.nextSequence(JournalOrder, ob.Item.Name, original, trades)
+}
 
-			return ob.CancelOrder(quote["side"], orderID, price)
+// processQuote : insert or update the order of the quote, the caller holds the lock of the orderbook.
+// The nonce of an operation replayed from a journal is not checked
+func (engine *Engine) processQuote(ob *OrderBook, quote map[string]string, replay bool) ([]map[string]string, map[string]string, error) {
+	if ob.status != PairActive {
+		return nil, nil, fmt.Errorf("Pair %s is %s", ob.Item.Name, ob.status)
+	}
+	// get map as general input, we can set format later to make sure there is no problem
+	orderID, err := strconv.ParseUint(quote["order_id"], 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Order id is not correct :%s", quote["order_id"])
+	}
+
+	var trades []map[string]string
+	var orderInBook map[string]string
+	err = engine.withNonce(ob, quote, replay, func() (err error) {
+		// insert
+		if orderID == 0 {
+			demo.LogInfo("Process order")
+			trades, orderInBook, err = ob.processOrder(quote, true)
+			return err
 		}
+
+		demo.LogInfo("Update order")
+		if err := ob.CheckOwner(quote, orderID); err != nil {
+			return err
+		}
+		return ob.UpdateOrder(quote)
+	})
+	if err != nil {
+		return nil, nil, err
 	}
+	return trades, orderInBook, nil
+}
 
-	return err
+func (engine *Engine) CancelOrder(quote map[string]string) error {
+	ob, err := engine.getAndCreateIfNotExisted(quote["pair_name"])
+	if ob == nil {
+		return err
+	}
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	if err := engine.cancelOrder(ob, quote, false); err != nil {
+		return err
+	}
+	return engine.nextSequence(JournalCancel, ob.Item.Name, copyQuote(quote), nil)
+}
+
+// cancelOrder : cancel the order of the quote, the caller holds the lock of the orderbook
+func (engine *Engine) cancelOrder(ob *OrderBook, quote map[string]string, replay bool) error {
+	// resting orders of a suspended pair can still be cancelled
+	if ob.status == PairDelisted {
+		return fmt.Errorf("Pair is delisted :%s", ob.Item.Name)
+	}
+	orderID, err := strconv.ParseUint(quote["order_id"], 10, 64)
+	if err != nil {
+		return err
+	}
+	price, ok := new(big.Int).SetString(quote["price"], 10)
+	if !ok {
+		return fmt.Errorf("Price is not correct :%s", quote["price"])
+	}
+	if err := ob.CheckOwner(quote, orderID); err != nil {
+		return err
+	}
+	return engine.withNonce(ob, quote, replay, func() error {
+		return ob.CancelOrder(quote["side"], orderID, price, quoteTimestamp(quote))
+	})
 }
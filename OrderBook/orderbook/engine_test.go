@@ -0,0 +1,152 @@
+package orderbook
+
+import (
+	"math/big"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func testPairOrders(pairName string, count int) []map[string]string {
+	orders := make([]map[string]string, count)
+	for i := range orders {
+		side, price := Ask, 100+(i*7)%20
+		if i%2 == 1 {
+			side, price = Bid, 90+(i*13)%20
+		}
+		orders[i] = map[string]string{
+			"pair_name": pairName,
+			"order_id":  "0",
+			"type":      Limit,
+			"side":      side,
+			"quantity":  strconv.Itoa(1 + i%5),
+			"price":     strconv.Itoa(price),
+			"trade_id":  strconv.Itoa(i),
+		}
+	}
+	return orders
+}
+
+func TestEngineConcurrent(t *testing.T) {
+	pairs := map[string]*big.Int{"aaa/tomo": ToBigInt("1"), "bbb/tomo": ToBigInt("1"), "ccc/tomo": ToBigInt("1"), "ddd/tomo": ToBigInt("1")}
+	engine := NewEngineWithBackend(NewMemBackend(), pairs)
+	engine.SetClock(FixedClock(1))
+
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	for name := range pairs {
+		// one writer for each pair keeps the order of its orders, different pairs run in parallel
+		writers.Add(1)
+		go func(name string) {
+			defer writers.Done()
+			for _, order := range testPairOrders(name, 200) {
+				if _, _, err := engine.ProcessQuote(order); err != nil {
+					t.Errorf("order of %s rejected: %v", name, err)
+				}
+			}
+		}(name)
+
+		readers.Add(1)
+		go func(name string) {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				engine.GetOrder(name, "1")
+				engine.ReadOrderBook(name, func(ob *OrderBook) error {
+					ob.BestBid()
+					ob.PriceLevel(Ask, 1)
+					ob.VolumeBetterThan(Bid, ToBigInt("95"))
+					return nil
+				})
+				engine.StateRoot()
+				engine.ReadSnapshot(name, func(ob *OrderBook) error {
+					ob.BestPriceLists(Ask, 5)
+					return nil
+				})
+			}
+		}(name)
+	}
+
+	// commits happen while orders are processed
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				engine.Commit()
+			}
+		}
+	}()
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	if err := engine.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// same result as processing each pair alone
+	for name := range pairs {
+		serial := NewEngineWithBackend(NewMemBackend(), map[string]*big.Int{name: ToBigInt("1")})
+		serial.SetClock(FixedClock(1))
+		for _, order := range testPairOrders(name, 200) {
+			if _, _, err := serial.ProcessQuote(order); err != nil {
+				t.Errorf("order of %s rejected: %v", name, err)
+			}
+		}
+		var got, want common.Hash
+		engine.WithOrderBook(name, func(ob *OrderBook) error {
+			got = ob.StateRoot()
+			return nil
+		})
+		serial.WithOrderBook(name, func(ob *OrderBook) error {
+			want = ob.StateRoot()
+			return nil
+		})
+		if got != want {
+			t.Errorf("state root of %s incorrect, got: %x, want: %x.", name, got, want)
+		}
+	}
+}
+
+func TestEngineOrderOwner(t *testing.T) {
+	engine := NewEngineWithBackend(NewMemBackend(), map[string]*big.Int{"tomo/weth": ToBigInt("1")})
+	owner := common.HexToAddress("0x01").Hex()
+	engine.ProcessOrder(map[string]string{
+		"pair_name": "TOMO/WETH", "order_id": "0", "type": Limit, "side": Ask, "quantity": "5", "price": "101",
+		"trade_id": "1", "owner": owner, "nonce": "1",
+	})
+	order := engine.GetOrder("TOMO/WETH", "1")
+	if order == nil || order.Item.Owner.Hex() != owner || order.Item.Nonce != 1 {
+		t.Fatalf("order owner incorrect, got: %v", order)
+	}
+
+	cancel := map[string]string{"pair_name": "TOMO/WETH", "order_id": "1", "side": Ask, "price": "101",
+		"owner": common.HexToAddress("0x02").Hex()}
+	if err := engine.CancelOrder(cancel); err == nil {
+		t.Error("cancel by another owner must be rejected")
+	}
+	amend := map[string]string{"pair_name": "TOMO/WETH", "order_id": "1", "type": Limit, "side": Ask, "quantity": "2",
+		"price": "101", "trade_id": "1", "owner": common.HexToAddress("0x02").Hex()}
+	engine.ProcessOrder(amend)
+	if order := engine.GetOrder("TOMO/WETH", "1"); order.Item.Quantity.Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("amend by another owner must be rejected, got: %s", order.Item.Quantity)
+	}
+
+	cancel["owner"] = owner
+	if err := engine.CancelOrder(cancel); err != nil {
+		t.Errorf("cancel by the owner failed :%v", err)
+	}
+	if order := engine.GetOrder("TOMO/WETH", "1"); order != nil {
+		t.Errorf("order must be cancelled, got: %v", order)
+	}
+}
@@ -38,16 +38,17 @@ func (iterator *Iterator) Next() bool {
 		iterator.node = left
 		goto between
 	}
-	if iterator.node.Item.Keys.Right != nil {
+	// stored nodes use empty key instead of nil for missing links
+	if !iterator.tree.IsEmptyKey(iterator.node.RightKey()) {
 		iterator.node = iterator.node.Right(iterator.tree)
-		for iterator.node.Item.Keys.Left != nil {
+		for !iterator.tree.IsEmptyKey(iterator.node.LeftKey()) {
 			iterator.node = iterator.node.Left(iterator.tree)
 		}
 		goto between
 	}
-	if iterator.node.Item.Keys.Parent != nil {
+	if !iterator.tree.IsEmptyKey(iterator.node.ParentKey()) {
 		node := iterator.node
-		for iterator.node.Item.Keys.Parent != nil {
+		for !iterator.tree.IsEmptyKey(iterator.node.ParentKey()) {
 			iterator.node = iterator.node.Parent(iterator.tree)
 			if iterator.tree.Comparator(node.Key, iterator.node.Key) <= 0 {
 				goto between
@@ -80,16 +81,16 @@ func (iterator *Iterator) Prev() bool {
 		iterator.node = right
 		goto between
 	}
-	if iterator.node.Item.Keys.Left != nil {
+	if !iterator.tree.IsEmptyKey(iterator.node.LeftKey()) {
 		iterator.node = iterator.node.Left(iterator.tree)
-		for iterator.node.Item.Keys.Right != nil {
+		for !iterator.tree.IsEmptyKey(iterator.node.RightKey()) {
 			iterator.node = iterator.node.Right(iterator.tree)
 		}
 		goto between
 	}
-	if iterator.node.Item.Keys.Parent != nil {
+	if !iterator.tree.IsEmptyKey(iterator.node.ParentKey()) {
 		node := iterator.node
-		for iterator.node.Item.Keys.Parent != nil {
+		for !iterator.tree.IsEmptyKey(iterator.node.ParentKey()) {
 			iterator.node = iterator.node.Parent(iterator.tree)
 			if iterator.tree.Comparator(node.Key, iterator.node.Key) >= 0 {
 				goto between
@@ -148,3 +149,12 @@ func (iterator *Iterator) Last() bool {
 	iterator.End()
 	return iterator.Prev()
 }
+
+// IteratorAt returns a stateful iterator positioned at the node, so Next() and Prev() continue from it
+// without walking from the min or max node. Node must belong to the tree.
+func (tree *Tree) IteratorAt(node *Node) Iterator {
+	if node == nil {
+		return tree.Iterator()
+	}
+	return Iterator{tree: tree, node: node, position: between}
+}
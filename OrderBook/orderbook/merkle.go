@@ -0,0 +1,176 @@
+package orderbook
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// MerkleProofNode : sibling hash on the path from a leaf to the root
+type MerkleProofNode struct {
+	Hash common.Hash `json:"hash"`
+	// sibling is on the left side, so it is hashed first
+	Left bool `json:"left"`
+}
+
+// leaves and nodes are hashed with different prefixes, so a node can not be proved as a leaf
+const (
+	leafPrefix byte = 0x00
+	nodePrefix byte = 0x01
+)
+
+// hashLeaf : hash of the fields of a leaf
+func hashLeaf(fields ...[]byte) common.Hash {
+	return crypto.Keccak256Hash(append([][]byte{{leafPrefix}}, fields...)...)
+}
+
+func hashPair(left, right common.Hash) common.Hash {
+	return crypto.Keccak256Hash([]byte{nodePrefix}, left.Bytes(), right.Bytes())
+}
+
+// next level of the merkle tree, the last node is promoted as is when the level has odd length
+func merkleLevel(nodes []common.Hash) []common.Hash {
+	next := make([]common.Hash, 0, (len(nodes)+1)/2)
+	for i := 0; i < len(nodes); i += 2 {
+		if i+1 < len(nodes) {
+			next = append(next, hashPair(nodes[i], nodes[i+1]))
+		} else {
+			next = append(next, nodes[i])
+		}
+	}
+	return next
+}
+
+// MerkleRoot : root of the binary merkle tree built from leaves, empty hash if there is no leaf
+func MerkleRoot(leaves []common.Hash) common.Hash {
+	if len(leaves) == 0 {
+		return common.Hash{}
+	}
+	nodes := leaves
+	for len(nodes) > 1 {
+		nodes = merkleLevel(nodes)
+	}
+	return nodes[0]
+}
+
+// MerkleProof : return the proof that leaves[index] belongs to MerkleRoot(leaves)
+func MerkleProof(leaves []common.Hash, index int) []MerkleProofNode {
+	if index < 0 || index >= len(leaves) {
+		return nil
+	}
+	var proof []MerkleProofNode
+	nodes := leaves
+	for len(nodes) > 1 {
+		// promoted node does not need a sibling
+		if index%2 == 1 {
+			proof = append(proof, MerkleProofNode{Hash: nodes[index-1], Left: true})
+		} else if index+1 < len(nodes) {
+			proof = append(proof, MerkleProofNode{Hash: nodes[index+1], Left: false})
+		}
+		nodes = merkleLevel(nodes)
+		index /= 2
+	}
+	return proof
+}
+
+// ComputeMerkleRoot : fold the proof from leaf, to compare with the expected root
+func ComputeMerkleRoot(leaf common.Hash, proof []MerkleProofNode) common.Hash {
+	hash := leaf
+	for _, node := range proof {
+		if node.Left {
+			hash = hashPair(node.Hash, hash)
+		} else {
+			hash = hashPair(hash, node.Hash)
+		}
+	}
+	return hash
+}
+
+// VerifyMerkleProof : check the leaf belongs to the tree with this root
+func VerifyMerkleProof(leaf common.Hash, proof []MerkleProofNode, root common.Hash) bool {
+	return ComputeMerkleRoot(leaf, proof) == root
+}
+
+// merkleTree : nodes of all levels of a merkle tree from the leaves to the root, so a change of leaves
+// only hashes the nodes that depend on them
+type merkleTree struct {
+	levels [][]common.Hash
+}
+
+// Root : root of the tree, empty hash if there is no leaf
+func (tree *merkleTree) Root() common.Hash {
+	if len(tree.levels) == 0 || len(tree.levels[0]) == 0 {
+		return common.Hash{}
+	}
+	return tree.levels[len(tree.levels)-1][0]
+}
+
+// Leaves : leaves of the tree, they must not be changed
+func (tree *merkleTree) Leaves() []common.Hash {
+	if len(tree.levels) == 0 {
+		return nil
+	}
+	return tree.levels[0]
+}
+
+// Update : replace the leaves, the ones before from must be the same. Nodes on the left of the first
+// changed leaf are kept, the others are hashed again
+func (tree *merkleTree) Update(leaves []common.Hash, from int) {
+	if len(tree.levels) == 0 {
+		tree.levels = [][]common.Hash{nil}
+	}
+	tree.levels[0] = append([]common.Hash(nil), leaves...)
+	level := 0
+	for ; len(tree.levels[level]) > 1; level++ {
+		if level+1 == len(tree.levels) {
+			tree.levels = append(tree.levels, nil)
+		}
+		nodes, next := tree.levels[level], tree.levels[level+1]
+		from /= 2
+		if from > len(next) {
+			from = len(next)
+		}
+		next = next[:from]
+		for i := from * 2; i < len(nodes); i += 2 {
+			if i+1 < len(nodes) {
+				next = append(next, hashPair(nodes[i], nodes[i+1]))
+			} else {
+				next = append(next, nodes[i])
+			}
+		}
+		tree.levels[level+1] = next
+	}
+	tree.levels = tree.levels[:level+1]
+}
+
+// Set : replace a leaf, only the nodes on its path are hashed again
+func (tree *merkleTree) Set(index int, leaf common.Hash) {
+	tree.levels[0][index] = leaf
+	for level := 0; level+1 < len(tree.levels); level++ {
+		nodes := tree.levels[level]
+		left := index &^ 1
+		index /= 2
+		if left+1 < len(nodes) {
+			tree.levels[level+1][index] = hashPair(nodes[left], nodes[left+1])
+		} else {
+			tree.levels[level+1][index] = nodes[left]
+		}
+	}
+}
+
+// Proof : proof of the leaf at the index, from the cached nodes
+func (tree *merkleTree) Proof(index int) []MerkleProofNode {
+	if index < 0 || index >= len(tree.Leaves()) {
+		return nil
+	}
+	var proof []MerkleProofNode
+	for level := 0; level+1 < len(tree.levels); level++ {
+		nodes := tree.levels[level]
+		if index%2 == 1 {
+			proof = append(proof, MerkleProofNode{Hash: nodes[index-1], Left: true})
+		} else if index+1 < len(nodes) {
+			proof = append(proof, MerkleProofNode{Hash: nodes[index+1], Left: false})
+		}
+		index /= 2
+	}
+	return proof
+}
@@ -0,0 +1,70 @@
+package orderbook
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestMerkleProof(t *testing.T) {
+	if MerkleRoot(nil) != (common.Hash{}) {
+		t.Errorf("Merkle root of empty leaves incorrect, got: %x", MerkleRoot(nil))
+	}
+
+	for size := 1; size <= 9; size++ {
+		leaves := make([]common.Hash, size)
+		for i := range leaves {
+			leaves[i] = crypto.Keccak256Hash([]byte{byte(i)})
+		}
+		root := MerkleRoot(leaves)
+		for i := range leaves {
+			proof := MerkleProof(leaves, i)
+			if !VerifyMerkleProof(leaves[i], proof, root) {
+				t.Errorf("Merkle proof incorrect, size: %d, index: %d", size, i)
+			}
+			// other leaf must not match the same proof
+			if size > 1 && VerifyMerkleProof(leaves[(i+1)%size], proof, root) {
+				t.Errorf("Merkle proof accepts wrong leaf, size: %d, index: %d", size, i)
+			}
+		}
+	}
+}
+
+func TestMerkleTree(t *testing.T) {
+	a, b := crypto.Keccak256Hash([]byte{1}), crypto.Keccak256Hash([]byte{2})
+	if hashLeaf(a.Bytes(), b.Bytes()) == hashPair(a, b) {
+		t.Error("leaf and node must be hashed with different prefixes")
+	}
+
+	// the cached tree must have the root and the proofs of the tree built again from its leaves
+	random := rand.New(rand.NewSource(27))
+	tree := &merkleTree{}
+	var leaves []common.Hash
+	for step := 0; step < 200; step++ {
+		leaf := crypto.Keccak256Hash([]byte{byte(step), byte(step >> 8)})
+		index := 0
+		if len(leaves) > 0 {
+			index = random.Intn(len(leaves))
+		}
+		switch op := random.Intn(3); {
+		case op == 0 && len(leaves) > 0:
+			leaves[index] = leaf
+			tree.Set(index, leaf)
+		case op == 1 && len(leaves) > 0:
+			leaves = append(leaves[:index:index], leaves[index+1:]...)
+			tree.Update(leaves, index)
+		default:
+			leaves = append(leaves[:index:index], append([]common.Hash{leaf}, leaves[index:]...)...)
+			tree.Update(leaves, index)
+		}
+		if tree.Root() != MerkleRoot(leaves) {
+			t.Fatalf("Merkle tree root incorrect at step %d, size: %d", step, len(leaves))
+		}
+		if len(leaves) > 0 && !reflect.DeepEqual(tree.Proof(index%len(leaves)), MerkleProof(leaves, index%len(leaves))) {
+			t.Fatalf("Merkle tree proof incorrect at step %d, size: %d", step, len(leaves))
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package orderbook
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// EncodingVersion : version of the database layout, it is bumped whenever an item encoding changes
+const EncodingVersion uint64 = 3
+
+// SchemaVersionKey : where the version of the database layout is stored
+var SchemaVersionKey = crypto.Keccak256([]byte("orderbook/schemaVersion"))
+
+// Migration : rewrite the database from the previous version, pair names are used to find the orderbooks
+type Migration func(backend Backend, pairNames []string) error
+
+// migrations indexed by the version they migrate from
+var migrations = map[uint64]Migration{
+	0: migrateAddVersionHeader,
+	1: migrateNodeStatistics,
+	2: migrateOrderOwner,
+}
+
+// ReadSchemaVersion : get the stored version, false if the database does not have it
+func ReadSchemaVersion(db *BatchDatabase) (uint64, bool) {
+	val, err := db.Get(SchemaVersionKey, new(uint64))
+	if err != nil || val == nil {
+		return 0, false
+	}
+	return *val.(*uint64), true
+}
+
+// WriteSchemaVersion : version is written with the next commit
+func WriteSchemaVersion(db *BatchDatabase, version uint64) error {
+	return db.Put(SchemaVersionKey, &version)
+}
+
+// isEmpty : the database does not store anything yet
+func (db *BatchDatabase) isEmpty() bool {
+	if len(db.pendingItems) > 0 {
+		return false
+	}
+	empty := true
+	db.db.Iterate(nil, func(key, value []byte) bool {
+		empty = false
+		return false
+	})
+	return empty
+}
+
+// checkSchemaVersion : a new database uses the latest layout, an older one must be migrated before use
+func checkSchemaVersion(db *BatchDatabase) error {
+	version, found := ReadSchemaVersion(db)
+	if !found {
+		if db.isEmpty() {
+			return WriteSchemaVersion(db, EncodingVersion)
+		}
+		version = 0
+	}
+	if version != EncodingVersion {
+		return fmt.Errorf("Database encoding version is %d, want %d, please run migrate", version, EncodingVersion)
+	}
+	return nil
+}
+
+// Migrate : rewrite the database to the latest layout, it must run offline when no engine uses the backend
+func Migrate(backend Backend, pairNames []string) error {
+	db := NewBatchDatabaseWithBackend(backend, 0, 0, EncodeBytesItem, DecodeBytesItem)
+	version, found := ReadSchemaVersion(db)
+	if !found && db.isEmpty() {
+		WriteSchemaVersion(db, EncodingVersion)
+		return db.Commit()
+	}
+	pairNames = registeredPairNames(db, pairNames)
+
+	for version < EncodingVersion {
+		migration, ok := migrations[version]
+		if !ok {
+			return fmt.Errorf("No migration from encoding version %d", version)
+		}
+		fmt.Printf("Migrate database from version %d to %d\n", version, version+1)
+		if err := migration(backend, pairNames); err != nil {
+			return fmt.Errorf("Migrate from version %d failed :%v", version, err)
+		}
+		version++
+	}
+
+	if version > EncodingVersion {
+		return fmt.Errorf("Database encoding version %d is newer than %d", version, EncodingVersion)
+	}
+	return nil
+}
+
+// registeredPairNames : the pair names with the ones of the registry, pairs added to a running node are
+// only in the registry
+func registeredPairNames(db *BatchDatabase, pairNames []string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		name = strings.ToLower(name)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range pairNames {
+		add(name)
+	}
+	if val, err := db.Get(PairRegistryKey, &pairRegistryItem{}); err == nil && val != nil {
+		for _, name := range val.(*pairRegistryItem).Names {
+			add(name)
+		}
+	}
+	return names
+}
+
+// migrateAddVersionHeader : items written before version 1 do not have a version header
+func migrateAddVersionHeader(backend Backend, pairNames []string) error {
+	db := newMigrationDatabase(backend, DecodeLegacyBytesItem)
+	for _, pairName := range pairNames {
+		if err := rewriteOrderBook(db, pairName); err != nil {
+			return err
+		}
+	}
+	WriteSchemaVersion(db, 1)
+	return db.Commit()
+}
+
+// migrateNodeStatistics : nodes of version 1 do not have the subtree size and volume
+func migrateNodeStatistics(backend Backend, pairNames []string) error {
+	db := newMigrationDatabase(backend, DecodeBytesItem)
+	for _, pairName := range pairNames {
+		orderBook, err := loadMigrationOrderBook(db, pairName)
+		if err != nil {
+			return err
+		}
+		if orderBook == nil {
+			continue
+		}
+		for _, orderTree := range []*OrderTree{orderBook.Bids, orderBook.Asks} {
+			tree := orderTree.PriceTree.Tree
+			if size, _ := tree.rebuildStats(tree.rootKey); size != tree.Size() {
+				return fmt.Errorf("Price tree of %s has %d nodes, want %d", pairName, size, tree.Size())
+			}
+		}
+	}
+	WriteSchemaVersion(db, 2)
+	return db.Commit()
+}
+
+// migrateOrderOwner : orders of version 1 do not have owner and nonce, they are rewritten with empty ones
+func migrateOrderOwner(backend Backend, pairNames []string) error {
+	db := newMigrationDatabase(backend, DecodeBytesItem)
+	for _, pairName := range pairNames {
+		if err := rewriteOrderBook(db, pairName); err != nil {
+			return err
+		}
+	}
+	WriteSchemaVersion(db, 3)
+	return db.Commit()
+}
+
+// newMigrationDatabase : read with the decoder of the old version, write with the latest encoder.
+// Nothing is flushed until the end, so that migrated items are never read again with the old decoder,
+// and an interrupted migration leaves the database unchanged
+func newMigrationDatabase(backend Backend, decode DecodeBytes) *BatchDatabase {
+	return NewBatchDatabaseWithBackend(backend, 0, math.MaxInt32, EncodeBytesItem, decode)
+}
+
+// loadMigrationOrderBook : restore the orderbook, nil if it is not created yet
+func loadMigrationOrderBook(db *BatchDatabase, pairName string) (*OrderBook, error) {
+	orderBook := NewOrderBook(strings.ToLower(pairName), db)
+	if found, _ := db.Has(orderBook.Key); !found {
+		return nil, nil
+	}
+	if err := orderBook.Restore(); err != nil {
+		return nil, fmt.Errorf("Can not load orderbook %s :%v", pairName, err)
+	}
+	return orderBook, nil
+}
+
+// rewriteOrderBook : walk all items of an orderbook by following its structure, and put them again,
+// so they are encoded with the latest layout on commit
+func rewriteOrderBook(db *BatchDatabase, pairName string) error {
+	orderBook, err := loadMigrationOrderBook(db, pairName)
+	if err != nil || orderBook == nil {
+		return err
+	}
+
+	for _, orderTree := range []*OrderTree{orderBook.Bids, orderBook.Asks} {
+		if err := rewriteOrderTree(db, orderTree); err != nil {
+			return fmt.Errorf("Can not migrate orderbook %s :%v", pairName, err)
+		}
+		if err := db.Put(orderTree.Key, orderTree.Item); err != nil {
+			return err
+		}
+	}
+	return db.Put(orderBook.Key, orderBook.Item)
+}
+
+func rewriteOrderTree(db *BatchDatabase, orderTree *OrderTree) error {
+	tree := orderTree.PriceTree
+	keys := [][]byte{orderTree.Item.PriceTreeKey}
+	for len(keys) > 0 {
+		key := keys[len(keys)-1]
+		keys = keys[:len(keys)-1]
+		if tree.IsEmptyKey(key) {
+			continue
+		}
+
+		node, err := tree.GetNode(key)
+		if node == nil {
+			return fmt.Errorf("Node not found :%x, %v", key, err)
+		}
+
+		// order list is stored as the value of the node
+		item := &OrderListItem{}
+		if err := db.DecodeBytes(node.Value(), item); err != nil {
+			return fmt.Errorf("Can not decode order list :%x, %v", key, err)
+		}
+		if err := rewriteOrders(db, orderTree.orderBook, item); err != nil {
+			return err
+		}
+		if node.Item.Value, err = db.EncodeToBytes(item); err != nil {
+			return err
+		}
+		if err := db.Put(node.Key, node.Item); err != nil {
+			return err
+		}
+
+		keys = append(keys, node.LeftKey(), node.RightKey())
+	}
+	return nil
+}
+
+func rewriteOrders(db *BatchDatabase, orderBook *OrderBook, item *OrderListItem) error {
+	// length is used to guard against broken links
+	key := item.HeadOrder
+	for i := uint64(0); i < item.Length && !db.IsEmptyKey(key); i++ {
+		storedKey := orderBook.GetOrderIDFromKey(key)
+		val, err := db.Get(storedKey, &OrderItem{})
+		if err != nil {
+			return fmt.Errorf("Order not found :%x, %v", key, err)
+		}
+		if err := db.Put(storedKey, val); err != nil {
+			return err
+		}
+		key = val.(*OrderItem).NextOrder
+	}
+	return nil
+}
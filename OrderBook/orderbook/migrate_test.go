@@ -0,0 +1,125 @@
+package orderbook
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// encode items like before the version header was introduced, order list in node value
+// is already encoded by this function
+func encodeLegacyBytesItem(val interface{}) ([]byte, error) {
+	switch val.(type) {
+	case *Item:
+		// node layout without statistics
+		item := val.(*Item)
+		start := 3 * common.HashLength
+		bytes := make([]byte, start+1+len(item.Value))
+		copy(bytes[0:common.HashLength], item.Keys.Left)
+		copy(bytes[common.HashLength:2*common.HashLength], item.Keys.Right)
+		copy(bytes[2*common.HashLength:start], item.Keys.Parent)
+		bytes[start] = Bool2byte(item.Color)
+		copy(bytes[start+1:], item.Value)
+		return bytes, nil
+	case *OrderItem:
+		// order layout without owner and nonce
+		bytes, err := EncodeBytesItem(val)
+		if err != nil {
+			return nil, err
+		}
+		start := versionHeaderLength + 5*common.HashLength + 8
+		return append(bytes[versionHeaderLength:start], bytes[start+common.AddressLength+8:]...), nil
+	case *OrderListItem, *OrderTreeItem, *OrderBookItem:
+	default:
+		return EncodeBytesItem(val)
+	}
+	bytes, err := EncodeBytesItem(val)
+	if err != nil {
+		return nil, err
+	}
+	return bytes[versionHeaderLength:], nil
+}
+
+func TestMigrateAddVersionHeader(t *testing.T) {
+	backend := NewMemBackend()
+	legacyDB := NewBatchDatabaseWithBackend(backend, 0, 0, encodeLegacyBytesItem, DecodeLegacyBytesItem)
+	orderBook := NewOrderBook("TOMO/WETH", legacyDB)
+	orderBook.SetClock(FixedClock(1))
+	orders := []map[string]string{
+		{"type": Limit, "side": Ask, "quantity": "5", "price": "101", "trade_id": "1"},
+		{"type": Limit, "side": Ask, "quantity": "7", "price": "101", "trade_id": "2"},
+		{"type": Limit, "side": Ask, "quantity": "3", "price": "105", "trade_id": "3"},
+		{"type": Limit, "side": Bid, "quantity": "4", "price": "99", "trade_id": "4"},
+		{"type": Limit, "side": Bid, "quantity": "2", "price": "98", "trade_id": "5"},
+	}
+	for _, order := range orders {
+		orderBook.ProcessOrder(order, false)
+	}
+	// pairs added to a running node are only in the registry
+	registered := NewOrderBook("tomo/usdt", legacyDB)
+	registered.SetClock(FixedClock(1))
+	registered.ProcessOrder(orders[0], false)
+	legacyDB.Commit()
+	root, registeredRoot := orderBook.StateRoot(), registered.StateRoot()
+	registry := NewBatchDatabaseWithBackend(backend, 0, 0, EncodeBytesItem, DecodeBytesItem)
+	registry.Put(GetPairKey("tomo/usdt"), &PairItem{Name: "tomo/usdt", MaxVolume: ToBigInt("1"), Status: PairActive})
+	registry.Put(PairRegistryKey, &pairRegistryItem{Names: []string{"tomo/usdt"}})
+	registry.Commit()
+
+	if err := checkSchemaVersion(NewBatchDatabaseWithBackend(backend, 0, 0, EncodeBytesItem, DecodeBytesItem)); err == nil {
+		t.Fatal("legacy database must be detected")
+	}
+
+	if err := Migrate(backend, []string{"TOMO/WETH"}); err != nil {
+		t.Fatal(err)
+	}
+	db := NewBatchDatabaseWithBackend(backend, 0, 0, EncodeBytesItem, DecodeBytesItem)
+	if version, _ := ReadSchemaVersion(db); version != EncodingVersion {
+		t.Errorf("schema version incorrect, got: %d, want: %d.", version, EncodingVersion)
+	}
+
+	engine := NewEngineWithBackend(backend, map[string]*big.Int{"tomo/weth": ToBigInt("1")})
+	migrated, _ := engine.GetOrderBook("TOMO/WETH")
+	if migrated.StateRoot() != root {
+		t.Errorf("state root changed after migration, got: %x, want: %x.", migrated.StateRoot(), root)
+	}
+	if migrated, err := engine.GetOrderBook("TOMO/USDT"); err != nil || migrated.StateRoot() != registeredRoot {
+		t.Errorf("registered pair must be migrated, got: %v", err)
+	}
+	if report := engine.Verify(false); len(report.Issues) != 0 {
+		t.Errorf("migrated database is not consistent :%s", report)
+	}
+
+	// migrate again does nothing
+	if err := Migrate(backend, []string{"TOMO/WETH"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodingVersion(t *testing.T) {
+	item := &OrderItem{Quantity: ToBigInt("10"), Price: ToBigInt("100"), TradeID: "1",
+		Owner: common.HexToAddress("0x01"), Nonce: 5}
+	bytes, _ := EncodeBytesItem(item)
+	if bytes[0] != orderItemVersion {
+		t.Errorf("version header incorrect, got: %d, want: %d.", bytes[0], orderItemVersion)
+	}
+
+	decoded := &OrderItem{}
+	if err := DecodeBytesItem(bytes, decoded); err != nil || decoded.Quantity.Cmp(item.Quantity) != 0 ||
+		decoded.Owner != item.Owner || decoded.Nonce != 5 || decoded.TradeID != "1" {
+		t.Errorf("decode incorrect, got: %v, %v", decoded, err)
+	}
+
+	// version 1 does not have owner and nonce
+	legacy, _ := encodeLegacyBytesItem(item)
+	decoded = &OrderItem{}
+	if err := DecodeBytesItem(append([]byte{1}, legacy...), decoded); err != nil || decoded.TradeID != "1" || decoded.Nonce != 0 {
+		t.Errorf("decode version 1 incorrect, got: %v, %v", decoded, err)
+	}
+
+	bytes[0] = 0xff
+	if err := DecodeBytesItem(bytes, &OrderItem{}); err == nil {
+		t.Error("unknown version must be rejected")
+	}
+}
@@ -6,8 +6,9 @@ var datadir = "../datadir/testing"
 // orderbook for this pair
 var pairName = "TOMO/WETH"
 
-// override Encode and Decode for better performance
-var testDB = NewBatchDatabaseWithEncode(datadir, 0, 0, EncodeBytesItem, DecodeBytesItem)
+// override Encode and Decode for better performance, tests run in memory
+// var testDB = NewBatchDatabaseWithEncode(datadir, 0, 0, EncodeBytesItem, DecodeBytesItem)
+var testDB = NewBatchDatabaseWithBackend(NewMemBackend(), 0, 0, EncodeBytesItem, DecodeBytesItem)
 var testOrderBook = NewOrderBook(pairName, testDB)
 
 // order tree without orderbook
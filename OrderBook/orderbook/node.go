@@ -6,6 +6,7 @@ package orderbook
 
 import (
 	"fmt"
+	"math/big"
 )
 
 const (
@@ -28,6 +29,9 @@ type Item struct {
 	Value []byte
 	// Deleted bool
 	Color bool
+	// statistics of the subtree rooted at this node, including itself
+	Size   uint64
+	Volume *big.Int
 }
 
 // Node is a single element within the tree
@@ -48,7 +52,7 @@ func (node *Node) maximumNode(tree *Tree) *Node {
 	if newNode == nil {
 		return newNode
 	}
-	for !tree.IsEmptyKey(node.RightKey()) {
+	for !tree.IsEmptyKey(newNode.RightKey()) {
 		newNode = newNode.Right(tree)
 	}
 	return newNode
@@ -0,0 +1,225 @@
+package orderbook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	demo "github.com/tomochain/orderbook/common"
+)
+
+// Each signed message carries a nonce of its owner, and it must be greater than the last nonce used
+// by the owner on any pair, so a message broadcast again or an older message is rejected.
+// The nonce is stored in the database of the pair, in the same transaction as the operation that uses it,
+// so it is only used when the operation succeeds and it is never saved without the operation.
+
+// GetNonceKey : key of the last nonce used by the owner in the pair. Nonces raised by imported orders
+// are stored in the database of the engine, with an empty pair name
+func GetNonceKey(pairName string, owner common.Address) []byte {
+	return crypto.Keccak256([]byte("orderbook/nonce/"), []byte(strings.ToLower(pairName)), owner.Bytes())
+}
+
+// GetNonce : last nonce used by the owner, 0 if the owner has not sent anything yet
+func (engine *Engine) GetNonce(owner common.Address) uint64 {
+	engine.nonceLock.Lock()
+	defer engine.nonceLock.Unlock()
+	return engine.getNonce(owner)
+}
+
+// getNonce : last nonce of the owner, it is read from all pairs the first time. Nonce lock must be held
+func (engine *Engine) getNonce(owner common.Address) uint64 {
+	if last, ok := engine.nonces[owner]; ok {
+		return last
+	}
+	last := engine.readNonce(GetNonceKey("", owner))
+	for name := range engine.noncePairs {
+		if nonce := engine.readNonce(GetNonceKey(name, owner)); nonce > last {
+			last = nonce
+		}
+	}
+	engine.nonces[owner] = last
+	return last
+}
+
+// readNonce : stored nonce, pairs share the storage of the engine
+func (engine *Engine) readNonce(key []byte) uint64 {
+	val, err := engine.db.Get(key, new(uint64))
+	if err != nil || val == nil {
+		return 0
+	}
+	return *val.(*uint64)
+}
+
+// addNoncePair : the nonces of the owners are read from the pair as well
+func (engine *Engine) addNoncePair(name string) {
+	engine.nonceLock.Lock()
+	defer engine.nonceLock.Unlock()
+	engine.noncePairs[name] = true
+}
+
+// quoteNonce : owner and nonce of a signed quote, false for quotes without nonce which are local calls
+func quoteNonce(quote map[string]string) (common.Address, uint64, bool, error) {
+	value, ok := quote["nonce"]
+	if !ok {
+		return common.Address{}, 0, false, nil
+	}
+	nonce, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return common.Address{}, 0, false, fmt.Errorf("Nonce is not correct :%s", value)
+	}
+	return common.HexToAddress(quote["owner"]), nonce, true, nil
+}
+
+// reserveNonce : check the nonce, it can not be used by other operations until it is released
+func (engine *Engine) reserveNonce(owner common.Address, nonce uint64) error {
+	engine.nonceLock.Lock()
+	defer engine.nonceLock.Unlock()
+	if last := engine.getNonce(owner); nonce <= last {
+		return fmt.Errorf("Nonce %d of %s is already used, last nonce is %d", nonce, owner.Hex(), last)
+	}
+	if engine.usingNonces[owner][nonce] {
+		return fmt.Errorf("Nonce %d of %s is already used by an operation in progress", nonce, owner.Hex())
+	}
+	if engine.usingNonces[owner] == nil {
+		engine.usingNonces[owner] = make(map[uint64]bool)
+	}
+	engine.usingNonces[owner][nonce] = true
+	return nil
+}
+
+// releaseNonce : end of the operation, the nonce is the last one of the owner if it has been used
+func (engine *Engine) releaseNonce(owner common.Address, nonce uint64, used bool) {
+	engine.nonceLock.Lock()
+	defer engine.nonceLock.Unlock()
+	delete(engine.usingNonces[owner], nonce)
+	if len(engine.usingNonces[owner]) == 0 {
+		delete(engine.usingNonces, owner)
+	}
+	if used && nonce > engine.getNonce(owner) {
+		engine.nonces[owner] = nonce
+	}
+}
+
+// withNonce : run the operation on the pair with the nonce of the quote, the caller holds the lock
+// of the orderbook. Quotes without nonce are local calls and are not checked. Operations replayed
+// from a journal are applied in the order of the peer, their nonces are raised and not checked
+func (engine *Engine) withNonce(ob *OrderBook, quote map[string]string, replay bool, operation func() error) error {
+	owner, nonce, ok, err := quoteNonce(quote)
+	if err != nil {
+		return err
+	}
+	if !ok || (replay && nonce <= engine.GetNonce(owner)) {
+		return operation()
+	}
+	if !replay {
+		if err := engine.reserveNonce(owner, nonce); err != nil {
+			return err
+		}
+	}
+	err = engine.useNonce(ob, owner, nonce, operation)
+	engine.releaseNonce(owner, nonce, err == nil)
+	return err
+}
+
+// useNonce : run the operation and write the reserved nonce in one transaction of the pair
+func (engine *Engine) useNonce(ob *OrderBook, owner common.Address, nonce uint64, operation func() error) error {
+	return ob.group(func() error {
+		if err := operation(); err != nil {
+			return err
+		}
+		return ob.db.Put(GetNonceKey(ob.Item.Name, owner), &nonce)
+	})
+}
+
+// cancelOwnerOrders : cancel the orders of the owner of the quote signed with a lower nonce in the pair,
+// the caller holds the lock of the orderbook
+func (engine *Engine) cancelOwnerOrders(ob *OrderBook, quote map[string]string, replay bool) (uint64, error) {
+	owner, nonce, ok, err := quoteNonce(quote)
+	if err != nil || !ok {
+		return 0, fmt.Errorf("Nonce is not correct :%s", quote["nonce"])
+	}
+	if ob.status == PairDelisted {
+		return 0, fmt.Errorf("Pair is delisted :%s", ob.Item.Name)
+	}
+	var count uint64
+	err = engine.withNonce(ob, quote, replay, func() (err error) {
+		count, err = ob.CancelOwnerOrders(owner, nonce, quoteTimestamp(quote))
+		return err
+	})
+	return count, err
+}
+
+// raiseNonce : the last nonce of the owner is at least the nonce, for orders imported from a peer
+func (engine *Engine) raiseNonce(owner common.Address, nonce uint64) error {
+	engine.nonceLock.Lock()
+	defer engine.nonceLock.Unlock()
+	if nonce <= engine.getNonce(owner) {
+		return nil
+	}
+	if err := engine.db.Put(GetNonceKey("", owner), &nonce); err != nil {
+		return err
+	}
+	engine.nonces[owner] = nonce
+	return nil
+}
+
+// CancelOrdersBelowNonce : cancel all resting orders of the owner with nonce lower than the nonce of the quote,
+// in the pair of the quote or in all pairs when it is empty. The quote nonce must be a new nonce of the owner,
+// so orders signed before can not be sent again. It returns the number of cancelled orders
+func (engine *Engine) CancelOrdersBelowNonce(quote map[string]string) (uint64, error) {
+	owner, nonce, ok, err := quoteNonce(quote)
+	if err != nil || !ok {
+		return 0, fmt.Errorf("Nonce is not correct :%s", quote["nonce"])
+	}
+	if err := engine.reserveNonce(owner, nonce); err != nil {
+		return 0, err
+	}
+
+	names := engine.pairNames()
+	if quote["pair_name"] != "" {
+		names = []string{strings.ToLower(quote["pair_name"])}
+	}
+
+	// a pair that fails after others are cancelled would change the books without a sequence and a journal
+	// entry, so all pairs are loaded and checked before any is changed
+	for _, name := range names {
+		err = engine.ReadOrderBook(name, func(ob *OrderBook) error {
+			if ob.status == PairDelisted {
+				return fmt.Errorf("Pair is delisted :%s", ob.Item.Name)
+			}
+			return nil
+		})
+		if err != nil {
+			engine.releaseNonce(owner, nonce, false)
+			return 0, err
+		}
+	}
+
+	// each pair is cancelled with the write of the nonce in its own transaction
+	var total uint64
+	used := false
+	for _, name := range names {
+		err = engine.WithOrderBook(name, func(ob *OrderBook) error {
+			if ob.status == PairDelisted {
+				return fmt.Errorf("Pair is delisted :%s", ob.Item.Name)
+			}
+			return engine.useNonce(ob, owner, nonce, func() error {
+				count, err := ob.CancelOwnerOrders(owner, nonce, quoteTimestamp(quote))
+				total += count
+				return err
+			})
+		})
+		if err != nil {
+			break
+		}
+		used = true
+	}
+	engine.releaseNonce(owner, nonce, used)
+	if err != nil {
+		return total, err
+	}
+	demo.LogInfo("Cancelled orders below nonce", "owner", owner.Hex(), "nonce", nonce, "count", total)
+	return total, engine.nextSequence(JournalMassCancel, strings.ToLower(quote["pair_name"]), copyQuote(quote), nil)
+}
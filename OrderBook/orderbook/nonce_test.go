@@ -0,0 +1,102 @@
+package orderbook
+
+import (
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestEngineNonce(t *testing.T) {
+	backend := NewMemBackend()
+	engine := NewEngineWithBackend(backend, map[string]*big.Int{"tomo/weth": ToBigInt("1")})
+	alice, bob := common.HexToAddress("0x0a"), common.HexToAddress("0x0b")
+	order := func(owner common.Address, nonce uint64, price string) map[string]string {
+		return map[string]string{
+			"pair_name": "TOMO/WETH", "order_id": "0", "type": Limit, "side": Ask, "quantity": "1", "price": price,
+			"trade_id": strconv.FormatUint(nonce, 10), "owner": owner.Hex(), "nonce": strconv.FormatUint(nonce, 10),
+		}
+	}
+
+	engine.ProcessOrder(order(alice, 1, "101"))
+	engine.ProcessOrder(order(alice, 2, "102"))
+	engine.ProcessOrder(order(alice, 5, "105"))
+	engine.ProcessOrder(order(bob, 1, "103"))
+
+	// the same message again and an older one are rejected
+	if _, orderInBook := engine.ProcessOrder(order(alice, 5, "105")); orderInBook != nil {
+		t.Error("replayed order must be rejected")
+	}
+	if _, orderInBook := engine.ProcessOrder(order(alice, 3, "104")); orderInBook != nil {
+		t.Error("stale nonce must be rejected")
+	}
+	if nonce := engine.GetNonce(alice); nonce != 5 {
+		t.Errorf("nonce incorrect, got: %d, want: %d.", nonce, 5)
+	}
+
+	ob, _ := engine.GetOrderBook("TOMO/WETH")
+	if ob.Asks.Item.NumOrders != 4 {
+		t.Fatalf("orders incorrect, got: %d", ob.Asks.Item.NumOrders)
+	}
+
+	// cancel all orders of alice signed before the mass cancel, in all pairs
+	cancel := map[string]string{"owner": alice.Hex(), "nonce": "6"}
+	count, err := engine.CancelOrdersBelowNonce(cancel)
+	if err != nil || count != 3 {
+		t.Fatalf("cancel below nonce incorrect, got: %d, %v", count, err)
+	}
+	if ob.Asks.Item.NumOrders != 1 || ob.Asks.PriceList(ToBigInt("103")) == nil {
+		t.Errorf("only orders of alice must be cancelled, got: %d", ob.Asks.Item.NumOrders)
+	}
+	if _, err := engine.CancelOrdersBelowNonce(cancel); err == nil {
+		t.Error("replayed mass cancel must be rejected")
+	}
+	if _, orderInBook := engine.ProcessOrder(order(alice, 5, "105")); orderInBook != nil {
+		t.Error("cancelled order must not be sent again")
+	}
+	if _, orderInBook := engine.ProcessOrder(order(alice, 7, "107")); orderInBook == nil {
+		t.Error("order after the mass cancel must be accepted")
+	}
+
+	// the nonce of a failed operation can be used again
+	cancelOrder := map[string]string{"pair_name": "TOMO/WETH", "order_id": "5", "side": Ask, "price": "x",
+		"owner": alice.Hex(), "nonce": "8"}
+	if err := engine.CancelOrder(cancelOrder); err == nil {
+		t.Fatal("cancel with a wrong price must be rejected")
+	}
+	cancelOrder["price"] = "107"
+	if err := engine.CancelOrder(cancelOrder); err != nil {
+		t.Fatalf("nonce of a failed cancel must not be used, got: %v", err)
+	}
+
+	// nonces are stored in the database
+	engine.Commit()
+	reloaded := NewEngineWithBackend(backend, map[string]*big.Int{"tomo/weth": ToBigInt("1")})
+	if nonce := reloaded.GetNonce(alice); nonce != 8 {
+		t.Errorf("nonce must be loaded, got: %d, want: %d.", nonce, 8)
+	}
+	if nonce := reloaded.GetNonce(bob); nonce != 1 {
+		t.Errorf("nonce must be loaded, got: %d, want: %d.", nonce, 1)
+	}
+}
+
+func TestEngineMassCancelPairs(t *testing.T) {
+	engine := NewEngineWithBackend(NewMemBackend(), map[string]*big.Int{"tomo/usdt": ToBigInt("1"), "tomo/weth": ToBigInt("1")})
+	alice := common.HexToAddress("0x0a")
+	engine.ProcessOrder(map[string]string{
+		"pair_name": "TOMO/USDT", "order_id": "0", "type": Limit, "side": Ask, "quantity": "1", "price": "101",
+		"trade_id": "1", "owner": alice.Hex(), "nonce": "1",
+	})
+
+	// the last pair is delisted while the mass cancel is sent, no pair is changed
+	weth, _ := engine.GetOrderBook("TOMO/WETH")
+	weth.status = PairDelisted
+	if _, err := engine.CancelOrdersBelowNonce(map[string]string{"owner": alice.Hex(), "nonce": "2"}); err == nil {
+		t.Fatal("mass cancel with a delisted pair must be rejected")
+	}
+	if engine.GetOrder("TOMO/USDT", "1") == nil || engine.GetNonce(alice) != 1 || engine.Sequence() != 1 {
+		t.Errorf("pairs must not be changed by a rejected mass cancel, got nonce %d at sequence %d",
+			engine.GetNonce(alice), engine.Sequence())
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"math/big"
 	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
 )
 
 // OrderItem : info that will be store in database
@@ -14,6 +16,9 @@ type OrderItem struct {
 	Price     *big.Int `json:"price"`
 	// OrderID   string          `json:"orderID"`
 	TradeID string `json:"tradeID"`
+	// owner signed the order with the nonce, only the owner can cancel or amend it
+	Owner common.Address `json:"owner"`
+	Nonce uint64         `json:"nonce"`
 	// these following fields can lead to recursive problem
 	// NextOrder *Order     `json:"-"`
 	// PrevOrder *Order     `json:"-"`
@@ -63,12 +68,15 @@ func NewOrder(quote map[string]string, orderList []byte) *Order {
 	orderID := ToBigInt(quote["order_id"])
 	key := GetKeyFromBig(orderID)
 	tradeID := quote["trade_id"]
+	nonce, _ := strconv.ParseUint(quote["nonce"], 10, 64)
 	orderItem := &OrderItem{
 		Timestamp: timestamp,
 		Quantity:  quantity,
 		Price:     price,
 		// OrderID:   orderID,
 		TradeID:   tradeID,
+		Owner:     common.HexToAddress(quote["owner"]),
+		Nonce:     nonce,
 		NextOrder: EmptyKey(),
 		PrevOrder: EmptyKey(),
 		OrderList: orderList,
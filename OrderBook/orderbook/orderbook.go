@@ -5,10 +5,11 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	demo "github.com/tomochain/orderbook/common"
 )
 
 const (
@@ -38,8 +39,16 @@ type OrderBook struct {
 	Asks *OrderTree     `json:"asks"`
 	Item *OrderBookItem
 
-	Key  []byte
-	slot *big.Int
+	Key   []byte
+	slot  *big.Int
+	clock Clock
+	// status of the pair in the registry, new orders are only accepted when it is active
+	status string
+	// grouped : operations are part of the transaction of group
+	grouped bool
+
+	// lock is held by the engine, exclusive for writes and shared for queries
+	lock sync.RWMutex
 }
 
 // NewOrderBook : return new order book
@@ -75,10 +84,12 @@ func NewOrderBook(name string, db *BatchDatabase) *OrderBook {
 	asksKey := GetSegmentHash(key, 2, SlotSegment)
 
 	orderBook := &OrderBook{
-		db:   db,
-		Item: item,
-		slot: slot,
-		Key:  key,
+		db:     db,
+		Item:   item,
+		slot:   slot,
+		Key:    key,
+		clock:  SystemClock{},
+		status: PairActive,
 	}
 
 	bids := NewOrderTree(db, bidsKey, orderBook)
@@ -90,7 +101,7 @@ func NewOrderBook(name string, db *BatchDatabase) *OrderBook {
 	// orderBook.Restore()
 
 	// no need to update when there is no operation yet
-	orderBook.UpdateTime()
+	orderBook.UpdateTime(0)
 
 	return orderBook
 }
@@ -99,6 +110,11 @@ func (orderBook *OrderBook) SetDebug(debug bool) {
 	orderBook.db.Debug = debug
 }
 
+// SetClock : replace the clock used when an operation does not carry its own timestamp
+func (orderBook *OrderBook) SetClock(clock Clock) {
+	orderBook.clock = clock
+}
+
 func (orderBook *OrderBook) Save() error {
 
 	orderBook.Asks.Save()
@@ -187,9 +203,13 @@ func (orderBook *OrderBook) String(startDepth int) string {
 		tabs)
 }
 
-// UpdateTime : update time for order book
-func (orderBook *OrderBook) UpdateTime() {
-	timestamp := uint64(time.Now().Unix())
+// UpdateTime : update time for order book, using the timestamp from the inbound message
+// so that every node processing the same messages gets the same result.
+// If timestamp is 0, the time is taken from the clock
+func (orderBook *OrderBook) UpdateTime(timestamp uint64) {
+	if timestamp == 0 {
+		timestamp = orderBook.clock.Now()
+	}
 	orderBook.Item.Timestamp = timestamp
 }
 
@@ -287,27 +307,101 @@ func (orderBook *OrderBook) processLimitOrder(quote map[string]string, verbose b
 	return trades, orderInBook
 }
 
-// ProcessOrder : process the order
+// ProcessOrder : process the order, the order and all its fills are applied atomically
 func (orderBook *OrderBook) ProcessOrder(quote map[string]string, verbose bool) ([]map[string]string, map[string]string) {
+	trades, orderInBook, err := orderBook.processOrder(quote, verbose)
+	if err != nil {
+		demo.LogWarn("Process order failed, rolled back", "pair", orderBook.Item.Name, "err", err)
+		return nil, nil
+	}
+
+	return trades, orderInBook
+}
+
+// processOrder : like ProcessOrder, also return the error when the order is rolled back
+func (orderBook *OrderBook) processOrder(quote map[string]string, verbose bool) ([]map[string]string, map[string]string, error) {
 	orderType := quote["type"]
 	var orderInBook map[string]string
 	var trades []map[string]string
 
-	orderBook.UpdateTime()
-	// quote["timestamp"] = strconv.Itoa(orderBook.Time)
-	// if we do not use auto-increment orderid, we must set price slot to avoid conflict
-	orderBook.Item.NextOrderID++
+	err := orderBook.atomic(func() error {
+		orderBook.UpdateTime(quoteTimestamp(quote))
+		// the order in book must have the same time as the trades
+		quote["timestamp"] = strconv.FormatUint(orderBook.Item.Timestamp, 10)
+		// if we do not use auto-increment orderid, we must set price slot to avoid conflict
+		orderBook.Item.NextOrderID++
+		// the id is known by the sender even if the order is fully matched
+		quote["order_id"] = strconv.FormatUint(orderBook.Item.NextOrderID, 10)
+
+		if orderType == Market {
+			trades = orderBook.processMarketOrder(quote, verbose)
+		} else {
+			trades, orderInBook = orderBook.processLimitOrder(quote, verbose)
+		}
 
-	if orderType == Market {
-		trades = orderBook.processMarketOrder(quote, verbose)
-	} else {
-		trades, orderInBook = orderBook.processLimitOrder(quote, verbose)
+		// update orderBook
+		return orderBook.Save()
+	})
+
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// update orderBook
-	orderBook.Save()
+	return trades, orderInBook, nil
+}
 
-	return trades, orderInBook
+// atomic : run the operation inside a database transaction, if it returns an error or panics
+// all its writes are discarded and the orderbook is reloaded from the database. Inside group,
+// the operation is part of the transaction of the group
+func (orderBook *OrderBook) atomic(operation func() error) (err error) {
+	if orderBook.grouped {
+		return operation()
+	}
+	tx, err := orderBook.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Orderbook %s operation panic :%v", orderBook.Item.Name, r)
+		}
+		if err != nil {
+			tx.Rollback()
+			orderBook.reload()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	return operation()
+}
+
+// group : run operations of the book in one transaction, like an operation of the engine
+// with the write of the nonce of its quote
+func (orderBook *OrderBook) group(operation func() error) error {
+	return orderBook.atomic(func() error {
+		orderBook.grouped = true
+		defer func() {
+			orderBook.grouped = false
+		}()
+		return operation()
+	})
+}
+
+// reload : drop in-memory state, then restore it from the database
+func (orderBook *OrderBook) reload() {
+	// the items kept by the book may have been changed in place, they are read again from the database
+	orderBook.db.removeFromCache(orderBook.db.getCacheKey(orderBook.Key))
+	orderBook.db.removeFromCache(orderBook.db.getCacheKey(orderBook.Bids.Key))
+	orderBook.db.removeFromCache(orderBook.db.getCacheKey(orderBook.Asks.Key))
+	orderBook.Item = &OrderBookItem{
+		NextOrderID: 0,
+		Name:        orderBook.Item.Name,
+	}
+	orderBook.Bids.reset()
+	orderBook.Asks.reset()
+	orderBook.Restore()
 }
 
 // processOrderList : process the order list
@@ -355,7 +449,8 @@ func (orderBook *OrderBook) processOrderList(side string, orderList *OrderList,
 			tradedQuantity = CloneBigInt(headOrder.Item.Quantity)
 			if side == Bid {
 				// orderBook.Bids.RemoveOrderByID(headOrder.Key)
-				orderBook.Bids.RemoveOrder(headOrder)
+				// the order list is used for the next head order, it must be the one the order is removed from
+				orderBook.Bids.RemoveOrderFromOrderList(headOrder, orderList)
 			} else {
 				// orderBook.Asks.RemoveOrderByID(headOrder.Key)
 				// fmt.Printf("\nBEFORE : %s\n\n", orderList.String(0))
@@ -387,33 +482,126 @@ func (orderBook *OrderBook) processOrderList(side string, orderList *OrderList,
 	return quantityToTrade, trades
 }
 
+// CheckOwner : cancel and amend quotes carry the owner who signed them, it must be the owner of the order.
+// Quotes without owner are local calls and are not checked
+func (orderBook *OrderBook) CheckOwner(quote map[string]string, orderID uint64) error {
+	owner, ok := quote["owner"]
+	if !ok {
+		return nil
+	}
+	order := orderBook.GetOrder(GetKeyFromBig(new(big.Int).SetUint64(orderID)))
+	if order == nil {
+		return fmt.Errorf("Order not found :%d", orderID)
+	}
+	if order.Item.Owner != common.HexToAddress(owner) {
+		return fmt.Errorf("Order %d is owned by %s, not %s", orderID, order.Item.Owner.Hex(), owner)
+	}
+	return nil
+}
+
 // CancelOrder : cancel the order, just need ID, side and price, of course order must belong
-// to a price point as well
-func (orderBook *OrderBook) CancelOrder(side string, orderID uint64, price *big.Int) error {
-	orderBook.UpdateTime()
-	key := GetKeyFromBig(big.NewInt(int64(orderID)))
-	var err error
-	if side == Bid {
-		order := orderBook.Bids.GetOrder(key, price)
-		if order != nil {
-			_, err = orderBook.Bids.RemoveOrder(order)
+// to a price point as well. Timestamp is from the cancel message, 0 mean using the clock
+func (orderBook *OrderBook) CancelOrder(side string, orderID uint64, price *big.Int, timestamp uint64) error {
+	return orderBook.atomic(func() error {
+		orderBook.UpdateTime(timestamp)
+		key := GetKeyFromBig(big.NewInt(int64(orderID)))
+		var err error
+		if side == Bid {
+			order := orderBook.Bids.GetOrder(key, price)
+			if order != nil {
+				_, err = orderBook.Bids.RemoveOrder(order)
+			}
+			// if orderBook.Bids.OrderExist(key, price) {
+			// 	orderBook.Bids.RemoveOrder(order)
+			// }
+		} else {
+
+			order := orderBook.Asks.GetOrder(key, price)
+			if order != nil {
+				_, err = orderBook.Asks.RemoveOrder(order)
+			}
+
+			// if orderBook.Asks.OrderExist(key) {
+			// 	orderBook.Asks.RemoveOrder(order)
+			// }
 		}
-		// if orderBook.Bids.OrderExist(key, price) {
-		// 	orderBook.Bids.RemoveOrder(order)
-		// }
-	} else {
 
-		order := orderBook.Asks.GetOrder(key, price)
-		if order != nil {
-			_, err = orderBook.Asks.RemoveOrder(order)
+		return err
+	})
+}
+
+// CancelAllOrders : cancel every resting order on both sides in one operation, it returns the number
+// of cancelled orders
+func (orderBook *OrderBook) CancelAllOrders(timestamp uint64) (uint64, error) {
+	var count uint64
+	err := orderBook.atomic(func() error {
+		orderBook.UpdateTime(timestamp)
+		var err error
+		if count, err = orderBook.removeAllOrders(); err != nil {
+			return err
 		}
+		return orderBook.Save()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
 
-		// if orderBook.Asks.OrderExist(key) {
-		// 	orderBook.Asks.RemoveOrder(order)
-		// }
+// removeAllOrders : remove the orders from the lowest price of each side, it must run inside atomic
+func (orderBook *OrderBook) removeAllOrders() (uint64, error) {
+	var count uint64
+	for _, orderTree := range []*OrderTree{orderBook.Bids, orderBook.Asks} {
+		for orderTree.Depth() > 0 {
+			orderList := orderTree.MinPriceList()
+			if orderList == nil {
+				return count, fmt.Errorf("Price tree of %s has depth %d but no price list", orderBook.Item.Name, orderTree.Depth())
+			}
+			order := orderList.Head()
+			if order == nil {
+				// an empty price list must not stay in the tree
+				orderTree.RemovePrice(orderList.Item.Price)
+				continue
+			}
+			if _, err := orderTree.RemoveOrder(order); err != nil {
+				return count, err
+			}
+			count++
+		}
 	}
+	return count, nil
+}
 
-	return err
+// CancelOwnerOrders : cancel the resting orders of the owner with nonce lower than nonce in one operation,
+// it returns the number of cancelled orders
+func (orderBook *OrderBook) CancelOwnerOrders(owner common.Address, nonce uint64, timestamp uint64) (uint64, error) {
+	var count uint64
+	err := orderBook.atomic(func() error {
+		orderBook.UpdateTime(timestamp)
+		for _, orderTree := range []*OrderTree{orderBook.Bids, orderBook.Asks} {
+			// collect first, removing orders changes the tree being iterated
+			var orders []*Order
+			orderTree.IteratePriceLists(nil, nil, false, func(orderList *OrderList) bool {
+				for order := orderList.Head(); order != nil; order = order.GetNextOrder(orderList) {
+					if order.Item.Owner == owner && order.Item.Nonce < nonce {
+						orders = append(orders, order)
+					}
+				}
+				return true
+			})
+			for _, order := range orders {
+				if _, err := orderTree.RemoveOrder(order); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		return orderBook.Save()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
 }
 
 func (orderBook *OrderBook) UpdateOrder(quoteUpdate map[string]string) error {
@@ -424,14 +612,16 @@ func (orderBook *OrderBook) UpdateOrder(quoteUpdate map[string]string) error {
 			return fmt.Errorf("Price is not correct :%s", quoteUpdate["price"])
 		}
 
-		return orderBook.ModifyOrder(quoteUpdate, orderID, price)
+		return orderBook.atomic(func() error {
+			return orderBook.ModifyOrder(quoteUpdate, orderID, price)
+		})
 	}
 	return err
 }
 
 // ModifyOrder : modify the order
 func (orderBook *OrderBook) ModifyOrder(quoteUpdate map[string]string, orderID uint64, price *big.Int) error {
-	orderBook.UpdateTime()
+	orderBook.UpdateTime(quoteTimestamp(quoteUpdate))
 
 	side := quoteUpdate["side"]
 	quoteUpdate["order_id"] = strconv.FormatUint(orderID, 10)
@@ -452,7 +642,8 @@ func (orderBook *OrderBook) ModifyOrder(quoteUpdate map[string]string, orderID u
 		}
 	}
 
-	return nil
+	// nothing is amended, so the update must not be acked
+	return fmt.Errorf("Order not found :%d at price %s", orderID, price)
 }
 
 // VolumeAtPrice : get volume at the current price
@@ -475,3 +666,65 @@ func (orderBook *OrderBook) VolumeAtPrice(side string, price *big.Int) *big.Int
 	return volume
 
 }
+
+// BestPriceLists : get at most n price levels of a side, starting from the best price
+func (orderBook *OrderBook) BestPriceLists(side string, n int) []*OrderList {
+	if side == Bid {
+		return orderBook.Bids.FirstPriceLists(n, true)
+	}
+	return orderBook.Asks.FirstPriceLists(n, false)
+}
+
+// PriceLevel : get the price level at the index of a side, 0 is the best price
+func (orderBook *OrderBook) PriceLevel(side string, index uint64) *OrderList {
+	if side == Bid {
+		return orderBook.Bids.PriceListAt(index, true)
+	}
+	return orderBook.Asks.PriceListAt(index, false)
+}
+
+// VolumeBetterThan : volume of a side with price better than price, higher for bids and lower for asks
+func (orderBook *OrderBook) VolumeBetterThan(side string, price *big.Int) *big.Int {
+	if side == Bid {
+		return Sub(orderBook.Bids.PriceTree.TotalVolume(), orderBook.Bids.VolumeBelow(price, true))
+	}
+	return orderBook.Asks.VolumeBelow(price, false)
+}
+
+// iterateMatchingPriceLists : walk the opposite side of an incoming order from the best price,
+// price is the limit of the incoming order, nil for market order
+func (orderBook *OrderBook) iterateMatchingPriceLists(side string, price *big.Int, fn func(orderList *OrderList) bool) {
+	if side == Bid {
+		orderBook.Asks.IteratePriceLists(nil, price, false, fn)
+	} else {
+		orderBook.Bids.IteratePriceLists(price, nil, true, fn)
+	}
+}
+
+// MatchableVolume : volume an incoming order can match, stop counting when quantity is reached,
+// so fill-or-kill orders can be checked without walking the whole side. Quantity nil means no limit
+func (orderBook *OrderBook) MatchableVolume(side string, price *big.Int, quantity *big.Int) *big.Int {
+	volume := Zero()
+	orderBook.iterateMatchingPriceLists(side, price, func(orderList *OrderList) bool {
+		volume = Add(volume, orderList.Item.Volume)
+		return quantity == nil || volume.Cmp(quantity) < 0
+	})
+	return volume
+}
+
+// EstimateMarketImpact : estimate a market order of quantity, return the filled quantity,
+// the total cost (price * quantity, not scaled by the base decimals, see PairItem.Notional) and the last price reached
+func (orderBook *OrderBook) EstimateMarketImpact(side string, quantity *big.Int) (filled *big.Int, cost *big.Int, lastPrice *big.Int) {
+	filled, cost, lastPrice = Zero(), Zero(), Zero()
+	orderBook.iterateMatchingPriceLists(side, nil, func(orderList *OrderList) bool {
+		volume := orderList.Item.Volume
+		if remain := Sub(quantity, filled); volume.Cmp(remain) > 0 {
+			volume = remain
+		}
+		filled = Add(filled, volume)
+		cost = Add(cost, Mul(volume, orderList.Item.Price))
+		lastPrice = CloneBigInt(orderList.Item.Price)
+		return filled.Cmp(quantity) < 0
+	})
+	return filled, cost, lastPrice
+}
@@ -1,7 +1,10 @@
 package orderbook
 
 import (
+	"fmt"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestNewOrderBook(t *testing.T) {
@@ -220,3 +223,81 @@ func TestOrderBookRestore(t *testing.T) {
 
 	t.Logf("\nOrder : %s", order)
 }
+
+func TestOrderBookDeterministicTime(t *testing.T) {
+	// the test database is kept between runs, so use a fresh pair
+	orderBook := NewOrderBook(fmt.Sprintf("CLOCK/%d", time.Now().UnixNano()), testDB)
+	orderBook.SetClock(FixedClock(42))
+
+	ask := map[string]string{
+		"type":      Limit,
+		"side":      Ask,
+		"quantity":  "5",
+		"price":     "101",
+		"trade_id":  "1",
+		"timestamp": "1000",
+	}
+	orderBook.ProcessOrder(ask, false)
+
+	headOrder := orderBook.Asks.MinPriceList().Head()
+	if headOrder.Item.Timestamp != 1000 {
+		t.Errorf("order timestamp incorrect, got: %d, want: %d.", headOrder.Item.Timestamp, 1000)
+	}
+
+	// no timestamp in the message, use the clock
+	bid := map[string]string{
+		"type":     Limit,
+		"side":     Bid,
+		"quantity": "2",
+		"price":    "101",
+		"trade_id": "2",
+	}
+	trades, _ := orderBook.ProcessOrder(bid, false)
+	if len(trades) != 1 || trades[0]["timestamp"] != "42" {
+		t.Errorf("trade timestamp incorrect, got: %v, want: %s.", trades, "42")
+	}
+
+	bid = map[string]string{
+		"type":      Limit,
+		"side":      Bid,
+		"quantity":  "2",
+		"price":     "101",
+		"trade_id":  "3",
+		"timestamp": "2000",
+	}
+	trades, _ = orderBook.ProcessOrder(bid, false)
+	if len(trades) != 1 || trades[0]["timestamp"] != "2000" {
+		t.Errorf("trade timestamp incorrect, got: %v, want: %s.", trades, "2000")
+	}
+	if orderBook.Item.Timestamp != 2000 {
+		t.Errorf("orderBook timestamp incorrect, got: %d, want: %d.", orderBook.Item.Timestamp, 2000)
+	}
+}
+
+func benchmarkProcessOrder(b *testing.B, cacheLimit int) {
+	db := NewBatchDatabaseWithConfig(NewMemBackend(), DefaultCacheConfig(cacheLimit), 0, EncodeBytesItem, DecodeBytesItem)
+	orderBook := NewOrderBook("BENCH/TEST", db)
+	orderBook.SetClock(FixedClock(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// resting orders on both sides at 50 price levels, some of them cross
+		side := Ask
+		price := 1000 + i%50
+		if i%2 == 1 {
+			side = Bid
+			price = 960 + i%50
+		}
+		orderBook.ProcessOrder(map[string]string{
+			"type":     Limit,
+			"side":     side,
+			"quantity": "10",
+			"price":    strconv.Itoa(price),
+			"trade_id": strconv.Itoa(i),
+		}, false)
+	}
+}
+
+func BenchmarkProcessOrder(b *testing.B) {
+	b.Run("cache-1", func(b *testing.B) { benchmarkProcessOrder(b, 1) })
+	b.Run("cache-default", func(b *testing.B) { benchmarkProcessOrder(b, 0) })
+}
@@ -269,6 +269,7 @@ func (orderList *OrderList) SaveOrder(order *Order) error {
 	if orderList.orderTree.orderDB.Debug {
 		fmt.Printf("Save order key : %x, value :%s\n", key, ToJSON(order.Item))
 	}
+	orderList.orderTree.markDirty(orderList.Key)
 
 	return orderList.orderTree.orderDB.Put(key, order.Item)
 
@@ -310,7 +311,7 @@ func (orderList *OrderList) AppendOrder(order *Order) error {
 
 func (orderList *OrderList) DeleteOrder(order *Order) error {
 	key := orderList.GetOrderID(order)
-	return orderList.orderTree.orderDB.Delete(key, false)
+	return orderList.orderTree.orderDB.Delete(key)
 }
 
 // RemoveOrder : remove order from the order list
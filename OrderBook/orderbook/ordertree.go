@@ -1,6 +1,7 @@
 package orderbook
 
 import (
+	"bytes"
 	"fmt"
 	"math/big"
 	"strconv"
@@ -27,7 +28,14 @@ type OrderTree struct {
 	Key       []byte
 	Item      *OrderTreeItem
 
-	// orderListCache *lru.Cache // Cache for the recent orderList
+	// price levels by ascending price and the merkle tree of their leaves for state root computation,
+	// changed levels are hashed again when the root is needed
+	levelKeys   [][]byte
+	levelTree   merkleTree
+	dirtyLevels map[string]bool
+	stateValid  bool
+
+	orderListCache *itemCache // Cache for the recent orderList
 }
 
 // NewOrderTree create new order tree
@@ -52,13 +60,19 @@ func NewOrderTree(orderDB *BatchDatabase, key []byte, orderBook *OrderBook) *Ord
 
 	// we will need a lru for cache hit, and internal cache for orderbook db to do the batch update
 	orderTree := &OrderTree{
-		orderDB:   orderDB,
-		PriceTree: priceTree,
-		Key:       key,
-		slot:      slot,
-		Item:      item,
-		orderBook: orderBook,
-		// orderListCache: itemCache,
+		orderDB:        orderDB,
+		PriceTree:      priceTree,
+		Key:            key,
+		slot:           slot,
+		Item:           item,
+		orderBook:      orderBook,
+		orderListCache: newItemCache("orderlist", orderDB.cacheConfig.OrderLists),
+		dirtyLevels:    make(map[string]bool),
+	}
+
+	// volume of each price level is summed in the price tree
+	priceTree.Weight = func(value []byte) *big.Int {
+		return orderTree.getOrderListItem(value).Volume
 	}
 
 	// must restore from db first to make sure we get corrent information
@@ -87,6 +101,10 @@ func (orderTree *OrderTree) Save() error {
 	if priceTreeRoot != nil {
 		orderTree.Item.PriceTreeKey = priceTreeRoot.Key
 		orderTree.Item.PriceTreeSize = orderTree.Depth()
+	} else if orderTree.PriceTree.IsEmptyKey(orderTree.PriceTree.rootKey) {
+		// all prices are removed, the old root must not be restored
+		orderTree.Item.PriceTreeKey = EmptyKey()
+		orderTree.Item.PriceTreeSize = 0
 	}
 
 	// using rlp.EncodeToBytes as underlying encode method
@@ -124,11 +142,30 @@ func (orderTree *OrderTree) Restore() error {
 
 		// update root key for pricetree
 		orderTree.PriceTree.SetRootKey(orderTree.Item.PriceTreeKey, orderTree.Item.PriceTreeSize)
+		orderTree.resetStateCache()
+		orderTree.orderListCache.Purge()
 	}
 
 	return err
 }
 
+// reset : drop in-memory information, used before restoring from the database again
+func (orderTree *OrderTree) reset() {
+	orderTree.Item = &OrderTreeItem{
+		Volume:        Zero(),
+		NumOrders:     0,
+		PriceTreeSize: 0,
+	}
+	orderTree.PriceTree.SetRootKey(EmptyKey(), 0)
+	orderTree.resetStateCache()
+	orderTree.orderListCache.Purge()
+}
+
+// CacheStats : counters of the order list cache
+func (orderTree *OrderTree) CacheStats() CacheStats {
+	return orderTree.orderListCache.Stats()
+}
+
 func (orderTree *OrderTree) String(startDepth int) string {
 	tabs := strings.Repeat("\t", startDepth)
 	return fmt.Sprintf("{\n\t%sMinPriceList: %s\n\t%sMaxPriceList: %s\n\t%sVolume: %v\n\t%sNumOrders: %d\n\t%sDepth: %d\n%s}",
@@ -199,12 +236,12 @@ func (orderTree *OrderTree) PriceList(price *big.Int) *OrderList {
 	// orderList := NewOrderList(price, orderTree)
 
 	// cache is seperated for each ordertree, so no need to add the slot
-	// cacheKey := price.String()
-	// // cache hit
-	// if cached, ok := orderTree.orderListCache.Get(cacheKey); ok {
-	// 	fmt.Println("Cache hit")
-	// 	return cached.(*OrderList)
-	// }
+	cacheKey := price.String()
+	// cache hit
+	if cached, ok := orderTree.orderListCache.Get(cacheKey); ok {
+		// fmt.Println("Cache hit")
+		return cached.(*OrderList)
+	}
 
 	key := orderTree.getKeyFromPrice(price)
 	bytes, found := orderTree.PriceTree.Get(key)
@@ -216,8 +253,8 @@ func (orderTree *OrderTree) PriceList(price *big.Int) *OrderList {
 
 		orderList := orderTree.decodeOrderList(bytes)
 
-		// // update cache
-		// orderTree.orderListCache.Add(cacheKey, orderList)
+		// update cache
+		orderTree.orderListCache.Add(cacheKey, orderList)
 
 		return orderList
 	}
@@ -255,6 +292,9 @@ func (orderTree *OrderTree) SaveOrderList(orderList *OrderList) error {
 		fmt.Printf("Save orderlist key %x, value :%x\n", orderList.Key, value)
 	}
 	// fmt.Println("AFTER UPDATE", orderList.String(0))
+	orderTree.markDirty(orderList.Key)
+	// saved object is the latest one
+	orderTree.orderListCache.Add(orderList.Item.Price.String(), orderList)
 	return orderTree.PriceTree.Put(orderList.Key, value)
 
 }
@@ -270,9 +310,10 @@ func (orderTree *OrderTree) RemovePrice(price *big.Int) {
 		// using tree size
 		orderListKey := orderTree.getKeyFromPrice(price)
 		orderTree.PriceTree.Remove(orderListKey)
+		orderTree.markDirty(orderListKey)
 
-		// // also remove from cache to trigger cache miss
-		// orderTree.orderListCache.Remove(price.String())
+		// also remove from cache to trigger cache miss
+		orderTree.orderListCache.Remove(price.String())
 
 		// should use batch to optimize the performance
 		orderTree.Save()
@@ -283,9 +324,9 @@ func (orderTree *OrderTree) RemovePrice(price *big.Int) {
 func (orderTree *OrderTree) PriceExist(price *big.Int) bool {
 
 	// cache hit
-	// if orderTree.orderListCache.Contains(price.String()) {
-	// 	return true
-	// }
+	if orderTree.orderListCache.Contains(price.String()) {
+		return true
+	}
 
 	orderListKey := orderTree.getKeyFromPrice(price)
 
@@ -338,7 +379,12 @@ func (orderTree *OrderTree) InsertOrder(quote map[string]string) error {
 
 		if orderList.OrderExist(order.Key) {
 			// orderTree.RemoveOrderByID(key)
-			orderTree.RemoveOrder(order)
+			// remove the stored order, not the new one, because links are kept in the stored one.
+			// It may be at another price or belong to the other side, so check its order list first
+			existing := orderList.GetOrder(order.Key)
+			if existing != nil && bytes.Equal(existing.Item.OrderList, orderTree.getKeyFromPrice(existing.Item.Price)) {
+				orderTree.RemoveOrder(existing)
+			}
 			// fmt.Println("Order already exsited, do nothing or should remove it?")
 			// return nil
 		}
@@ -387,6 +433,9 @@ func (orderTree *OrderTree) UpdateOrder(quote map[string]string) error {
 		if orderList.Item.Length == 0 {
 			orderTree.RemovePrice(price)
 		}
+		// the amended order still belongs to the owner of the original one
+		quote["owner"] = order.Item.Owner.Hex()
+		quote["nonce"] = strconv.FormatUint(order.Item.Nonce, 10)
 		orderTree.InsertOrder(quote)
 		// orderList.Save()
 	} else {
@@ -561,3 +610,140 @@ func (orderTree *OrderTree) MinPriceList() *OrderList {
 	}
 	return nil
 }
+
+// FloorPriceList : get the order list with the highest price lower than or equal to price
+func (orderTree *OrderTree) FloorPriceList(price *big.Int) *OrderList {
+	if node, found := orderTree.PriceTree.Floor(orderTree.getKeyFromPrice(price)); found {
+		return orderTree.decodeOrderList(node.Value())
+	}
+	return nil
+}
+
+// CeilingPriceList : get the order list with the lowest price higher than or equal to price
+func (orderTree *OrderTree) CeilingPriceList(price *big.Int) *OrderList {
+	if node, found := orderTree.PriceTree.Ceiling(orderTree.getKeyFromPrice(price)); found {
+		return orderTree.decodeOrderList(node.Value())
+	}
+	return nil
+}
+
+// IteratePriceLists : call fn for each order list with price between low and high (both inclusive),
+// nil low or high means there is no bound. Walk by descending price if descending is set, stop when fn returns false.
+// Only the nodes in the range and the path to the first one are loaded from database
+func (orderTree *OrderTree) IteratePriceLists(low, high *big.Int, descending bool, fn func(orderList *OrderList) bool) {
+	tree := orderTree.PriceTree.Tree
+	if low != nil && high != nil && low.Cmp(high) > 0 {
+		return
+	}
+
+	// find the first node, then move to the next node by the links
+	var first *Node
+	if descending {
+		if high == nil {
+			first = tree.Right()
+		} else {
+			first, _ = tree.Floor(orderTree.getKeyFromPrice(high))
+		}
+	} else {
+		if low == nil {
+			first = tree.Left()
+		} else {
+			first, _ = tree.Ceiling(orderTree.getKeyFromPrice(low))
+		}
+	}
+	if first == nil {
+		return
+	}
+
+	it := tree.IteratorAt(first)
+	for ok := true; ok; {
+		orderList := orderTree.decodeOrderList(it.Value())
+		if orderList.Item.Price == nil {
+			// can not decode, stop here instead of returning broken lists
+			return
+		}
+		if descending && low != nil && orderList.Item.Price.Cmp(low) < 0 {
+			return
+		}
+		if !descending && high != nil && orderList.Item.Price.Cmp(high) > 0 {
+			return
+		}
+		if !fn(orderList) {
+			return
+		}
+		if descending {
+			ok = it.Prev()
+		} else {
+			ok = it.Next()
+		}
+	}
+}
+
+// PriceListsInRange : get order lists with price between low and high by ascending price
+func (orderTree *OrderTree) PriceListsInRange(low, high *big.Int) []*OrderList {
+	var orderLists []*OrderList
+	orderTree.IteratePriceLists(low, high, false, func(orderList *OrderList) bool {
+		orderLists = append(orderLists, orderList)
+		return true
+	})
+	return orderLists
+}
+
+// FirstPriceLists : get at most n order lists from the min price, or from the max price if descending is set
+func (orderTree *OrderTree) FirstPriceLists(n int, descending bool) []*OrderList {
+	var orderLists []*OrderList
+	if n <= 0 {
+		return orderLists
+	}
+	orderTree.IteratePriceLists(nil, nil, descending, func(orderList *OrderList) bool {
+		orderLists = append(orderLists, orderList)
+		return len(orderLists) < n
+	})
+	return orderLists
+}
+
+// VolumeInRange : total volume of the order lists with price between low and high, using the
+// subtree volumes of the price tree so only the paths to the bounds are loaded
+func (orderTree *OrderTree) VolumeInRange(low, high *big.Int) *big.Int {
+	tree := orderTree.PriceTree.Tree
+	volume := tree.TotalVolume()
+	if high != nil {
+		volume = orderTree.VolumeBelow(high, true)
+	}
+	if low != nil {
+		volume = Sub(volume, orderTree.VolumeBelow(low, false))
+	}
+	if volume.Sign() < 0 {
+		return Zero()
+	}
+	return volume
+}
+
+// VolumeBelow : total volume of the order lists with price lower than price, or equal to it if inclusive is set
+func (orderTree *OrderTree) VolumeBelow(price *big.Int, inclusive bool) *big.Int {
+	return orderTree.PriceTree.VolumeBefore(orderTree.getKeyFromPrice(price), inclusive)
+}
+
+// PriceListAt : get the order list at the index from the min price, or from the max price if descending is set
+func (orderTree *OrderTree) PriceListAt(index uint64, descending bool) *OrderList {
+	size := orderTree.Depth()
+	if index >= size {
+		return nil
+	}
+	if descending {
+		index = size - 1 - index
+	}
+	if node := orderTree.PriceTree.Select(index); node != nil {
+		return orderTree.decodeOrderList(node.Value())
+	}
+	return nil
+}
+
+// PriceRank : number of price levels lower than price, or higher than price if descending is set
+func (orderTree *OrderTree) PriceRank(price *big.Int, descending bool) uint64 {
+	key := orderTree.getKeyFromPrice(price)
+	if descending {
+		return orderTree.Depth() - orderTree.PriceTree.Rank(key, true)
+	}
+	return orderTree.PriceTree.Rank(key, false)
+}
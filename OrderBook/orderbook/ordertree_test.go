@@ -94,3 +94,65 @@ func TestNewOrderTree(t *testing.T) {
 
 	// TODO Check PriceList as well and verify with the orders
 }
+
+func TestOrderTreePriceRange(t *testing.T) {
+	orderBook := NewOrderBook("RANGE/TEST", NewBatchDatabaseWithBackend(NewMemBackend(), 0, 0, EncodeBytesItem, DecodeBytesItem))
+	orderBook.SetClock(FixedClock(1))
+	for i, price := range []string{"105", "101", "103", "109", "107"} {
+		orderBook.ProcessOrder(map[string]string{
+			"type": Limit, "side": Ask, "quantity": "2", "price": price, "trade_id": strconv.Itoa(i),
+		}, false)
+	}
+
+	prices := func(orderLists []*OrderList) string {
+		str := ""
+		for _, orderList := range orderLists {
+			str += orderList.Item.Price.String() + " "
+		}
+		return str
+	}
+
+	if got := prices(orderBook.Asks.PriceListsInRange(ToBigInt("102"), ToBigInt("107"))); got != "103 105 107 " {
+		t.Errorf("PriceListsInRange incorrect, got: %s", got)
+	}
+	if got := prices(orderBook.Asks.PriceListsInRange(ToBigInt("110"), nil)); got != "" {
+		t.Errorf("PriceListsInRange must be empty, got: %s", got)
+	}
+	if got := prices(orderBook.Asks.FirstPriceLists(2, true)); got != "109 107 " {
+		t.Errorf("FirstPriceLists incorrect, got: %s", got)
+	}
+	if got := prices(orderBook.BestPriceLists(Ask, 3)); got != "101 103 105 " {
+		t.Errorf("BestPriceLists incorrect, got: %s", got)
+	}
+	if orderList := orderBook.Asks.FloorPriceList(ToBigInt("104")); orderList == nil || orderList.Item.Price.Cmp(ToBigInt("103")) != 0 {
+		t.Errorf("FloorPriceList incorrect, got: %v", orderList)
+	}
+	if orderList := orderBook.Asks.CeilingPriceList(ToBigInt("104")); orderList == nil || orderList.Item.Price.Cmp(ToBigInt("105")) != 0 {
+		t.Errorf("CeilingPriceList incorrect, got: %v", orderList)
+	}
+	if volume := orderBook.Asks.VolumeInRange(nil, ToBigInt("105")); volume.Cmp(ToBigInt("6")) != 0 {
+		t.Errorf("VolumeInRange incorrect, got: %v", volume)
+	}
+
+	if orderList := orderBook.PriceLevel(Ask, 3); orderList == nil || orderList.Item.Price.Cmp(ToBigInt("107")) != 0 {
+		t.Errorf("PriceLevel incorrect, got: %v", orderList)
+	}
+	if orderBook.PriceLevel(Ask, 5) != nil {
+		t.Error("PriceLevel out of range must be nil")
+	}
+	if rank := orderBook.Asks.PriceRank(ToBigInt("107"), true); rank != 1 {
+		t.Errorf("PriceRank incorrect, got: %d", rank)
+	}
+	if volume := orderBook.VolumeBetterThan(Ask, ToBigInt("105")); volume.Cmp(ToBigInt("4")) != 0 {
+		t.Errorf("VolumeBetterThan incorrect, got: %v", volume)
+	}
+
+	// fill or kill check for a bid of 5 at 103, only 4 is available
+	if volume := orderBook.MatchableVolume(Bid, ToBigInt("103"), ToBigInt("5")); volume.Cmp(ToBigInt("4")) != 0 {
+		t.Errorf("MatchableVolume incorrect, got: %v", volume)
+	}
+	filled, cost, lastPrice := orderBook.EstimateMarketImpact(Bid, ToBigInt("5"))
+	if filled.Cmp(ToBigInt("5")) != 0 || cost.Cmp(ToBigInt("513")) != 0 || lastPrice.Cmp(ToBigInt("105")) != 0 {
+		t.Errorf("EstimateMarketImpact incorrect, got: %v %v %v", filled, cost, lastPrice)
+	}
+}
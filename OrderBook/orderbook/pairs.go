@@ -0,0 +1,230 @@
+package orderbook
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// PairActive : the pair accepts all operations
+	PairActive = "active"
+	// PairSuspended : new orders and updates are rejected, resting orders can still be cancelled
+	PairSuspended = "suspended"
+	// PairDelisted : all resting orders are cancelled and the orderbook can not be used anymore
+	PairDelisted = "delisted"
+)
+
+// PairRegistryKey : where the names of all registered pairs are stored
+var PairRegistryKey = crypto.Keccak256([]byte("orderbook/pairs"))
+
+// PairItem : a registered pair, the name is in lower case
+type PairItem struct {
+	Name          string         `json:"name"`
+	BaseToken     common.Address `json:"baseToken"`
+	QuoteToken    common.Address `json:"quoteToken"`
+	BaseDecimals  uint64         `json:"baseDecimals"`
+	QuoteDecimals uint64         `json:"quoteDecimals"`
+	MaxVolume     *big.Int       `json:"maxVolume"`
+	Status        string         `json:"status"`
+	CreatedAt     uint64         `json:"createdAt"`
+}
+
+// pairRegistryItem : names of the registered pairs, each pair is stored at its own key
+type pairRegistryItem struct {
+	Names []string
+}
+
+func (pair *PairItem) String() string {
+	return fmt.Sprintf("%s, base: %s(%d), quote: %s(%d), status: %s, created: %d",
+		pair.Name, pair.BaseToken.Hex(), pair.BaseDecimals, pair.QuoteToken.Hex(), pair.QuoteDecimals,
+		pair.Status, pair.CreatedAt)
+}
+
+// GetPairKey : key of the registry entry of the pair
+func GetPairKey(name string) []byte {
+	return crypto.Keccak256([]byte("orderbook/pair/" + strings.ToLower(name)))
+}
+
+// loadPairs : read the registry, it is called before the engine is shared
+func (engine *Engine) loadPairs() error {
+	val, err := engine.db.Get(PairRegistryKey, &pairRegistryItem{})
+	if err != nil || val == nil {
+		// nothing registered yet
+		return nil
+	}
+	for _, name := range val.(*pairRegistryItem).Names {
+		pair, err := engine.db.Get(GetPairKey(name), &PairItem{})
+		if err != nil {
+			return fmt.Errorf("Pair %s is registered but can not be read :%v", name, err)
+		}
+		engine.pairs[name] = pair.(*PairItem)
+		engine.addNoncePair(name)
+	}
+	return nil
+}
+
+// savePair : write the pair and the registry, the caller holds the engine lock
+func (engine *Engine) savePair(pair *PairItem) error {
+	if err := engine.db.Put(GetPairKey(pair.Name), pair); err != nil {
+		return err
+	}
+	names := []string{pair.Name}
+	for name := range engine.pairs {
+		if name != pair.Name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if err := engine.db.Put(PairRegistryKey, &pairRegistryItem{Names: names}); err != nil {
+		return err
+	}
+	if err := engine.db.Commit(); err != nil {
+		return err
+	}
+	engine.pairs[pair.Name] = pair
+	engine.addNoncePair(pair.Name)
+	return nil
+}
+
+// pairNames : sorted names of the pairs that are not delisted
+func (engine *Engine) pairNames() []string {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	names := make([]string, 0, len(engine.pairs))
+	for name, pair := range engine.pairs {
+		if pair.Status != PairDelisted {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PairNames : sorted names of the pairs in the state root, delisted pairs are not included
+func (engine *Engine) PairNames() []string {
+	return engine.pairNames()
+}
+
+// ListPairs : all registered pairs ordered by name, including delisted ones
+func (engine *Engine) ListPairs() []*PairItem {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	pairs := make([]*PairItem, 0, len(engine.pairs))
+	for _, pair := range engine.pairs {
+		copied := *pair
+		pairs = append(pairs, &copied)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Name < pairs[j].Name
+	})
+	return pairs
+}
+
+// GetPair : the registry entry of the pair, nil if it is not registered
+func (engine *Engine) GetPair(pairName string) *PairItem {
+	engine.lock.RLock()
+	defer engine.lock.RUnlock()
+	pair, ok := engine.pairs[strings.ToLower(pairName)]
+	if !ok {
+		return nil
+	}
+	copied := *pair
+	return &copied
+}
+
+// AddPair : register a new active pair, creation time is taken from the clock when it is not set
+func (engine *Engine) AddPair(pair *PairItem) error {
+	if pair == nil || pair.Name == "" {
+		return fmt.Errorf("Pair name is empty")
+	}
+	if pair.BaseDecimals > MaxDecimals || pair.QuoteDecimals > MaxDecimals {
+		return fmt.Errorf("Pair decimals must not be greater than %d", MaxDecimals)
+	}
+	copied := *pair
+	copied.Name = strings.ToLower(pair.Name)
+	copied.Status = PairActive
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	if _, ok := engine.pairs[copied.Name]; ok {
+		return fmt.Errorf("Pair is already registered :%s", copied.Name)
+	}
+	if copied.CreatedAt == 0 {
+		copied.CreatedAt = engine.clock.Now()
+	}
+	return engine.savePair(&copied)
+}
+
+// SuspendPair : reject new orders and updates until the pair is resumed
+func (engine *Engine) SuspendPair(pairName string) error {
+	return engine.setPairStatus(pairName, PairSuspended, PairActive)
+}
+
+// ResumePair : accept orders again for a suspended or delisted pair
+func (engine *Engine) ResumePair(pairName string) error {
+	return engine.setPairStatus(pairName, PairActive, PairSuspended, PairDelisted)
+}
+
+// DelistPair : cancel all resting orders of the pair then stop using its orderbook, the number of
+// cancelled orders is returned. A delisted pair can be delisted again if cancelling failed
+func (engine *Engine) DelistPair(pairName string) (uint64, error) {
+	// load the orderbook before it can not be used anymore
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return 0, err
+	}
+	if err := engine.setPairStatus(pairName, PairDelisted, PairActive, PairSuspended, PairDelisted); err != nil {
+		return 0, err
+	}
+
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	count, err := ob.CancelAllOrders(0)
+	if err != nil {
+		return 0, err
+	}
+	return count, ob.db.Commit()
+}
+
+// setPairStatus : persist the new status, then update the loaded orderbook. Orders processed before
+// the orderbook is updated still use the previous status
+func (engine *Engine) setPairStatus(pairName, status string, from ...string) error {
+	name := strings.ToLower(pairName)
+
+	engine.lock.Lock()
+	pair, ok := engine.pairs[name]
+	if !ok {
+		engine.lock.Unlock()
+		return fmt.Errorf("Pair is not registered :%s", name)
+	}
+	allowed := false
+	for _, current := range from {
+		if pair.Status == current {
+			allowed = true
+		}
+	}
+	if !allowed {
+		engine.lock.Unlock()
+		return fmt.Errorf("Pair %s is %s, can not be %s", name, pair.Status, status)
+	}
+	copied := *pair
+	copied.Status = status
+	err := engine.savePair(&copied)
+	ob := engine.Orderbooks[name]
+	engine.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if ob != nil {
+		ob.lock.Lock()
+		ob.status = status
+		ob.lock.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package orderbook
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestPairRegistry(t *testing.T) {
+	backend := NewMemBackend()
+	engine := NewEngineWithBackend(backend, map[string]*big.Int{"tomo/weth": ToBigInt("1")})
+	engine.SetClock(FixedClock(10))
+
+	err := engine.AddPair(&PairItem{
+		Name:          "TOMO/USDT",
+		BaseToken:     common.HexToAddress("0x01"),
+		QuoteToken:    common.HexToAddress("0x02"),
+		BaseDecimals:  18,
+		QuoteDecimals: 6,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.AddPair(&PairItem{Name: "tomo/usdt"}); err == nil {
+		t.Error("pair must not be registered twice")
+	}
+	pairs := engine.ListPairs()
+	if len(pairs) != 2 || pairs[0].Name != "tomo/usdt" || pairs[1].Name != "tomo/weth" {
+		t.Fatalf("pairs incorrect, got: %v", pairs)
+	}
+	if pairs[0].Status != PairActive || pairs[0].CreatedAt != 10 || pairs[0].QuoteDecimals != 6 {
+		t.Errorf("pair incorrect, got: %s", pairs[0])
+	}
+	if _, err := engine.GetOrderBook("ABC/XYZ"); err == nil {
+		t.Error("orderbook of an unknown pair must not be created")
+	}
+
+	orders := []map[string]string{
+		{"pair_name": "TOMO/USDT", "order_id": "0", "type": Limit, "side": Ask, "quantity": "5", "price": "101", "trade_id": "1"},
+		{"pair_name": "TOMO/USDT", "order_id": "0", "type": Limit, "side": Ask, "quantity": "3", "price": "105", "trade_id": "2"},
+		{"pair_name": "TOMO/USDT", "order_id": "0", "type": Limit, "side": Bid, "quantity": "4", "price": "99", "trade_id": "3"},
+	}
+	for _, order := range orders[:2] {
+		engine.ProcessOrder(order)
+	}
+
+	// suspended pair rejects new orders but resting orders can be cancelled
+	if err := engine.SuspendPair("TOMO/USDT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, orderInBook := engine.ProcessOrder(orders[2]); orderInBook != nil {
+		t.Error("order must be rejected for a suspended pair")
+	}
+	err = engine.CancelOrder(map[string]string{"pair_name": "TOMO/USDT", "order_id": "2", "side": Ask, "price": "105"})
+	if err != nil {
+		t.Error(err)
+	}
+	if err := engine.SuspendPair("TOMO/USDT"); err == nil {
+		t.Error("suspended pair must not be suspended again")
+	}
+	if err := engine.ResumePair("TOMO/USDT"); err != nil {
+		t.Fatal(err)
+	}
+	engine.ProcessOrder(orders[2])
+
+	ob, _ := engine.GetOrderBook("TOMO/USDT")
+	if ob.Asks.Item.NumOrders != 1 || ob.Bids.Item.NumOrders != 1 {
+		t.Fatalf("orders incorrect, got asks: %d, bids: %d", ob.Asks.Item.NumOrders, ob.Bids.Item.NumOrders)
+	}
+
+	// delisting cancels all resting orders, the pair is not part of the state root anymore
+	root := NewEngineWithBackend(NewMemBackend(), map[string]*big.Int{"tomo/weth": ToBigInt("1")}).StateRoot()
+	count, err := engine.DelistPair("TOMO/USDT")
+	if err != nil || count != 2 {
+		t.Fatalf("delist incorrect, got: %d, %v", count, err)
+	}
+	if ob.Asks.Depth() != 0 || ob.Bids.Depth() != 0 || ob.Asks.Item.Volume.Sign() != 0 {
+		t.Errorf("orders must be cancelled, got asks: %d, bids: %d", ob.Asks.Depth(), ob.Bids.Depth())
+	}
+	if _, orderInBook := engine.ProcessOrder(orders[0]); orderInBook != nil {
+		t.Error("order must be rejected for a delisted pair")
+	}
+	if engine.StateRoot() != root {
+		t.Error("delisted pair must not be in the state root")
+	}
+	if report := engine.Verify(false); len(report.Issues) != 0 {
+		t.Errorf("verify failed after delisting :%s", report)
+	}
+	engine.Commit()
+
+	// registry is loaded from the database, configured pairs do not override it
+	reloaded := NewEngineWithBackend(backend, map[string]*big.Int{"tomo/weth": ToBigInt("1"), "tomo/usdt": ToBigInt("1")})
+	pair := reloaded.GetPair("tomo/usdt")
+	if pair == nil || pair.Status != PairDelisted || pair.BaseToken != common.HexToAddress("0x01") {
+		t.Fatalf("pair must be loaded from the registry, got: %v", pair)
+	}
+	if _, err := reloaded.GetOrderBook("TOMO/USDT"); err == nil {
+		t.Error("orderbook of a delisted pair must not be loaded")
+	}
+	if err := reloaded.ResumePair("TOMO/USDT"); err != nil {
+		t.Fatal(err)
+	}
+	relisted, err := reloaded.GetOrderBook("TOMO/USDT")
+	if err != nil || relisted.Asks.Depth() != 0 {
+		t.Errorf("relisted orderbook must be empty, got: %v", err)
+	}
+}
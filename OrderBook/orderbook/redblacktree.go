@@ -8,6 +8,7 @@ package orderbook
 import (
 	"bytes"
 	"fmt"
+	"math/big"
 )
 
 // Tree holds elements of the red-black tree
@@ -23,6 +24,8 @@ type Tree struct {
 	// EncodeToBytes EncodeToBytes
 	// DecodeBytes   DecodeBytes
 	FormatBytes FormatBytes
+	// volume of each value is summed in the subtree statistics, nil means zero volume
+	Weight Weight
 	// EmptyKey      []byte
 }
 
@@ -94,7 +97,8 @@ func (tree *Tree) Put(key []byte, value []byte) error {
 				// node.Key = key
 				// item := &Item{Value: value, Keys: &KeyMeta{}}
 				node.Item.Value = value
-				tree.Save(node)
+				// volume of the value may change
+				tree.updateStatsToRoot(node)
 				return nil
 			case compare < 0:
 				if tree.IsEmptyKey(node.LeftKey()) {
@@ -131,6 +135,7 @@ func (tree *Tree) Put(key []byte, value []byte) error {
 	}
 
 	// tree.Save(insertedNode)
+	tree.updateStatsToRoot(insertedNode)
 	tree.insertCase1(insertedNode)
 	tree.Save(insertedNode)
 
@@ -202,52 +207,65 @@ func (tree *Tree) Get(key []byte) (value []byte, found bool) {
 }
 
 // Remove remove the node from the tree by key.
+// Nodes are addressed by their keys in the database, so a node with two children is replaced by moving
+// its predecessor into its place, instead of copying the predecessor key into the node.
 // Key should adhere to the comparator's type assertion, otherwise method panics.
 func (tree *Tree) Remove(key []byte) {
-	var child *Node
 	node, err := tree.GetNode(key)
 
 	if err != nil || node == nil {
 		return
 	}
 
-	var left, right *Node = nil, nil
-	if !tree.IsEmptyKey(node.LeftKey()) {
-		left = node.Left(tree)
-	}
-	if !tree.IsEmptyKey(node.RightKey()) {
-		right = node.Right(tree)
-	}
+	// child is moved to the position of the removed one, it can be nil with childParent as its parent
+	var child, childParent *Node
+	removedColor := node.Item.Color
 
-	if left != nil && right != nil {
-		// pred := left.maximumNode(tree)
-		// node.Key = pred.Key
-		// node.Item = pred.Item
-		// node = pred
-		node = left.maximumNode(tree)
-	}
+	if tree.IsEmptyKey(node.LeftKey()) || tree.IsEmptyKey(node.RightKey()) {
+		if tree.IsEmptyKey(node.LeftKey()) {
+			child = node.Right(tree)
+		} else {
+			child = node.Left(tree)
+		}
+		childParent = node.Parent(tree)
+		tree.replaceNode(node, child)
+	} else {
+		pred := node.Left(tree).maximumNode(tree)
+		removedColor = pred.Item.Color
+		child = pred.Left(tree)
 
-	if left == nil || right == nil {
-		if right == nil {
-			child = left
+		if tree.Comparator(pred.ParentKey(), node.Key) == 0 {
+			childParent = pred
 		} else {
-			child = right
+			childParent = pred.Parent(tree)
+			tree.replaceNode(pred, child)
+			// left subtree of node is changed after the replacement
+			pred.LeftKey(node.LeftKey())
+			left := node.Left(tree)
+			left.ParentKey(pred.Key)
+			tree.Save(left)
 		}
 
-		if node.Item.Color == black {
-			node.Item.Color = nodeColor(child)
-			tree.Save(node)
+		tree.replaceNode(node, pred)
+		pred.RightKey(node.RightKey())
+		right := pred.Right(tree)
+		right.ParentKey(pred.Key)
+		tree.Save(right)
+		pred.Item.Color = node.Item.Color
+		tree.Save(pred)
+	}
 
-			tree.deleteCase1(node)
-			// fmt.Println("DELETE ", tree, node)
-		}
+	tree.deleteNode(node)
+	if childParent != nil {
+		// get the latest links after the replacements
+		childParent, _ = tree.GetNode(childParent.Key)
+	}
 
-		tree.replaceNode(node, child)
+	// update the statistics from the lowest changed node to the root, before rotating
+	tree.updateStatsToRoot(childParent)
 
-		if tree.IsEmptyKey(node.ParentKey()) && child != nil {
-			child.Item.Color = black
-			tree.Save(child)
-		}
+	if removedColor == black {
+		tree.deleteFixup(child, childParent)
 	}
 
 	tree.size--
@@ -363,6 +381,131 @@ func (tree *Tree) Ceiling(key []byte) (ceiling *Node, found bool) {
 	return nil, false
 }
 
+// Rank returns the number of nodes with key smaller than the given key, or smaller than or equal to it
+// if inclusive is set. The key does not need to be in the tree.
+func (tree *Tree) Rank(key []byte, inclusive bool) uint64 {
+	var rank uint64
+	node := tree.Root()
+	for node != nil {
+		compare := tree.Comparator(key, node.Key)
+		if compare < 0 || (compare == 0 && !inclusive) {
+			node = node.Left(tree)
+			continue
+		}
+		leftSize, _ := tree.subtreeStats(node.LeftKey())
+		rank += leftSize + 1
+		if compare == 0 {
+			break
+		}
+		node = node.Right(tree)
+	}
+	return rank
+}
+
+// Select returns the node at the index in key order (starting from 0), or nil if index is out of range.
+func (tree *Tree) Select(index uint64) *Node {
+	node := tree.Root()
+	for node != nil {
+		leftSize, _ := tree.subtreeStats(node.LeftKey())
+		switch {
+		case index < leftSize:
+			node = node.Left(tree)
+		case index == leftSize:
+			return node
+		default:
+			index -= leftSize + 1
+			node = node.Right(tree)
+		}
+	}
+	return nil
+}
+
+// VolumeBefore returns the total weight of the nodes with key smaller than the given key,
+// or smaller than or equal to it if inclusive is set.
+func (tree *Tree) VolumeBefore(key []byte, inclusive bool) *big.Int {
+	volume := Zero()
+	node := tree.Root()
+	for node != nil {
+		compare := tree.Comparator(key, node.Key)
+		if compare < 0 || (compare == 0 && !inclusive) {
+			node = node.Left(tree)
+			continue
+		}
+		_, leftVolume := tree.subtreeStats(node.LeftKey())
+		volume = Add(volume, Add(leftVolume, tree.weight(node.Value())))
+		if compare == 0 {
+			break
+		}
+		node = node.Right(tree)
+	}
+	return volume
+}
+
+// TotalVolume returns the total weight of all nodes.
+func (tree *Tree) TotalVolume() *big.Int {
+	_, volume := tree.subtreeStats(tree.rootKey)
+	return volume
+}
+
+func (tree *Tree) weight(value []byte) *big.Int {
+	if tree.Weight == nil || value == nil {
+		return Zero()
+	}
+	if weight := tree.Weight(value); weight != nil {
+		return weight
+	}
+	return Zero()
+}
+
+// subtreeStats : size and volume of the subtree rooted at the key, zero for empty key
+func (tree *Tree) subtreeStats(key []byte) (uint64, *big.Int) {
+	if tree.IsEmptyKey(key) {
+		return 0, Zero()
+	}
+	node, _ := tree.GetNode(key)
+	if node == nil || node.Item.Volume == nil {
+		return 0, Zero()
+	}
+	return node.Item.Size, node.Item.Volume
+}
+
+// updateStats : compute subtree size and volume of the node from its children, the node is not saved
+func (tree *Tree) updateStats(node *Node) {
+	leftSize, leftVolume := tree.subtreeStats(node.LeftKey())
+	rightSize, rightVolume := tree.subtreeStats(node.RightKey())
+	node.Item.Size = leftSize + rightSize + 1
+	node.Item.Volume = Add(tree.weight(node.Value()), Add(leftVolume, rightVolume))
+}
+
+// updateStatsToRoot : update and save the node and all of its ancestors
+func (tree *Tree) updateStatsToRoot(node *Node) {
+	for node != nil {
+		tree.updateStats(node)
+		tree.Save(node)
+		if tree.IsEmptyKey(node.ParentKey()) {
+			return
+		}
+		node = node.Parent(tree)
+	}
+}
+
+// rebuildStats : compute the statistics of all nodes in the subtree from the leaves, used when
+// the stored ones are missing or broken, return the subtree size and volume
+func (tree *Tree) rebuildStats(key []byte) (uint64, *big.Int) {
+	if tree.IsEmptyKey(key) {
+		return 0, Zero()
+	}
+	node, _ := tree.GetNode(key)
+	if node == nil {
+		return 0, Zero()
+	}
+	tree.rebuildStats(node.LeftKey())
+	tree.rebuildStats(node.RightKey())
+	tree.updateStats(node)
+	tree.Save(node)
+	return node.Item.Size, node.Item.Volume
+}
+
 // Clear removes all nodes from the tree.
 // we do not delete other children, but update them by overriding later
 func (tree *Tree) Clear() {
@@ -448,7 +591,10 @@ func (tree *Tree) rotateLeft(node *Node) {
 	}
 	right.LeftKey(node.Key)
 	node.ParentKey(right.Key)
+	// node is the child now, so it is updated first
+	tree.updateStats(node)
 	tree.Save(node)
+	tree.updateStats(right)
 	tree.Save(right)
 }
 
@@ -463,7 +609,9 @@ func (tree *Tree) rotateRight(node *Node) {
 	}
 	left.RightKey(node.Key)
 	node.ParentKey(left.Key)
+	tree.updateStats(node)
 	tree.Save(node)
+	tree.updateStats(left)
 	tree.Save(left)
 }
 
@@ -657,145 +805,95 @@ func (tree *Tree) Commit() error {
 	// return batch.Write()
 }
 
-func (tree *Tree) deleteCase1(node *Node) {
-	if tree.IsEmptyKey(node.ParentKey()) {
-		// fmt.Println("DELETE")
-		tree.deleteNode(node, false)
-		return
-	}
-
-	tree.deleteCase2(node)
-}
-
-func (tree *Tree) deleteCase2(node *Node) {
-	parent := node.Parent(tree)
-	sibling := node.sibling(tree)
+// deleteFixup : restore red-black properties after removing a black node, node has an extra black
+// and may be nil, so its parent is passed too
+func (tree *Tree) deleteFixup(node *Node, parent *Node) {
+	for parent != nil && nodeColor(node) == black {
+		isLeft := tree.IsEmptyKey(parent.LeftKey())
+		if node != nil {
+			isLeft = tree.Comparator(node.Key, parent.LeftKey()) == 0
+		}
 
-	if nodeColor(sibling) == red {
-		parent.Item.Color = red
-		sibling.Item.Color = black
-		tree.Save(parent)
-		tree.Save(sibling)
-		if tree.Comparator(node.Key, parent.LeftKey()) == 0 {
+		if isLeft {
+			sibling := parent.Right(tree)
+			if nodeColor(sibling) == red {
+				sibling.Item.Color = black
+				parent.Item.Color = red
+				tree.Save(sibling)
+				tree.Save(parent)
+				tree.rotateLeft(parent)
+				sibling = parent.Right(tree)
+			}
+			if nodeColor(sibling.Left(tree)) == black && nodeColor(sibling.Right(tree)) == black {
+				sibling.Item.Color = red
+				tree.Save(sibling)
+				node = parent
+				parent = node.Parent(tree)
+				continue
+			}
+			if nodeColor(sibling.Right(tree)) == black {
+				siblingLeft := sibling.Left(tree)
+				siblingLeft.Item.Color = black
+				sibling.Item.Color = red
+				tree.Save(siblingLeft)
+				tree.Save(sibling)
+				tree.rotateRight(sibling)
+				parent, _ = tree.GetNode(parent.Key)
+				sibling = parent.Right(tree)
+			}
+			siblingRight := sibling.Right(tree)
+			sibling.Item.Color = parent.Item.Color
+			parent.Item.Color = black
+			siblingRight.Item.Color = black
+			tree.Save(sibling)
+			tree.Save(parent)
+			tree.Save(siblingRight)
 			tree.rotateLeft(parent)
 		} else {
+			sibling := parent.Left(tree)
+			if nodeColor(sibling) == red {
+				sibling.Item.Color = black
+				parent.Item.Color = red
+				tree.Save(sibling)
+				tree.Save(parent)
+				tree.rotateRight(parent)
+				sibling = parent.Left(tree)
+			}
+			if nodeColor(sibling.Left(tree)) == black && nodeColor(sibling.Right(tree)) == black {
+				sibling.Item.Color = red
+				tree.Save(sibling)
+				node = parent
+				parent = node.Parent(tree)
+				continue
+			}
+			if nodeColor(sibling.Left(tree)) == black {
+				siblingRight := sibling.Right(tree)
+				siblingRight.Item.Color = black
+				sibling.Item.Color = red
+				tree.Save(siblingRight)
+				tree.Save(sibling)
+				tree.rotateLeft(sibling)
+				parent, _ = tree.GetNode(parent.Key)
+				sibling = parent.Left(tree)
+			}
+			siblingLeft := sibling.Left(tree)
+			sibling.Item.Color = parent.Item.Color
+			parent.Item.Color = black
+			siblingLeft.Item.Color = black
+			tree.Save(sibling)
+			tree.Save(parent)
+			tree.Save(siblingLeft)
 			tree.rotateRight(parent)
 		}
+		// extra black is moved to the root
+		node = tree.Root()
+		parent = nil
 	}
 
-	tree.deleteCase3(node)
-}
-
-func (tree *Tree) deleteCase3(node *Node) {
-
-	parent := node.Parent(tree)
-	sibling := node.sibling(tree)
-	siblingLeft := sibling.Left(tree)
-	siblingRight := sibling.Right(tree)
-
-	if nodeColor(parent) == black &&
-		nodeColor(sibling) == black &&
-		nodeColor(siblingLeft) == black &&
-		nodeColor(siblingRight) == black {
-		sibling.Item.Color = red
-		tree.Save(sibling)
-		tree.deleteCase1(parent)
-
-		if tree.db.Debug {
-			fmt.Printf("delete node,  key: %x, parentKey :%x\n", node.Key, parent.Key)
-		}
-		tree.deleteNode(node, false)
-
-	} else {
-		tree.deleteCase4(node)
-	}
-
-}
-
-func (tree *Tree) deleteCase4(node *Node) {
-	parent := node.Parent(tree)
-	sibling := node.sibling(tree)
-	siblingLeft := sibling.Left(tree)
-	siblingRight := sibling.Right(tree)
-
-	if nodeColor(parent) == red &&
-		nodeColor(sibling) == black &&
-		nodeColor(siblingLeft) == black &&
-		nodeColor(siblingRight) == black {
-		sibling.Item.Color = red
-		parent.Item.Color = black
-		tree.Save(sibling)
-		tree.Save(parent)
-	} else {
-		tree.deleteCase5(node)
-	}
-}
-
-func (tree *Tree) deleteCase5(node *Node) {
-	parent := node.Parent(tree)
-	sibling := node.sibling(tree)
-	siblingLeft := sibling.Left(tree)
-	siblingRight := sibling.Right(tree)
-
-	if tree.Comparator(node.Key, parent.LeftKey()) == 0 &&
-		nodeColor(sibling) == black &&
-		nodeColor(siblingLeft) == red &&
-		nodeColor(siblingRight) == black {
-		sibling.Item.Color = red
-		siblingLeft.Item.Color = black
-
-		tree.Save(sibling)
-		tree.Save(siblingLeft)
-
-		tree.rotateRight(sibling)
-
-	} else if tree.Comparator(node.Key, parent.RightKey()) == 0 &&
-		nodeColor(sibling) == black &&
-		nodeColor(siblingRight) == red &&
-		nodeColor(siblingLeft) == black {
-		sibling.Item.Color = red
-		siblingRight.Item.Color = black
-
-		tree.Save(sibling)
-		tree.Save(siblingRight)
-
-		tree.rotateLeft(sibling)
-
-	}
-
-	tree.deleteCase6(node)
-}
-
-func (tree *Tree) deleteCase6(node *Node) {
-	parent := node.Parent(tree)
-	sibling := node.sibling(tree)
-	siblingLeft := sibling.Left(tree)
-	siblingRight := sibling.Right(tree)
-
-	sibling.Item.Color = nodeColor(parent)
-	parent.Item.Color = black
-
-	tree.Save(sibling)
-	tree.Save(parent)
-
-	// fmt.Println("before-update ", tree, sibling, parent, siblingLeft, siblingRight)
-
-	if tree.Comparator(node.Key, parent.LeftKey()) == 0 && nodeColor(siblingRight) == red {
-		siblingRight.Item.Color = black
-		tree.Save(siblingRight)
-		tree.rotateLeft(parent)
-		// parent.LeftKey(emptyKey)
-	} else if nodeColor(siblingLeft) == red {
-		siblingLeft.Item.Color = black
-		tree.Save(siblingLeft)
-		tree.rotateRight(parent)
-		// parent.RightKey(emptyKey)
+	if node != nil {
+		node.Item.Color = black
+		tree.Save(node)
 	}
-
-	// update the parent meta then delete the current node from db
-	// tree.Save(parent)
-	tree.deleteNode(node, false)
-	// fmt.Println("update ", tree, parent, sibling)
 }
 
 func nodeColor(node *Node) bool {
@@ -805,7 +903,7 @@ func nodeColor(node *Node) bool {
 	return node.Item.Color
 }
 
-func (tree *Tree) deleteNode(node *Node, force bool) {
+func (tree *Tree) deleteNode(node *Node) {
 	// update parent
 	// parent := node.Parent(tree)
 	// fmt.Println("Update parent", parent, "Delete node", node)
@@ -816,7 +914,7 @@ func (tree *Tree) deleteNode(node *Node, force bool) {
 	// }
 	// tree.Save(parent)
 	// if force {
-	tree.db.Delete(node.Key, force)
+	tree.db.Delete(node.Key)
 	// } else {
 	// 	node.Item.Deleted = true
 	// 	tree.Save(node)
@@ -86,3 +86,89 @@ func TestRestoreLevelDBTree(t *testing.T) {
 	// RedBlackTree
 	// └── 3
 }
+
+// checkTreeNode : check colors and subtree statistics, return the black height and size of the subtree
+func checkTreeNode(t *testing.T, tree *RedBlackTreeExtended, key []byte, parentColor bool) (int, uint64) {
+	if tree.IsEmptyKey(key) {
+		return 1, 0
+	}
+	node, _ := tree.GetNode(key)
+	if node == nil {
+		t.Fatalf("node not found :%x", key)
+	}
+	if node.Item.Color == red && parentColor == red {
+		t.Fatalf("red node has red parent :%s", node.String(tree.Tree))
+	}
+	leftHeight, leftSize := checkTreeNode(t, tree, node.LeftKey(), node.Item.Color)
+	rightHeight, rightSize := checkTreeNode(t, tree, node.RightKey(), node.Item.Color)
+	if leftHeight != rightHeight {
+		t.Fatalf("black height incorrect :%s", node.String(tree.Tree))
+	}
+	_, leftVolume := tree.subtreeStats(node.LeftKey())
+	_, rightVolume := tree.subtreeStats(node.RightKey())
+	volume := Add(new(big.Int).SetBytes(node.Value()), Add(leftVolume, rightVolume))
+	if node.Item.Size != leftSize+rightSize+1 || node.Item.Volume.Cmp(volume) != 0 {
+		t.Fatalf("statistics incorrect, got: %d %v, want: %d %v", node.Item.Size, node.Item.Volume,
+			leftSize+rightSize+1, volume)
+	}
+	if node.Item.Color == black {
+		leftHeight++
+	}
+	return leftHeight, node.Item.Size
+}
+
+func TestTreeStatistics(t *testing.T) {
+	db := NewBatchDatabaseWithBackend(NewMemBackend(), 0, 0, EncodeBytesItem, DecodeBytesItem)
+	tree := NewRedBlackTreeExtended(db)
+	// value is the volume itself
+	tree.Weight = func(value []byte) *big.Int {
+		return new(big.Int).SetBytes(value)
+	}
+
+	// insert and remove in a fixed pseudo random order, compare with the sorted keys
+	present := make(map[int64]bool)
+	seed := int64(7)
+	for i := 0; i < 300; i++ {
+		seed = (seed*1103515245 + 12345) % 2147483648
+		// zero is the empty key
+		k := seed%64 + 1
+		if present[k] && seed%3 == 0 {
+			tree.Remove(getBig(big.NewInt(k).String()))
+			delete(present, k)
+		} else {
+			tree.Put(getBig(big.NewInt(k).String()), big.NewInt(k).Bytes())
+			present[k] = true
+		}
+
+		if _, size := checkTreeNode(t, tree, tree.rootKey, black); size != tree.Size() || size != uint64(len(present)) {
+			t.Fatalf("size incorrect at step %d, got: %d, want: %d", i, size, len(present))
+		}
+	}
+
+	var keys []int64
+	for k := int64(1); k <= 64; k++ {
+		if present[k] {
+			keys = append(keys, k)
+		}
+	}
+	volume := Zero()
+	for i, k := range keys {
+		key := getBig(big.NewInt(k).String())
+		if rank := tree.Rank(key, false); rank != uint64(i) {
+			t.Errorf("rank of %d incorrect, got: %d, want: %d", k, rank, i)
+		}
+		if node := tree.Select(uint64(i)); node == nil || new(big.Int).SetBytes(node.Key).Int64() != k {
+			t.Errorf("select %d incorrect, got: %v", i, node)
+		}
+		if before := tree.VolumeBefore(key, false); before.Cmp(volume) != 0 {
+			t.Errorf("volume before %d incorrect, got: %v, want: %v", k, before, volume)
+		}
+		volume = Add(volume, big.NewInt(k))
+	}
+	if tree.TotalVolume().Cmp(volume) != 0 {
+		t.Errorf("total volume incorrect, got: %v, want: %v", tree.TotalVolume(), volume)
+	}
+	if tree.Select(uint64(len(keys))) != nil {
+		t.Error("select out of range must return nil")
+	}
+}
@@ -0,0 +1,77 @@
+package orderbook
+
+import (
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// The engine counts the operations it has applied, orders, amends and cancels. Two engines that applied
+// the same operations have the same sequence and the same state root.
+
+// SequenceKey : key of the sequence of the last applied operation
+var SequenceKey = crypto.Keccak256([]byte("orderbook/sequence"))
+
+// loadSequence : the sequence is 0 for a new database
+func (engine *Engine) loadSequence() uint64 {
+	val, err := engine.db.Get(SequenceKey, new(uint64))
+	if err != nil || val == nil {
+		return 0
+	}
+	return *val.(*uint64)
+}
+
+// Sequence : sequence of the last operation applied by the engine
+func (engine *Engine) Sequence() uint64 {
+	engine.sequenceLock.Lock()
+	defer engine.sequenceLock.Unlock()
+	return engine.sequence
+}
+
+// nextSequence : count an applied operation and journal it with its trades, the sequence is stored with the next commit
+func (engine *Engine) nextSequence(kind, pairName string, quote map[string]string, trades []map[string]string) error {
+	engine.sequenceLock.Lock()
+	defer engine.sequenceLock.Unlock()
+	// operations of a synced pair follow the ones of its journal, the engine is at them when all pairs are synced
+	if _, ok := engine.pairSequences[pairName]; ok {
+		sequence := engine.pairSequence(pairName) + 1
+		engine.pairSequences[pairName] = sequence
+		engine.journal(&JournalEntry{Sequence: sequence, PairName: pairName, Kind: kind, Quote: quote, Trades: trades})
+		return nil
+	}
+	sequence := engine.sequence + 1
+	if err := engine.db.Put(SequenceKey, &sequence); err != nil {
+		return err
+	}
+	engine.sequence = sequence
+	engine.journal(&JournalEntry{Sequence: sequence, PairName: pairName, Kind: kind, Quote: quote, Trades: trades})
+	return nil
+}
+
+// pairSequence : sequence of the last operation on the pair, it is ahead of the engine while
+// other pairs are syncing. Sequence lock must be held
+func (engine *Engine) pairSequence(pairName string) uint64 {
+	if sequence, ok := engine.pairSequences[pairName]; ok && sequence > engine.sequence {
+		return sequence
+	}
+	return engine.sequence
+}
+
+// FinishSync : all pairs are synced, the engine continues from the last sequence of the pairs
+func (engine *Engine) FinishSync() error {
+	engine.sequenceLock.Lock()
+	defer engine.sequenceLock.Unlock()
+	sequence := engine.sequence
+	for _, pairSequence := range engine.pairSequences {
+		if pairSequence > sequence {
+			sequence = pairSequence
+		}
+	}
+	engine.pairSequences = make(map[string]uint64)
+	if sequence == engine.sequence {
+		return nil
+	}
+	if err := engine.db.Put(SequenceKey, &sequence); err != nil {
+		return err
+	}
+	engine.sequence = sequence
+	return nil
+}
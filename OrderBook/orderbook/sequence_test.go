@@ -0,0 +1,37 @@
+package orderbook
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestEngineSequence(t *testing.T) {
+	backend := NewMemBackend()
+	engine := NewEngineWithBackend(backend, map[string]*big.Int{"tomo/weth": ToBigInt("1")})
+	order := map[string]string{
+		"pair_name": "TOMO/WETH", "order_id": "0", "type": Limit, "side": Ask, "quantity": "1", "price": "101",
+		"trade_id": "1",
+	}
+
+	engine.ProcessOrder(order)
+	// rejected operations are not counted
+	if err := engine.CancelOrder(map[string]string{"pair_name": "TOMO/WETH", "order_id": "1", "side": Ask, "price": "x"}); err == nil {
+		t.Error("cancel with wrong price must be rejected")
+	}
+	if sequence := engine.Sequence(); sequence != 1 {
+		t.Errorf("sequence incorrect, got: %d, want: %d.", sequence, 1)
+	}
+	if err := engine.CancelOrder(map[string]string{"pair_name": "TOMO/WETH", "order_id": "1", "side": Ask, "price": "101"}); err != nil {
+		t.Fatal(err)
+	}
+	if sequence := engine.Sequence(); sequence != 2 {
+		t.Errorf("sequence incorrect, got: %d, want: %d.", sequence, 2)
+	}
+
+	// sequence is stored in the database
+	engine.Commit()
+	reloaded := NewEngineWithBackend(backend, map[string]*big.Int{"tomo/weth": ToBigInt("1")})
+	if sequence := reloaded.Sequence(); sequence != 2 {
+		t.Errorf("sequence must be loaded, got: %d, want: %d.", sequence, 2)
+	}
+}
@@ -0,0 +1,187 @@
+package orderbook
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+var errReadOnly = errors.New("Snapshot is read-only")
+
+// snapshotBackend : backend snapshot with the frozen pending items on top, it is read-only
+type snapshotBackend struct {
+	snapshot BackendSnapshot
+	// encoded values of the pending items, nil for deleted keys
+	pending map[string][]byte
+}
+
+func (backend *snapshotBackend) Get(key []byte) ([]byte, error) {
+	if value, ok := backend.pending[string(key)]; ok {
+		if value == nil {
+			return nil, leveldb.ErrNotFound
+		}
+		return common.CopyBytes(value), nil
+	}
+	return backend.snapshot.Get(key)
+}
+
+func (backend *snapshotBackend) Has(key []byte) (bool, error) {
+	if value, ok := backend.pending[string(key)]; ok {
+		return value != nil, nil
+	}
+	return backend.snapshot.Has(key)
+}
+
+func (backend *snapshotBackend) Put(key []byte, value []byte) error {
+	return errReadOnly
+}
+
+func (backend *snapshotBackend) Delete(key []byte) error {
+	return errReadOnly
+}
+
+func (backend *snapshotBackend) NewBatch() BackendBatch {
+	return &readOnlyBatch{}
+}
+
+// Iterate : merge the pending items into the keys of the snapshot, in ascending order
+func (backend *snapshotBackend) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	keys := sortedKeys(backend.pending, prefix)
+	stopped := false
+	// call fn with the pending items lower than the key, all of them if key is nil
+	emitPending := func(key []byte) bool {
+		for len(keys) > 0 && (key == nil || keys[0] < string(key)) {
+			value := backend.pending[keys[0]]
+			pendingKey := keys[0]
+			keys = keys[1:]
+			if value != nil && !fn([]byte(pendingKey), common.CopyBytes(value)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	err := backend.snapshot.Iterate(prefix, func(key, value []byte) bool {
+		if !emitPending(key) {
+			stopped = true
+			return false
+		}
+		if len(keys) > 0 && keys[0] == string(key) {
+			// pending item replaces or deletes the stored one
+			value = backend.pending[keys[0]]
+			keys = keys[1:]
+			if value == nil {
+				return true
+			}
+			value = common.CopyBytes(value)
+		}
+		stopped = !fn(key, value)
+		return !stopped
+	})
+	if err != nil || stopped {
+		return err
+	}
+	emitPending(nil)
+	return nil
+}
+
+func (backend *snapshotBackend) Snapshot() (BackendSnapshot, error) {
+	return nil, errors.New("Can not take snapshot of a snapshot")
+}
+
+// Close : release the underlying snapshot
+func (backend *snapshotBackend) Close() {
+	backend.snapshot.Release()
+}
+
+type readOnlyBatch struct{}
+
+func (b *readOnlyBatch) Put(key []byte, value []byte) {}
+func (b *readOnlyBatch) Delete(key []byte)            {}
+func (b *readOnlyBatch) Len() int                     { return 0 }
+func (b *readOnlyBatch) Write() error                 { return errReadOnly }
+
+// Snapshot : read-only database at this point. Pending items are encoded, so later changes to
+// the shared objects are not seen. It must be closed with Release after use
+func (db *BatchDatabase) Snapshot() (*BatchDatabase, error) {
+	// commit can not happen while the lock is held, so pending items and backend are consistent
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.tx != nil {
+		return nil, errors.New("Can not take snapshot while transaction is in progress")
+	}
+
+	pending := make(map[string][]byte, len(db.pendingItems))
+	for cacheKey, item := range db.pendingItems {
+		key, _ := hex.DecodeString(cacheKey)
+		if item.Deleted {
+			pending[string(key)] = nil
+			continue
+		}
+		value, err := db.EncodeToBytes(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		pending[string(key)] = value
+	}
+
+	snapshot, err := db.db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	backend := &snapshotBackend{snapshot: snapshot, pending: pending}
+	return NewBatchDatabaseWithConfig(backend, db.cacheConfig, db.itemMaxPending, db.EncodeToBytes, db.DecodeBytes), nil
+}
+
+// Release : release the backend of a snapshot
+func (db *BatchDatabase) Release() {
+	if backend, ok := db.db.(*snapshotBackend); ok {
+		backend.Close()
+	}
+}
+
+// OrderBookSnapshot : read-only orderbook at a point between two operations,
+// reading it does not block matching
+type OrderBookSnapshot struct {
+	*OrderBook
+}
+
+// Release : must be called after use
+func (snapshot *OrderBookSnapshot) Release() {
+	snapshot.db.Release()
+}
+
+// Snapshot : take a read-only view of the orderbook of the pair
+func (engine *Engine) Snapshot(pairName string) (*OrderBookSnapshot, error) {
+	ob, err := engine.getAndCreateIfNotExisted(pairName)
+	if ob == nil {
+		return nil, err
+	}
+
+	// writers hold the exclusive lock during a whole operation, so no fill is half applied here
+	ob.lock.RLock()
+	db, err := ob.db.Snapshot()
+	name, clock := ob.Item.Name, ob.clock
+	ob.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	view := NewOrderBook(name, db)
+	view.SetClock(clock)
+	// orderbook is not stored yet when it has no order
+	view.Restore()
+	return &OrderBookSnapshot{OrderBook: view}, nil
+}
+
+// ReadSnapshot : call fn with a snapshot of the orderbook, for API queries
+func (engine *Engine) ReadSnapshot(pairName string, fn func(ob *OrderBook) error) error {
+	snapshot, err := engine.Snapshot(pairName)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+	return fn(snapshot.OrderBook)
+}
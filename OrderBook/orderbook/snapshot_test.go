@@ -0,0 +1,73 @@
+package orderbook
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestSnapshotBackendIterate(t *testing.T) {
+	backend := NewMemBackend()
+	backend.Put([]byte("a"), []byte("1"))
+	backend.Put([]byte("c"), []byte("3"))
+	backend.Put([]byte("e"), []byte("5"))
+	snapshot, _ := backend.Snapshot()
+	view := &snapshotBackend{snapshot: snapshot, pending: map[string][]byte{
+		"b": []byte("2"), "c": []byte("33"), "e": nil, "f": []byte("6"),
+	}}
+
+	var got string
+	view.Iterate(nil, func(key, value []byte) bool {
+		got += string(key) + "=" + string(value) + " "
+		return true
+	})
+	if got != "a=1 b=2 c=33 f=6 " {
+		t.Errorf("iterate incorrect, got: %s", got)
+	}
+	if ok, _ := view.Has([]byte("e")); ok {
+		t.Error("deleted pending item must not be found")
+	}
+	if err := view.Put([]byte("g"), nil); err != errReadOnly {
+		t.Errorf("snapshot must be read-only, got: %v", err)
+	}
+}
+
+func TestOrderBookSnapshot(t *testing.T) {
+	engine := NewEngineWithBackend(NewMemBackend(), map[string]*big.Int{"snap/test": ToBigInt("1")})
+	engine.SetClock(FixedClock(1))
+	ob, _ := engine.GetOrderBook("SNAP/TEST")
+	ob.ProcessOrder(map[string]string{"type": Limit, "side": Ask, "quantity": "5", "price": "101", "trade_id": "1"}, false)
+	engine.Commit()
+	ob.ProcessOrder(map[string]string{"type": Limit, "side": Ask, "quantity": "3", "price": "103", "trade_id": "2"}, false)
+	root := ob.StateRoot()
+
+	// the second order is still pending
+	snapshot, err := engine.Snapshot("SNAP/TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	// fill the best level in place and commit, the snapshot must not change
+	ob.ProcessOrder(map[string]string{"type": Limit, "side": Bid, "quantity": "6", "price": "103", "trade_id": "3"}, false)
+	engine.Commit()
+
+	if volume := snapshot.VolumeAtPrice(Ask, ToBigInt("101")); volume.Cmp(ToBigInt("5")) != 0 {
+		t.Errorf("snapshot volume incorrect, got: %v, want: 5", volume)
+	}
+	if volume := snapshot.VolumeAtPrice(Ask, ToBigInt("103")); volume.Cmp(ToBigInt("3")) != 0 {
+		t.Errorf("snapshot volume incorrect, got: %v, want: 3", volume)
+	}
+	if snapshot.StateRoot() != root {
+		t.Errorf("snapshot state root incorrect, got: %x, want: %x", snapshot.StateRoot(), root)
+	}
+	if ob.VolumeAtPrice(Ask, ToBigInt("101")).Sign() != 0 {
+		t.Error("orderbook must be updated")
+	}
+
+	engine.ReadSnapshot("SNAP/TEST", func(latest *OrderBook) error {
+		if latest.StateRoot() != ob.StateRoot() {
+			t.Errorf("new snapshot must see the latest state, got: %x, want: %x", latest.StateRoot(), ob.StateRoot())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,266 @@
+package orderbook
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// State root of an orderbook, so that peers can check their books agree:
+//   order leaf = keccak(0x00 . orderID . price . quantity . timestamp . tradeID)
+//   level leaf = keccak(0x00 . side . price . volume . length . merkle root of orders from head to tail)
+//   side root  = merkle root of level leaves, ordered by price
+//   book root  = keccak(0x01 . bids root . asks root)
+// Nodes of merkle trees are keccak(0x01 . left . right). The merkle tree of level leaves is cached by the
+// order tree, a saved level only hashes its path again, an added or removed level the nodes on its right
+
+// OrderProof : proof that an order exists at a price level of the book with the given root
+type OrderProof struct {
+	PairName  string   `json:"pairName"`
+	Side      string   `json:"side"`
+	OrderID   *big.Int `json:"orderID"`
+	Price     *big.Int `json:"price"`
+	Quantity  *big.Int `json:"quantity"`
+	Timestamp uint64   `json:"timestamp"`
+	TradeID   string   `json:"tradeID"`
+
+	// price level information
+	Volume *big.Int `json:"volume"`
+	Length uint64   `json:"length"`
+
+	OrderProof []MerkleProofNode `json:"orderProof"`
+	LevelProof []MerkleProofNode `json:"levelProof"`
+	BidsRoot   common.Hash       `json:"bidsRoot"`
+	AsksRoot   common.Hash       `json:"asksRoot"`
+	Root       common.Hash       `json:"root"`
+}
+
+func orderLeaf(orderKey []byte, item *OrderItem) common.Hash {
+	timestamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(timestamp, item.Timestamp)
+	return hashLeaf(common.BytesToHash(orderKey).Bytes(), common.BigToHash(item.Price).Bytes(),
+		common.BigToHash(item.Quantity).Bytes(), timestamp, []byte(item.TradeID))
+}
+
+func levelLeaf(side string, item *OrderListItem, ordersRoot common.Hash) common.Hash {
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, item.Length)
+	return hashLeaf([]byte(side), common.BigToHash(item.Price).Bytes(),
+		common.BigToHash(item.Volume).Bytes(), length, ordersRoot.Bytes())
+}
+
+// Verify : check the proof is consistent from the order up to the root
+func (proof *OrderProof) Verify() bool {
+	item := &OrderItem{
+		Price:     proof.Price,
+		Quantity:  proof.Quantity,
+		Timestamp: proof.Timestamp,
+		TradeID:   proof.TradeID,
+	}
+	ordersRoot := ComputeMerkleRoot(orderLeaf(GetKeyFromBig(proof.OrderID), item), proof.OrderProof)
+	levelItem := &OrderListItem{
+		Price:  proof.Price,
+		Volume: proof.Volume,
+		Length: proof.Length,
+	}
+	sideRoot := ComputeMerkleRoot(levelLeaf(proof.Side, levelItem, ordersRoot), proof.LevelProof)
+	if proof.Side == Bid && sideRoot != proof.BidsRoot {
+		return false
+	}
+	if proof.Side == Ask && sideRoot != proof.AsksRoot {
+		return false
+	}
+	return hashPair(proof.BidsRoot, proof.AsksRoot) == proof.Root
+}
+
+// orderLeaves : leaves of orders from head to tail, also return the orders
+func (orderList *OrderList) orderLeaves() ([]*Order, []common.Hash) {
+	orders := make([]*Order, 0, orderList.Item.Length)
+	leaves := make([]common.Hash, 0, orderList.Item.Length)
+	// length is used to guard against broken links
+	order := orderList.Head()
+	for order != nil && uint64(len(orders)) < orderList.Item.Length {
+		orders = append(orders, order)
+		leaves = append(leaves, orderLeaf(order.Key, order.Item))
+		order = orderList.GetOrder(order.Item.NextOrder)
+	}
+	return orders, leaves
+}
+
+// invalidate the cached state of a price level
+func (orderTree *OrderTree) markDirty(key []byte) {
+	orderTree.dirtyLevels[string(key)] = true
+}
+
+// stateClean : the cached states are up to date
+func (orderTree *OrderTree) stateClean() bool {
+	return orderTree.stateValid && len(orderTree.dirtyLevels) == 0
+}
+
+// reset all cached states, used when the tree is reloaded from database
+func (orderTree *OrderTree) resetStateCache() {
+	orderTree.dirtyLevels = make(map[string]bool)
+	orderTree.stateValid = false
+}
+
+// levelLeafOf : leaf of the price level, false if the price level does not exist
+func (orderTree *OrderTree) levelLeafOf(side string, key []byte) (common.Hash, bool) {
+	value, found := orderTree.PriceTree.Get(key)
+	if !found {
+		return common.Hash{}, false
+	}
+	orderList := orderTree.decodeOrderList(value)
+	_, orderLeaves := orderList.orderLeaves()
+	return levelLeaf(side, orderList.Item, MerkleRoot(orderLeaves)), true
+}
+
+// levelIndex : index of the price level in the leaves, or where it would be inserted
+func (orderTree *OrderTree) levelIndex(key []byte) (int, bool) {
+	index := sort.Search(len(orderTree.levelKeys), func(i int) bool {
+		return bytes.Compare(orderTree.levelKeys[i], key) >= 0
+	})
+	return index, index < len(orderTree.levelKeys) && bytes.Equal(orderTree.levelKeys[index], key)
+}
+
+// updateLevels : hash the changed price levels again. Saved levels only hash their path, added or removed
+// levels move the leaves on their right, so the nodes on the right are hashed again
+func (orderTree *OrderTree) updateLevels(side string) {
+	if !orderTree.stateValid {
+		var keys [][]byte
+		var leaves []common.Hash
+		it := orderTree.PriceTree.Iterator()
+		for it.Next() {
+			orderList := orderTree.decodeOrderList(it.Value())
+			_, orderLeaves := orderList.orderLeaves()
+			keys = append(keys, it.Key())
+			leaves = append(leaves, levelLeaf(side, orderList.Item, MerkleRoot(orderLeaves)))
+		}
+		orderTree.levelKeys = keys
+		orderTree.levelTree.Update(leaves, 0)
+		orderTree.dirtyLevels = make(map[string]bool)
+		orderTree.stateValid = true
+		return
+	}
+	if len(orderTree.dirtyLevels) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(orderTree.dirtyLevels))
+	for key := range orderTree.dirtyLevels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	orderTree.dirtyLevels = make(map[string]bool)
+
+	leaves := orderTree.levelTree.Leaves()
+	from := -1
+	for _, key := range keys {
+		leaf, found := orderTree.levelLeafOf(side, []byte(key))
+		index, exists := orderTree.levelIndex([]byte(key))
+		switch {
+		case found && exists:
+			if from < 0 {
+				// no level moved yet, the tree is up to date but this path
+				orderTree.levelTree.Set(index, leaf)
+				leaves = orderTree.levelTree.Leaves()
+			} else {
+				leaves[index] = leaf
+			}
+			continue
+		case found:
+			orderTree.levelKeys = append(orderTree.levelKeys, nil)
+			copy(orderTree.levelKeys[index+1:], orderTree.levelKeys[index:])
+			orderTree.levelKeys[index] = []byte(key)
+			leaves = append(leaves[:index:index], append([]common.Hash{leaf}, leaves[index:]...)...)
+		case exists:
+			orderTree.levelKeys = append(orderTree.levelKeys[:index], orderTree.levelKeys[index+1:]...)
+			leaves = append(leaves[:index:index], leaves[index+1:]...)
+		default:
+			// level added and removed again
+			continue
+		}
+		if from < 0 || index < from {
+			from = index
+		}
+	}
+	if from >= 0 {
+		orderTree.levelTree.Update(leaves, from)
+	}
+}
+
+func (orderTree *OrderTree) stateRoot(side string) common.Hash {
+	orderTree.updateLevels(side)
+	return orderTree.levelTree.Root()
+}
+
+// StateRoot : root hash of the whole orderbook
+func (orderBook *OrderBook) StateRoot() common.Hash {
+	return hashPair(orderBook.Bids.stateRoot(Bid), orderBook.Asks.stateRoot(Ask))
+}
+
+// cachedStateRoot : root hash when no price level changed since it was computed, it does not update
+// the cached states so the shared lock is enough, false if the root must be computed with StateRoot
+func (orderBook *OrderBook) cachedStateRoot() (common.Hash, bool) {
+	if !orderBook.Bids.stateClean() || !orderBook.Asks.stateClean() {
+		return common.Hash{}, false
+	}
+	return hashPair(orderBook.Bids.levelTree.Root(), orderBook.Asks.levelTree.Root()), true
+}
+
+// GetOrderProof : build the merkle proof that the order exists in its price level
+func (orderBook *OrderBook) GetOrderProof(key []byte) (*OrderProof, error) {
+	order := orderBook.GetOrder(key)
+	if order == nil {
+		return nil, fmt.Errorf("Order not found :%x", key)
+	}
+
+	side, orderTree := Bid, orderBook.Bids
+	// order keeps the key of its order list, which is different for each side
+	if !bytes.Equal(orderBook.Bids.getKeyFromPrice(order.Item.Price), order.Item.OrderList) {
+		side, orderTree = Ask, orderBook.Asks
+	}
+	orderList := orderTree.PriceList(order.Item.Price)
+	if orderList == nil {
+		return nil, fmt.Errorf("Price level not found :%s", order.Item.Price)
+	}
+
+	orders, orderLeaves := orderList.orderLeaves()
+	orderIndex := -1
+	for i, item := range orders {
+		if bytes.Equal(item.Key, order.Key) {
+			orderIndex = i
+			break
+		}
+	}
+	if orderIndex < 0 {
+		return nil, fmt.Errorf("Order is not linked in price level :%x", key)
+	}
+
+	orderTree.updateLevels(side)
+	levelIndex, found := orderTree.levelIndex(orderList.Key)
+	if !found {
+		return nil, fmt.Errorf("Price level is not in the tree :%s", order.Item.Price)
+	}
+
+	proof := &OrderProof{
+		PairName:   orderBook.Item.Name,
+		Side:       side,
+		OrderID:    new(big.Int).SetBytes(order.Key),
+		Price:      CloneBigInt(order.Item.Price),
+		Quantity:   CloneBigInt(order.Item.Quantity),
+		Timestamp:  order.Item.Timestamp,
+		TradeID:    order.Item.TradeID,
+		Volume:     CloneBigInt(orderList.Item.Volume),
+		Length:     orderList.Item.Length,
+		OrderProof: MerkleProof(orderLeaves, orderIndex),
+		LevelProof: orderTree.levelTree.Proof(levelIndex),
+		BidsRoot:   orderBook.Bids.stateRoot(Bid),
+		AsksRoot:   orderBook.Asks.stateRoot(Ask),
+	}
+	proof.Root = hashPair(proof.BidsRoot, proof.AsksRoot)
+	return proof, nil
+}
@@ -0,0 +1,74 @@
+package orderbook
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newStateRootTestOrderBook(prefix string) *OrderBook {
+	// the test database is kept between runs, so use a fresh pair
+	orderBook := NewOrderBook(fmt.Sprintf("%s/%d", prefix, time.Now().UnixNano()), testDB)
+	orderBook.SetClock(FixedClock(1))
+	orders := []map[string]string{
+		{"type": Limit, "side": Ask, "quantity": "5", "price": "101", "trade_id": "1", "timestamp": "1"},
+		{"type": Limit, "side": Ask, "quantity": "7", "price": "101", "trade_id": "2", "timestamp": "2"},
+		{"type": Limit, "side": Ask, "quantity": "3", "price": "105", "trade_id": "3", "timestamp": "3"},
+		{"type": Limit, "side": Bid, "quantity": "4", "price": "99", "trade_id": "4", "timestamp": "4"},
+		{"type": Limit, "side": Bid, "quantity": "2", "price": "98", "trade_id": "5", "timestamp": "5"},
+	}
+	for _, order := range orders {
+		orderBook.ProcessOrder(order, false)
+	}
+	return orderBook
+}
+
+func TestOrderBookStateRoot(t *testing.T) {
+	orderBook := newStateRootTestOrderBook("ROOT1")
+	otherBook := newStateRootTestOrderBook("ROOT2")
+
+	root := orderBook.StateRoot()
+	if root != otherBook.StateRoot() {
+		t.Errorf("State root must be the same for the same operations, got: %x, want: %x", otherBook.StateRoot(), root)
+	}
+
+	// partial fill changes the root
+	orderBook.ProcessOrder(map[string]string{"type": Limit, "side": Bid, "quantity": "1", "price": "101", "trade_id": "6", "timestamp": "6"}, false)
+	if orderBook.StateRoot() == root {
+		t.Errorf("State root must change after matching")
+	}
+	otherBook.ProcessOrder(map[string]string{"type": Limit, "side": Bid, "quantity": "1", "price": "101", "trade_id": "6", "timestamp": "6"}, false)
+	if orderBook.StateRoot() != otherBook.StateRoot() {
+		t.Errorf("State root must be the same after matching, got: %x, want: %x", otherBook.StateRoot(), orderBook.StateRoot())
+	}
+
+	// cached nodes must give the root of the tree built again
+	root = orderBook.StateRoot()
+	orderBook.Bids.resetStateCache()
+	orderBook.Asks.resetStateCache()
+	if orderBook.StateRoot() != root {
+		t.Errorf("State root of cached nodes incorrect, got: %x, want: %x", root, orderBook.StateRoot())
+	}
+
+	// order 2 is the second order at price 101
+	proof, err := orderBook.GetOrderProof(GetKeyFromUint64(2))
+	if err != nil {
+		t.Fatalf("GetOrderProof failed :%v", err)
+	}
+	if proof.Side != Ask || proof.Root != orderBook.StateRoot() || !proof.Verify() {
+		t.Errorf("Order proof incorrect :%s", ToJSON(proof))
+	}
+
+	proof.Quantity = ToBigInt("1000")
+	if proof.Verify() {
+		t.Errorf("Order proof must fail with wrong quantity")
+	}
+
+	proof, err = orderBook.GetOrderProof(GetKeyFromUint64(5))
+	if err != nil {
+		t.Fatalf("GetOrderProof failed :%v", err)
+	}
+	if proof.Side != Bid || !proof.Verify() {
+		t.Errorf("Order proof incorrect :%s", ToJSON(proof))
+	}
+}
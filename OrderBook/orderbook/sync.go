@@ -0,0 +1,267 @@
+package orderbook
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	demo "github.com/tomochain/orderbook/common"
+)
+
+// A node that joins late imports the book of each pair from a peer, then applies the operations the peer
+// journaled after the sequence of the book, until it has the same state root as the peer.
+
+// journal kinds, the quote of the operation is applied again with the engine method of the kind
+const (
+	JournalOrder      = "order"
+	JournalCancel     = "cancel"
+	JournalMassCancel = "mass_cancel"
+)
+
+// journalLimit : operations kept in memory, a peer that is further behind must import the book again
+const journalLimit = 4096
+
+// JournalEntry : operation applied by the engine at the sequence, pair name is empty for a mass cancel
+// of all pairs. Quote is the one received, before it is changed by matching. Trades are the ones of an order,
+// a peer that applies the entry makes them again
+type JournalEntry struct {
+	Sequence uint64
+	PairName string
+	Kind     string
+	Quote    map[string]string
+	Trades   []map[string]string
+}
+
+// SnapshotOrder : resting order of a book snapshot
+type SnapshotOrder struct {
+	OrderID   uint64
+	Side      string
+	Price     *big.Int
+	Quantity  *big.Int
+	Timestamp uint64
+	TradeID   string
+	Owner     common.Address
+	Nonce     uint64
+}
+
+// BookSnapshot : the book of a pair after the operation at the sequence. Orders are the bids then the asks,
+// by ascending price and from head to tail in each price level, so the book built from them has the same root
+type BookSnapshot struct {
+	PairName    string
+	Sequence    uint64
+	Timestamp   uint64
+	NextOrderID uint64
+	Root        common.Hash
+	Orders      []*SnapshotOrder
+}
+
+func copyQuote(quote map[string]string) map[string]string {
+	copied := make(map[string]string, len(quote))
+	for key, value := range quote {
+		copied[key] = value
+	}
+	return copied
+}
+
+// journal : record the operation, the oldest ones are dropped
+func (engine *Engine) journal(entry *JournalEntry) {
+	engine.journalEntries = append(engine.journalEntries, entry)
+	if len(engine.journalEntries) > journalLimit {
+		dropped := len(engine.journalEntries) - journalLimit
+		for _, entry := range engine.journalEntries[:dropped] {
+			if entry.Sequence > engine.journalPruned {
+				engine.journalPruned = entry.Sequence
+			}
+		}
+		engine.journalEntries = append([]*JournalEntry(nil), engine.journalEntries[dropped:]...)
+	}
+}
+
+// Journal : operations on the pair after the sequence and the root of the pair after them, an error is
+// returned when some of them are not in the journal anymore
+func (engine *Engine) Journal(pairName string, sequence uint64) ([]*JournalEntry, common.Hash, error) {
+	name := strings.ToLower(pairName)
+	var entries []*JournalEntry
+	var root common.Hash
+	// operations on the pair are journaled with its lock held
+	err := engine.WithOrderBook(name, func(ob *OrderBook) error {
+		engine.sequenceLock.Lock()
+		defer engine.sequenceLock.Unlock()
+		if sequence < engine.pairSequence(name) && (sequence < engine.journalPruned || sequence < engine.journalFrom[name]) {
+			return fmt.Errorf("Journal of %s after sequence %d is pruned", name, sequence)
+		}
+		for _, entry := range engine.journalEntries {
+			if entry.Sequence > sequence && (entry.PairName == name || entry.PairName == "") {
+				entries = append(entries, entry)
+			}
+		}
+		root = ob.StateRoot()
+		return nil
+	})
+	return entries, root, err
+}
+
+// ApplyJournal : apply the operation of a peer on the pair, an operation on all pairs only changes this pair.
+// The operation is journaled with its sequence, the engine is at it when all pairs are synced, see FinishSync.
+// Nonces are raised and not checked, the operations are applied in the order of the peer
+func (engine *Engine) ApplyJournal(pairName string, entry *JournalEntry) error {
+	name := strings.ToLower(pairName)
+	if entry.PairName != "" && entry.PairName != name {
+		return fmt.Errorf("Journal entry %d is an operation on %s, not on %s", entry.Sequence, entry.PairName, name)
+	}
+	return engine.WithOrderBook(name, func(ob *OrderBook) error {
+		engine.sequenceLock.Lock()
+		last := engine.pairSequence(name)
+		engine.sequenceLock.Unlock()
+		if entry.Sequence <= last {
+			return fmt.Errorf("Journal entry %d of %s is applied already, pair is at %d", entry.Sequence, name, last)
+		}
+
+		quote := copyQuote(entry.Quote)
+		quote["pair_name"] = name
+		var trades []map[string]string
+		var err error
+		switch entry.Kind {
+		case JournalOrder:
+			trades, _, err = engine.processQuote(ob, quote, true)
+		case JournalCancel:
+			err = engine.cancelOrder(ob, quote, true)
+		case JournalMassCancel:
+			_, err = engine.cancelOwnerOrders(ob, quote, true)
+		default:
+			err = fmt.Errorf("Unknown journal kind :%s", entry.Kind)
+		}
+		if err != nil {
+			return err
+		}
+
+		engine.sequenceLock.Lock()
+		defer engine.sequenceLock.Unlock()
+		engine.pairSequences[name] = entry.Sequence
+		engine.journal(&JournalEntry{Sequence: entry.Sequence, PairName: name, Kind: entry.Kind,
+			Quote: copyQuote(entry.Quote), Trades: trades})
+		return nil
+	})
+}
+
+// PairRoot : state root of the book of the pair
+func (engine *Engine) PairRoot(pairName string) (root common.Hash, err error) {
+	err = engine.WithOrderBook(pairName, func(ob *OrderBook) error {
+		root = ob.StateRoot()
+		return nil
+	})
+	return root, err
+}
+
+// ExportBook : snapshot of the book of the pair, operations after it are in the journal
+func (engine *Engine) ExportBook(pairName string) (*BookSnapshot, error) {
+	var snapshot *BookSnapshot
+	err := engine.WithOrderBook(pairName, func(ob *OrderBook) error {
+		// operations on the pair take the sequence with its lock held
+		engine.sequenceLock.Lock()
+		sequence := engine.pairSequence(ob.Item.Name)
+		engine.sequenceLock.Unlock()
+		snapshot = &BookSnapshot{
+			PairName:    ob.Item.Name,
+			Sequence:    sequence,
+			Timestamp:   ob.Item.Timestamp,
+			NextOrderID: ob.Item.NextOrderID,
+			Root:        ob.StateRoot(),
+		}
+		for _, side := range []string{Bid, Ask} {
+			orderTree := ob.Bids
+			if side == Ask {
+				orderTree = ob.Asks
+			}
+			orderTree.IteratePriceLists(nil, nil, false, func(orderList *OrderList) bool {
+				orders, _ := orderList.orderLeaves()
+				for _, order := range orders {
+					snapshot.Orders = append(snapshot.Orders, &SnapshotOrder{
+						OrderID:   new(big.Int).SetBytes(order.Key).Uint64(),
+						Side:      side,
+						Price:     CloneBigInt(order.Item.Price),
+						Quantity:  CloneBigInt(order.Item.Quantity),
+						Timestamp: order.Item.Timestamp,
+						TradeID:   order.Item.TradeID,
+						Owner:     order.Item.Owner,
+						Nonce:     order.Item.Nonce,
+					})
+				}
+				return true
+			})
+		}
+		return nil
+	})
+	return snapshot, err
+}
+
+// ImportBook : replace the book of the pair with the snapshot, it is rolled back if the root is not the one
+// of the snapshot. Nonces of the owners are raised to the ones of their orders. The operations journaled
+// on the pair before are dropped, and the pair is at the sequence of the snapshot until all pairs are synced
+func (engine *Engine) ImportBook(snapshot *BookSnapshot) error {
+	name := strings.ToLower(snapshot.PairName)
+	return engine.WithOrderBook(name, func(ob *OrderBook) error {
+		if ob.status == PairDelisted {
+			return fmt.Errorf("Pair is delisted :%s", ob.Item.Name)
+		}
+		if err := ob.Import(snapshot); err != nil {
+			return err
+		}
+		for _, order := range snapshot.Orders {
+			if err := engine.raiseNonce(order.Owner, order.Nonce); err != nil {
+				return err
+			}
+		}
+
+		engine.sequenceLock.Lock()
+		defer engine.sequenceLock.Unlock()
+		// operations of the other pairs are kept
+		entries := engine.journalEntries[:0:0]
+		for _, entry := range engine.journalEntries {
+			if entry.PairName != name {
+				entries = append(entries, entry)
+			}
+		}
+		engine.journalEntries = entries
+		engine.journalFrom[name] = snapshot.Sequence
+		engine.pairSequences[name] = snapshot.Sequence
+		demo.LogInfo("Imported book", "pair", name, "sequence", snapshot.Sequence,
+			"orders", len(snapshot.Orders), "root", snapshot.Root.Hex())
+		return nil
+	})
+}
+
+// Import : replace all orders with the ones of the snapshot in one operation
+func (orderBook *OrderBook) Import(snapshot *BookSnapshot) error {
+	return orderBook.atomic(func() error {
+		if _, err := orderBook.removeAllOrders(); err != nil {
+			return err
+		}
+		for _, order := range snapshot.Orders {
+			orderTree := orderBook.Bids
+			if order.Side == Ask {
+				orderTree = orderBook.Asks
+			}
+			quote := map[string]string{
+				"order_id":  strconv.FormatUint(order.OrderID, 10),
+				"price":     order.Price.String(),
+				"quantity":  order.Quantity.String(),
+				"timestamp": strconv.FormatUint(order.Timestamp, 10),
+				"trade_id":  order.TradeID,
+				"owner":     order.Owner.Hex(),
+				"nonce":     strconv.FormatUint(order.Nonce, 10),
+			}
+			if err := orderTree.InsertOrder(quote); err != nil {
+				return err
+			}
+		}
+		orderBook.Item.Timestamp = snapshot.Timestamp
+		orderBook.Item.NextOrderID = snapshot.NextOrderID
+		if root := orderBook.StateRoot(); root != snapshot.Root {
+			return fmt.Errorf("State root of %s is %s, snapshot root is %s", orderBook.Item.Name, root.Hex(), snapshot.Root.Hex())
+		}
+		return orderBook.Save()
+	})
+}
@@ -0,0 +1,118 @@
+package orderbook
+
+import (
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestEngineSyncBook(t *testing.T) {
+	newEngine := func() *Engine {
+		return NewEngineWithBackend(NewMemBackend(), map[string]*big.Int{"tomo/weth": ToBigInt("1"), "tomo/usdt": ToBigInt("1")})
+	}
+	alice, bob := common.HexToAddress("0x0a"), common.HexToAddress("0x0b")
+	order := func(owner common.Address, nonce uint64, side, price, quantity string) map[string]string {
+		return map[string]string{
+			"pair_name": "TOMO/WETH", "order_id": "0", "type": Limit, "side": side, "quantity": quantity, "price": price,
+			"trade_id": strconv.FormatUint(nonce, 10), "owner": owner.Hex(), "nonce": strconv.FormatUint(nonce, 10),
+			"timestamp": strconv.FormatUint(nonce, 10),
+		}
+	}
+
+	source := newEngine()
+	source.ProcessOrder(order(alice, 1, Ask, "101", "5"))
+	source.ProcessOrder(order(alice, 2, Ask, "101", "3"))
+	source.ProcessOrder(order(alice, 3, Ask, "103", "2"))
+	source.ProcessOrder(order(bob, 4, Bid, "99", "4"))
+	source.ProcessOrder(order(bob, 5, Bid, "98", "1"))
+	// fully matches the first ask
+	source.ProcessOrder(order(bob, 6, Bid, "101", "5"))
+	source.CancelOrder(map[string]string{"pair_name": "TOMO/WETH", "order_id": "5", "side": Bid, "price": "98",
+		"owner": bob.Hex(), "nonce": "7", "timestamp": "7"})
+
+	snapshot, err := source.ExportBook("TOMO/WETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Sequence != 7 || len(snapshot.Orders) != 3 || snapshot.NextOrderID != 6 {
+		t.Fatalf("snapshot incorrect, got: sequence %d, %d orders, next order id %d",
+			snapshot.Sequence, len(snapshot.Orders), snapshot.NextOrderID)
+	}
+
+	// tampered snapshot is rolled back
+	target := newEngine()
+	target.ProcessOrder(order(alice, 1, Bid, "90", "1"))
+	// operations on another pair are kept when the book is imported
+	target.ProcessOrder(map[string]string{"pair_name": "TOMO/USDT", "order_id": "0", "type": Limit, "side": Bid,
+		"quantity": "1", "price": "90", "trade_id": "1"})
+	tampered := *snapshot
+	tampered.Orders = append([]*SnapshotOrder{}, snapshot.Orders[1:]...)
+	if err := target.ImportBook(&tampered); err == nil {
+		t.Fatal("snapshot with another root must be rejected")
+	}
+	if order := target.GetOrder("TOMO/WETH", "1"); order == nil {
+		t.Fatal("book must be rolled back")
+	}
+
+	if err := target.ImportBook(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	pairRoots := func() (common.Hash, common.Hash) {
+		targetRoot, _ := target.PairRoot("TOMO/WETH")
+		sourceRoot, _ := source.PairRoot("TOMO/WETH")
+		return targetRoot, sourceRoot
+	}
+	if targetRoot, sourceRoot := pairRoots(); targetRoot != sourceRoot {
+		t.Fatalf("imported book incorrect, got: %s, want: %s", targetRoot.Hex(), sourceRoot.Hex())
+	}
+	// the engine is at the sequence of the pair when all pairs are synced
+	if target.Sequence() != 2 {
+		t.Errorf("sequence must not change before the sync is done, got: %d", target.Sequence())
+	}
+	if entries, _, err := target.Journal("TOMO/USDT", 0); err != nil || len(entries) != 1 {
+		t.Errorf("journal of another pair must be kept, got: %d, %v", len(entries), err)
+	}
+	// nonces of the imported orders are used
+	if nonce := target.GetNonce(bob); nonce != 4 {
+		t.Errorf("nonce incorrect, got: %d, want: %d.", nonce, 4)
+	}
+
+	// operations after the snapshot are applied from the journal
+	source.ProcessOrder(order(bob, 8, Bid, "103", "4"))
+	source.CancelOrdersBelowNonce(map[string]string{"pair_name": "TOMO/WETH", "owner": bob.Hex(), "nonce": "9", "timestamp": "9"})
+	source.ProcessOrder(order(alice, 10, Ask, "105", "1"))
+	entries, root, err := source.Journal("TOMO/WETH", snapshot.Sequence)
+	if sourceRoot, _ := source.PairRoot("TOMO/WETH"); err != nil || len(entries) != 3 || root != sourceRoot {
+		t.Fatalf("journal incorrect, got: %d, %v", len(entries), err)
+	}
+	if len(entries[0].Trades) == 0 || entries[0].Trades[0]["price"] != "101" {
+		t.Errorf("trades of the order must be journaled, got: %v", entries[0].Trades)
+	}
+	for _, entry := range entries {
+		if err := target.ApplyJournal("TOMO/WETH", entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := target.FinishSync(); err != nil {
+		t.Fatal(err)
+	}
+	if targetRoot, sourceRoot := pairRoots(); targetRoot != sourceRoot || target.Sequence() != source.Sequence() {
+		t.Errorf("synced book incorrect, got: %s at %d, want: %s at %d",
+			targetRoot.Hex(), target.Sequence(), sourceRoot.Hex(), source.Sequence())
+	}
+	if err := target.ApplyJournal("TOMO/WETH", entries[0]); err == nil {
+		t.Error("applied operation must be rejected")
+	}
+	if err := target.ApplyJournal("TOMO/USDT", entries[2]); err == nil {
+		t.Error("operation on another pair must be rejected")
+	}
+	if entries, _, err := target.Journal("TOMO/WETH", source.Sequence()); err != nil || len(entries) != 0 {
+		t.Errorf("journal must be empty at the head, got: %d, %v", len(entries), err)
+	}
+	// journal of a new engine does not have the operations before
+	if _, _, err := target.Journal("TOMO/WETH", 1); err == nil {
+		t.Error("pruned journal must be rejected")
+	}
+}
@@ -0,0 +1,310 @@
+package orderbook
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// VerifyIssue : an inconsistency found in the storage, with the key of the broken item
+type VerifyIssue struct {
+	PairName string `json:"pairName"`
+	Side     string `json:"side"`
+	Key      []byte `json:"key"`
+	Message  string `json:"message"`
+	Repaired bool   `json:"repaired"`
+}
+
+func (issue *VerifyIssue) String() string {
+	str := fmt.Sprintf("%s %s %x : %s", issue.PairName, issue.Side, issue.Key, issue.Message)
+	if issue.Repaired {
+		str += " (repaired)"
+	}
+	return str
+}
+
+// VerifyReport : result of checking the persisted orderbooks
+type VerifyReport struct {
+	Books  int            `json:"books"`
+	Levels uint64         `json:"levels"`
+	Orders uint64         `json:"orders"`
+	Issues []*VerifyIssue `json:"issues"`
+}
+
+// OK : no inconsistency is found, or all of them were repaired
+func (report *VerifyReport) OK() bool {
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+func (report *VerifyReport) String() string {
+	str := fmt.Sprintf("Books: %d, Levels: %d, Orders: %d, Issues: %d\n", report.Books, report.Levels,
+		report.Orders, len(report.Issues))
+	for _, issue := range report.Issues {
+		str += issue.String() + "\n"
+	}
+	return str
+}
+
+// verifier keeps the state while walking one side of an orderbook
+type verifier struct {
+	report    *VerifyReport
+	orderTree *OrderTree
+	pairName  string
+	side      string
+	repair    bool
+	visited   map[string]bool
+	levels    uint64
+	orders    uint64
+	volume    *big.Int
+}
+
+func (v *verifier) addIssue(key []byte, repaired bool, format string, args ...interface{}) {
+	v.report.Issues = append(v.report.Issues, &VerifyIssue{
+		PairName: v.pairName,
+		Side:     v.side,
+		Key:      common.CopyBytes(key),
+		Message:  fmt.Sprintf(format, args...),
+		Repaired: repaired,
+	})
+}
+
+// sameKey : both keys are empty, or they are equal
+func (v *verifier) sameKey(a, b []byte) bool {
+	if v.orderTree.orderDB.IsEmptyKey(a) || v.orderTree.orderDB.IsEmptyKey(b) {
+		return v.orderTree.orderDB.IsEmptyKey(a) && v.orderTree.orderDB.IsEmptyKey(b)
+	}
+	return bytes.Equal(a, b)
+}
+
+// Verify : check every orderbook that is not delisted, and rebuild the aggregate fields from the orders when repair is set.
+// The price tree structure itself is only reported, because it can not be rebuilt safely
+func (engine *Engine) Verify(repair bool) *VerifyReport {
+	report := &VerifyReport{}
+	for _, name := range engine.pairNames() {
+		err := engine.WithOrderBook(name, func(ob *OrderBook) error {
+			ob.Verify(report, repair)
+			return nil
+		})
+		if err != nil {
+			report.Issues = append(report.Issues, &VerifyIssue{PairName: name, Message: fmt.Sprintf("Can not load orderbook :%v", err)})
+		}
+	}
+
+	if repair {
+		if err := engine.Commit(); err != nil {
+			report.Issues = append(report.Issues, &VerifyIssue{Message: fmt.Sprintf("Can not commit repair :%v", err)})
+		}
+	}
+	return report
+}
+
+// Verify : check both sides of the orderbook, issues are appended to the report
+func (orderBook *OrderBook) Verify(report *VerifyReport, repair bool) {
+	report.Books++
+	orderBook.Bids.verify(report, orderBook.Item.Name, Bid, repair)
+	orderBook.Asks.verify(report, orderBook.Item.Name, Ask, repair)
+}
+
+func (orderTree *OrderTree) verify(report *VerifyReport, pairName, side string, repair bool) {
+	v := &verifier{
+		report:    report,
+		orderTree: orderTree,
+		pairName:  pairName,
+		side:      side,
+		repair:    repair,
+		visited:   make(map[string]bool),
+		volume:    Zero(),
+	}
+	tree := orderTree.PriceTree.Tree
+
+	root := tree.Root()
+	if root == nil && !tree.IsEmptyKey(tree.rootKey) {
+		v.addIssue(tree.rootKey, false, "Root node not found")
+	}
+	if root != nil {
+		if root.Item.Color != black {
+			v.addIssue(root.Key, false, "Root node is red")
+		}
+		if !tree.IsEmptyKey(root.ParentKey()) {
+			v.addIssue(root.Key, false, "Root node has parent %x", root.ParentKey())
+		}
+		v.verifyNode(root.Key, root.ParentKey(), nil, nil, black)
+	}
+
+	report.Levels += v.levels
+	report.Orders += v.orders
+
+	// aggregate fields of the tree
+	repaired := false
+	if tree.Size() != v.levels || orderTree.Item.PriceTreeSize != v.levels {
+		v.addIssue(orderTree.Key, repair, "Price tree size is %d, stored %d, found %d levels", tree.Size(),
+			orderTree.Item.PriceTreeSize, v.levels)
+		if repair {
+			orderTree.Item.PriceTreeSize = v.levels
+			tree.SetRootKey(tree.rootKey, v.levels)
+			repaired = true
+		}
+	}
+	if orderTree.Item.NumOrders != v.orders {
+		v.addIssue(orderTree.Key, repair, "Number of orders is %d, found %d", orderTree.Item.NumOrders, v.orders)
+		if repair {
+			orderTree.Item.NumOrders = v.orders
+			repaired = true
+		}
+	}
+	if orderTree.Item.Volume == nil || orderTree.Item.Volume.Cmp(v.volume) != 0 {
+		v.addIssue(orderTree.Key, repair, "Volume is %v, found %v", orderTree.Item.Volume, v.volume)
+		if repair {
+			orderTree.Item.Volume = v.volume
+			repaired = true
+		}
+	}
+	if repaired {
+		orderTree.Save()
+	}
+}
+
+// verifyNode : check the red-black tree invariants and the subtree statistics from this node, lower and upper
+// are the exclusive bounds of its key, return the black height, size and volume of the subtree
+func (v *verifier) verifyNode(key, parentKey, lower, upper []byte, parentColor bool) (int, uint64, *big.Int) {
+	tree := v.orderTree.PriceTree.Tree
+	if tree.IsEmptyKey(key) {
+		// nil leaves are black
+		return 1, 0, Zero()
+	}
+	if v.visited[string(key)] {
+		v.addIssue(key, false, "Node is linked more than once")
+		return 1, 0, Zero()
+	}
+	v.visited[string(key)] = true
+
+	node, err := tree.GetNode(key)
+	if node == nil {
+		v.addIssue(key, false, "Node not found :%v", err)
+		return 1, 0, Zero()
+	}
+
+	if !v.sameKey(node.ParentKey(), parentKey) {
+		v.addIssue(key, false, "Parent key is %x, want %x", node.ParentKey(), parentKey)
+	}
+	if (lower != nil && tree.Comparator(key, lower) <= 0) || (upper != nil && tree.Comparator(key, upper) >= 0) {
+		v.addIssue(key, false, "Node is out of order, must be between %s and %s", tree.FormatBytes(lower),
+			tree.FormatBytes(upper))
+	}
+	if node.Item.Color == red && parentColor == red {
+		v.addIssue(key, false, "Red node has red parent")
+	}
+
+	v.levels++
+	leftHeight, leftSize, leftVolume := v.verifyNode(node.LeftKey(), key, lower, key, node.Item.Color)
+	rightHeight, rightSize, rightVolume := v.verifyNode(node.RightKey(), key, key, upper, node.Item.Color)
+	if leftHeight != rightHeight {
+		v.addIssue(key, false, "Black height of left subtree is %d, right subtree is %d", leftHeight, rightHeight)
+	}
+	if leftHeight < rightHeight {
+		leftHeight = rightHeight
+	}
+	if node.Item.Color == black {
+		leftHeight++
+	}
+
+	// order list is checked after the children, so a repaired volume is counted in the statistics
+	v.verifyOrderList(node)
+	size := leftSize + rightSize + 1
+	volume := Add(tree.weight(node.Value()), Add(leftVolume, rightVolume))
+	if node.Item.Size != size || node.Item.Volume == nil || node.Item.Volume.Cmp(volume) != 0 {
+		v.addIssue(key, v.repair, "Subtree size is %d, volume %v, found %d and %v", node.Item.Size,
+			node.Item.Volume, size, volume)
+		if v.repair {
+			node.Item.Size = size
+			node.Item.Volume = volume
+			tree.Save(node)
+		}
+	}
+	return leftHeight, size, volume
+}
+
+// verifyOrderList : walk the orders of a price level from head to tail, check the links,
+// and compare length and volume with the stored ones
+func (v *verifier) verifyOrderList(node *Node) {
+	item := v.orderTree.getOrderListItem(node.Value())
+	if item.Price == nil {
+		v.addIssue(node.Key, false, "Can not decode order list")
+		return
+	}
+	orderList := NewOrderListWithItem(item, v.orderTree)
+	if !bytes.Equal(orderList.Key, node.Key) {
+		v.addIssue(node.Key, false, "Order list key does not match price %s", orderList.Item.Price)
+	}
+
+	var length uint64
+	volume := Zero()
+	visited := make(map[string]bool)
+	prevKey := EmptyKey()
+	key := orderList.Item.HeadOrder
+	for !v.orderTree.orderDB.IsEmptyKey(key) {
+		if visited[string(key)] {
+			v.addIssue(key, false, "Order links form a cycle")
+			break
+		}
+		visited[string(key)] = true
+
+		order := orderList.GetOrder(key)
+		if order == nil {
+			v.addIssue(key, false, "Dangling order key, linked from %x", prevKey)
+			break
+		}
+		if !v.sameKey(order.Item.PrevOrder, prevKey) {
+			v.addIssue(key, false, "Previous order is %x, want %x", order.Item.PrevOrder, prevKey)
+		}
+		if !bytes.Equal(order.Item.OrderList, orderList.Key) {
+			v.addIssue(key, false, "Order list key is %x, want %x", order.Item.OrderList, orderList.Key)
+		}
+		if order.Item.Price == nil || order.Item.Price.Cmp(orderList.Item.Price) != 0 {
+			v.addIssue(key, false, "Order price is %v, want %v", order.Item.Price, orderList.Item.Price)
+		}
+
+		length++
+		if order.Item.Quantity != nil {
+			volume = Add(volume, order.Item.Quantity)
+		}
+		prevKey = key
+		key = order.Item.NextOrder
+	}
+
+	repaired := false
+	if !v.sameKey(orderList.Item.TailOrder, prevKey) {
+		v.addIssue(node.Key, v.repair, "Tail order is %x, last linked order is %x", orderList.Item.TailOrder, prevKey)
+		if v.repair {
+			orderList.Item.TailOrder = prevKey
+			repaired = true
+		}
+	}
+	if orderList.Item.Length != length {
+		v.addIssue(node.Key, v.repair, "Length is %d, found %d orders", orderList.Item.Length, length)
+		if v.repair {
+			orderList.Item.Length = length
+			repaired = true
+		}
+	}
+	if orderList.Item.Volume == nil || orderList.Item.Volume.Cmp(volume) != 0 {
+		v.addIssue(node.Key, v.repair, "Volume is %v, found %v", orderList.Item.Volume, volume)
+		if v.repair {
+			orderList.Item.Volume = volume
+			repaired = true
+		}
+	}
+	if repaired {
+		v.orderTree.SaveOrderList(orderList)
+	}
+
+	v.orders += length
+	v.volume = Add(v.volume, volume)
+}
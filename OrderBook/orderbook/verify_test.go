@@ -0,0 +1,71 @@
+package orderbook
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestEngineVerify(t *testing.T) {
+	engine := NewEngineWithBackend(NewMemBackend(), map[string]*big.Int{"tomo/weth": ToBigInt("1")})
+	ob, _ := engine.GetOrderBook("TOMO/WETH")
+	orders := []map[string]string{
+		{"type": Limit, "side": Ask, "quantity": "5", "price": "101", "trade_id": "1"},
+		{"type": Limit, "side": Ask, "quantity": "7", "price": "101", "trade_id": "2"},
+		{"type": Limit, "side": Ask, "quantity": "3", "price": "105", "trade_id": "3"},
+		{"type": Limit, "side": Ask, "quantity": "3", "price": "107", "trade_id": "4"},
+		{"type": Limit, "side": Bid, "quantity": "4", "price": "99", "trade_id": "5"},
+	}
+	for _, order := range orders {
+		ob.ProcessOrder(order, false)
+	}
+
+	report := engine.Verify(false)
+	if !report.OK() || len(report.Issues) != 0 || report.Levels != 4 || report.Orders != 5 {
+		t.Fatalf("verify incorrect, got: %s", report)
+	}
+
+	// break the aggregate fields of a price level
+	orderList := ob.Asks.PriceList(ToBigInt("101"))
+	orderList.Item.Length = 10
+	orderList.Item.Volume = ToBigInt("1")
+	ob.Asks.SaveOrderList(orderList)
+
+	report = engine.Verify(false)
+	if report.OK() || len(report.Issues) != 2 {
+		t.Errorf("verify must report the broken order list, got: %s", report)
+	}
+
+	report = engine.Verify(true)
+	if !report.OK() {
+		t.Errorf("verify must repair the order list, got: %s", report)
+	}
+	report = engine.Verify(false)
+	if len(report.Issues) != 0 {
+		t.Errorf("order list must be repaired, got: %s", report)
+	}
+	if ob.Asks.PriceList(ToBigInt("101")).Item.Length != 2 {
+		t.Errorf("length incorrect, got: %d, want: %d.", ob.Asks.PriceList(ToBigInt("101")).Item.Length, 2)
+	}
+
+	// break the subtree statistics of the root
+	root := ob.Asks.PriceTree.Root()
+	root.Item.Size = 1
+	ob.Asks.PriceTree.Save(root)
+	report = engine.Verify(false)
+	if len(report.Issues) != 1 {
+		t.Errorf("verify must report the subtree statistics, got: %s", report)
+	}
+	if report = engine.Verify(true); !report.OK() || ob.Asks.PriceTree.Root().Item.Size != 3 {
+		t.Errorf("verify must repair the subtree statistics, got: %s", report)
+	}
+
+	// break the color of the root, it can not be repaired
+	root = ob.Asks.PriceTree.Root()
+	root.Item.Color = red
+	ob.Asks.PriceTree.Save(root)
+	report = engine.Verify(true)
+	if report.OK() {
+		t.Errorf("verify must report the red root, got: %s", report)
+	}
+	t.Log(report)
+}
@@ -0,0 +1,236 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/protocols"
+	"github.com/ethereum/go-ethereum/rlp"
+	demo "github.com/tomochain/orderbook/common"
+)
+
+// Market makers update many orders at once, one p2p message per order costs a round trip each. A batch
+// carries many messages in one p2p message, the requests are processed in the order of the batch and
+// their replies are sent back in one batch too.
+
+const (
+	// batchWindow : requests of the node, and the requests forwarded or sequenced for the peers, sent in this time
+	// are sent to the peers in batches
+	batchWindow = 10 * time.Millisecond
+	// maxBatchItems : requests of the node in a batch, the batch is sent without waiting for the window
+	maxBatchItems = 512
+	// maxBatchSize : size of the items of a batch, the rest of the max message size of 64KB is for the envelope.
+	// Messages of 1024 bytes would only carry a few requests, batches need the size raised for the sync messages
+	maxBatchSize = 60 * 1024
+	// batchItemOverhead : size of the code and the list headers of an item
+	batchItemOverhead = 16
+)
+
+// OrderbookBatchItem : message of a batch, payload is the rlp of the message with the code
+type OrderbookBatchItem struct {
+	Code    uint64
+	Payload []byte
+}
+
+// OrderbookBatchMsg : messages in order, the replies to the requests are sent back in a batch with the request id
+type OrderbookBatchMsg struct {
+	RequestID uint64
+	Items     []OrderbookBatchItem
+}
+
+// NewOrderbookBatchMsgs : batches of the messages in order, a batch is split when it would not fit
+// in a p2p message. Batches and handshakes can not be in a batch
+func NewOrderbookBatchMsgs(requestID uint64, msgs ...interface{}) ([]*OrderbookBatchMsg, error) {
+	var batches []*OrderbookBatchMsg
+	batch, size := &OrderbookBatchMsg{RequestID: requestID}, 0
+	for _, msg := range msgs {
+		item, err := newBatchItem(msg)
+		if err != nil {
+			return nil, err
+		}
+		itemSize := len(item.Payload) + batchItemOverhead
+		if itemSize > maxBatchSize {
+			return nil, fmt.Errorf("Message is too large for a batch :%d bytes", len(item.Payload))
+		}
+		if size+itemSize > maxBatchSize {
+			batches = append(batches, batch)
+			batch, size = &OrderbookBatchMsg{RequestID: requestID}, 0
+		}
+		batch.Items = append(batch.Items, item)
+		size += itemSize
+	}
+	if len(batch.Items) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, nil
+}
+
+func newBatchItem(msg interface{}) (item OrderbookBatchItem, err error) {
+	switch msg.(type) {
+	case *OrderbookBatchMsg, *OrderbookHandshake:
+		return item, fmt.Errorf("Message can not be in a batch :%T", msg)
+	}
+	code, ok := OrderbookProtocol.GetCode(msg)
+	if !ok {
+		return item, fmt.Errorf("Unknown orderbook message type :%T", msg)
+	}
+	item.Code = code
+	item.Payload, err = rlp.EncodeToBytes(msg)
+	return item, err
+}
+
+// Messages : decode the messages of the batch
+func (batch *OrderbookBatchMsg) Messages() ([]interface{}, error) {
+	msgs := make([]interface{}, 0, len(batch.Items))
+	for i, item := range batch.Items {
+		msg, ok := OrderbookProtocol.NewMsg(item.Code)
+		if !ok {
+			return nil, fmt.Errorf("Unknown message code %d of batch item %d", item.Code, i)
+		}
+		switch msg.(type) {
+		case *OrderbookBatchMsg, *OrderbookHandshake:
+			return nil, fmt.Errorf("Message can not be in a batch :%T", msg)
+		}
+		if err := rlp.DecodeBytes(item.Payload, msg); err != nil {
+			return nil, fmt.Errorf("Batch item %d is not correct :%v", i, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// handleOrderbookBatchMsg : process the requests of the batch in order, then relay the accepted ones and reply
+// in batches. Other messages of the batch are handled like they were sent alone
+func (orderbookHandler *OrderbookHandler) handleOrderbookBatchMsg(message *OrderbookBatchMsg) error {
+	msgs, err := message.Messages()
+	if err != nil {
+		orderbookHandler.penalise(scoreMalformed, err)
+		return err
+	}
+	demo.LogDebug("Received batch", "request_id", message.RequestID, "messages", len(msgs), "peer", orderbookHandler.Peer)
+	// the batch is not limited when it is read, each message counts with its size but the ones limited
+	// by their handler
+	count, size := 0, 0
+	for _, item := range message.Items {
+		if !handleLimitedCodes[item.Code] {
+			count++
+			size += len(item.Payload) + batchItemOverhead
+		}
+	}
+	if !orderbookHandler.limit(count, size) {
+		return nil
+	}
+
+	var relayed, replies []interface{}
+	for _, msg := range msgs {
+		signed, ok := msg.(SignedMsg)
+		if !ok {
+			if err := orderbookHandler.handle(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		reply := orderbookHandler.process(signed)
+		if orderbookHandler.relays(reply) {
+			relayed = append(relayed, signed)
+		}
+		if reply != nil {
+			replies = append(replies, reply)
+		}
+	}
+	if orderbookHandler.peers != nil {
+		orderbookHandler.peers.broadcastBatch(relayed, orderbookHandler.Peer)
+	}
+	if orderbookHandler.Peer == nil || len(replies) == 0 {
+		return nil
+	}
+	batches, err := NewOrderbookBatchMsgs(message.RequestID, replies...)
+	if err != nil {
+		return err
+	}
+	for _, batch := range batches {
+		if err := orderbookHandler.reply(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcastBatch : send the messages to all peers but the one they come from, in batches when there are many
+func (ps *peerSet) broadcastBatch(msgs []interface{}, from *protocols.Peer) {
+	switch len(msgs) {
+	case 0:
+		return
+	case 1:
+		ps.broadcast(msgs[0], from)
+		return
+	}
+	batches, err := NewOrderbookBatchMsgs(0, msgs...)
+	if err != nil {
+		demo.LogError("Batch messages fail", "messages", len(msgs), "err", err)
+		return
+	}
+	for _, batch := range batches {
+		ps.broadcast(batch, from)
+	}
+}
+
+// relayedMsg : message waiting for the batch window, with the peer it comes from
+type relayedMsg struct {
+	msg  interface{}
+	from *protocols.Peer
+}
+
+// relayQueue : messages relayed in the batch window, they are sent in order
+type relayQueue struct {
+	lock      sync.Mutex
+	flushLock sync.Mutex
+	msgs      []relayedMsg
+	pending   bool
+}
+
+// relay : send the message to all peers but the one it comes from with the messages relayed in the batch window,
+// the batch is sent without waiting when it is full
+func (ps *peerSet) relay(msg interface{}, from *protocols.Peer) {
+	queue := &ps.relayed
+	queue.lock.Lock()
+	queue.msgs = append(queue.msgs, relayedMsg{msg: msg, from: from})
+	full := len(queue.msgs) >= maxBatchItems
+	wait := !full && !queue.pending
+	if wait {
+		queue.pending = true
+	}
+	queue.lock.Unlock()
+
+	if full {
+		ps.flushRelayed()
+	} else if wait {
+		time.AfterFunc(batchWindow, ps.flushRelayed)
+	}
+}
+
+// flushRelayed : send the relayed messages, the ones that come from the same peer in a row are sent in batches
+func (ps *peerSet) flushRelayed() {
+	queue := &ps.relayed
+	// flushes run one by one, so the messages are sent in the order they are relayed
+	queue.flushLock.Lock()
+	defer queue.flushLock.Unlock()
+	queue.lock.Lock()
+	relayed := queue.msgs
+	queue.msgs, queue.pending = nil, false
+	queue.lock.Unlock()
+
+	for len(relayed) > 0 {
+		from, end := relayed[0].from, 1
+		for end < len(relayed) && relayed[end].from == from {
+			end++
+		}
+		msgs := make([]interface{}, end)
+		for i := range msgs {
+			msgs[i] = relayed[i].msg
+		}
+		ps.broadcastBatch(msgs, from)
+		relayed = relayed[end:]
+	}
+}
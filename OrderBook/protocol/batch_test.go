@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+func TestOrderbookBatch(t *testing.T) {
+	engine := orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	key, _ := crypto.GenerateKey()
+	order := func(nonce uint64, price string) *OrderbookMsg {
+		msg := &OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Ask,
+			Quantity: "1", Price: price, TradeID: strconv.FormatUint(nonce, 10), Timestamp: nonce, Nonce: nonce}
+		if err := msg.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// many orders are split in batches that fit in a p2p message, in order
+	var msgs []interface{}
+	for i := uint64(1); i <= 1000; i++ {
+		msgs = append(msgs, order(i, strconv.FormatUint(100+i, 10)))
+	}
+	batches, err := NewOrderbookBatchMsgs(7, msgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) < 2 {
+		t.Fatalf("batches incorrect, got: %d", len(batches))
+	}
+	var decoded []interface{}
+	for _, batch := range batches {
+		if size, _ := rlp.EncodeToBytes(batch); uint32(len(size)) > OrderbookProtocol.MaxMsgSize || batch.RequestID != 7 {
+			t.Fatalf("batch incorrect, got: %d bytes, request id %d", len(size), batch.RequestID)
+		}
+		items, err := batch.Messages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, items...)
+	}
+	if len(decoded) != len(msgs) || decoded[999].(*OrderbookMsg).Hash() != msgs[999].(*OrderbookMsg).Hash() {
+		t.Fatalf("batch messages incorrect, got: %d", len(decoded))
+	}
+	if _, err := NewOrderbookBatchMsgs(0, batches[0]); err == nil {
+		t.Error("batch in a batch must be rejected")
+	}
+
+	// requests of a batch are processed in order, replied in a batch and the accepted ones relayed in a batch
+	ps := newPeerSet()
+	a, b := newTestPeer(t, ps, engine, 1), newTestPeer(t, ps, engine, 2)
+	cancel := &OrderbookCancelMsg{PairName: "TOMO/WETH", OrderID: "1", Price: "101", Side: orderbook.Ask, Timestamp: 2, Nonce: 2}
+	if err := cancel.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	// the last order reuses a nonce
+	batches, err = NewOrderbookBatchMsgs(8, order(1, "101"), cancel, order(3, "102"), order(3, "103"),
+		&OrderbookAckMsg{RequestID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.handler.handle(batches[0]); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(t, &OrderbookBatchMsg{})
+	b.expect(t, &OrderbookBatchMsg{})
+	if engine.Sequence() != 3 || engine.GetOrder("TOMO/WETH", "1") != nil || engine.GetOrder("TOMO/WETH", "2") == nil {
+		t.Errorf("batch must be processed in order, got sequence: %d", engine.Sequence())
+	}
+	// relayed back, the requests are not processed again and there is nothing to reply
+	if err := b.handler.handle(batches[0]); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t)
+	a.expect(t)
+	if engine.Sequence() != 3 {
+		t.Errorf("relayed batch must not be processed again, got sequence: %d", engine.Sequence())
+	}
+
+	// requests of the node in the window are sent in a batch, a single one alone
+	inC, quitC := make(chan interface{}), make(chan struct{})
+	go ps.run(inC, quitC)
+	defer close(quitC)
+	for i := uint64(4); i <= 6; i++ {
+		inC <- order(i, "110")
+	}
+	a.expect(t, &OrderbookBatchMsg{})
+	b.expect(t, &OrderbookBatchMsg{})
+	inC <- order(7, "110")
+	a.expect(t, &OrderbookMsg{})
+	b.expect(t, &OrderbookMsg{})
+}
+
+func TestPeerSetRelay(t *testing.T) {
+	engine := orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	ps := newPeerSet()
+	a, b := newTestPeer(t, ps, engine, 1), newTestPeer(t, ps, engine, 2)
+	order := func(nonce uint64) *OrderbookMsg {
+		return &OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Ask,
+			Quantity: "1", Price: "101", TradeID: "1", Timestamp: nonce, Nonce: nonce}
+	}
+
+	// messages relayed in the batch window are sent in a batch, the ones of another peer in their own batch
+	ps.relay(order(1), a.handler.Peer)
+	ps.relay(order(2), a.handler.Peer)
+	ps.relay(order(3), nil)
+	a.expect(t, &OrderbookMsg{})
+	b.expect(t, &OrderbookBatchMsg{}, &OrderbookMsg{})
+
+	// a full batch is sent without waiting for the window
+	for i := uint64(0); i < maxBatchItems; i++ {
+		ps.relay(order(i+4), a.handler.Peer)
+	}
+	ps.relayed.lock.Lock()
+	waiting := len(ps.relayed.msgs)
+	ps.relayed.lock.Unlock()
+	if waiting != 0 {
+		t.Errorf("full batch must be sent at once, got: %d waiting", waiting)
+	}
+	b.expect(t, &OrderbookBatchMsg{})
+}
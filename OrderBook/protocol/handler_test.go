@@ -0,0 +1,189 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+func TestOrderbookHandlerMessages(t *testing.T) {
+	engine := orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	handler := &OrderbookHandler{Engine: engine}
+	owner, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	process := func(msg SignedMsg, key *ecdsa.PrivateKey) interface{} {
+		if key != nil {
+			if err := msg.Sign(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return handler.process(msg)
+	}
+	accepted := func(msg SignedMsg, key *ecdsa.PrivateKey) *OrderbookAckMsg {
+		reply := process(msg, key)
+		ack, ok := reply.(*OrderbookAckMsg)
+		if !ok {
+			t.Fatalf("message must be accepted, got: %v", reply)
+		}
+		if ack.Hash != msg.Hash() || ack.RequestID != requestID(msg) {
+			t.Errorf("ack must match the request, got: %v", ack)
+		}
+		return ack
+	}
+	rejected := func(msg SignedMsg, key *ecdsa.PrivateKey) {
+		reply := process(msg, key)
+		reject, ok := reply.(*OrderbookRejectMsg)
+		if !ok {
+			t.Fatalf("message must be rejected, got: %v", reply)
+		}
+		if reject.Hash != msg.Hash() || reject.RequestID != requestID(msg) || reject.Reason == "" {
+			t.Errorf("reject must match the request, got: %v", reject)
+		}
+	}
+	getOrder := func(orderID string) *orderbook.Order {
+		return engine.GetOrder("TOMO/WETH", orderID)
+	}
+
+	if ack := accepted(&OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Ask,
+		Quantity: "5", Price: "101", TradeID: "1", Timestamp: 1, Nonce: 1, RequestID: 10}, owner); ack.OrderID != "1" {
+		t.Errorf("order id incorrect, got: %s", ack.OrderID)
+	}
+	accepted(&OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Ask,
+		Quantity: "3", Price: "102", TradeID: "2", Timestamp: 1, Nonce: 2, RequestID: 11}, owner)
+	if getOrder("1") == nil || getOrder("2") == nil {
+		t.Fatal("signed orders must be processed")
+	}
+	// each node would give its own timestamp to the order
+	rejected(&OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Ask,
+		Quantity: "1", Price: "103", TradeID: "3", Nonce: 3, RequestID: 12}, owner)
+	if engine.Sequence() != 2 {
+		t.Error("order without timestamp must not be processed")
+	}
+
+	// unsigned message is rejected
+	rejected(&OrderbookCancelMsg{PairName: "TOMO/WETH", OrderID: "1", Price: "101", Side: orderbook.Ask, Nonce: 3, RequestID: 12}, nil)
+	// cancel inferred from an order without trade id is rejected
+	rejected(&OrderbookMsg{PairName: "TOMO/WETH", OrderID: "1", Price: "101", Side: orderbook.Ask, Nonce: 3, RequestID: 13}, owner)
+	// cancel signed by another owner is rejected by the engine
+	rejected(&OrderbookCancelMsg{PairName: "TOMO/WETH", OrderID: "1", Price: "101", Side: orderbook.Ask, Nonce: 1, RequestID: 14}, other)
+	if getOrder("1") == nil {
+		t.Fatal("order must not be cancelled")
+	}
+	// replayed order is rejected
+	rejected(&OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Ask,
+		Quantity: "3", Price: "102", TradeID: "2", Timestamp: 1, Nonce: 2, RequestID: 15}, owner)
+
+	accepted(&OrderbookAmendMsg{PairName: "TOMO/WETH", OrderID: "1", Type: orderbook.Limit, Side: orderbook.Ask,
+		Quantity: "4", Price: "101", TradeID: "1", Timestamp: 2, Nonce: 4, RequestID: 16}, owner)
+	if order := getOrder("1"); order == nil || order.Item.Quantity.Cmp(big.NewInt(4)) != 0 {
+		t.Errorf("order must be amended, got: %v", order)
+	}
+	rejected(&OrderbookAmendMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Ask,
+		Quantity: "4", Price: "101", TradeID: "1", Timestamp: 2, Nonce: 5, RequestID: 17}, owner)
+	// amend of an order that is not in the book is rejected
+	rejected(&OrderbookAmendMsg{PairName: "TOMO/WETH", OrderID: "9", Type: orderbook.Limit, Side: orderbook.Ask,
+		Quantity: "4", Price: "101", TradeID: "9", Timestamp: 2, Nonce: 5, RequestID: 17}, owner)
+
+	// the bid is matched by the best ask, the trade is in the ack
+	ack := accepted(&OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Bid,
+		Quantity: "4", Price: "101", TradeID: "3", Timestamp: 3, Nonce: 2, RequestID: 18}, other)
+	if ack.TradeCount != 1 || len(ack.Trades) != 1 || ack.Trades[0].Price != "101" || ack.Trades[0].Quantity != "4" ||
+		ack.Trades[0].Timestamp != 3 {
+		t.Errorf("trades incorrect, got: %v", ack.Trades)
+	}
+	if ack.OrderID == "" || getOrder(ack.OrderID) != nil {
+		t.Errorf("matched order must have an id and not rest in the book, got: %s", ack.OrderID)
+	}
+	if getOrder("1") != nil {
+		t.Error("order must be filled")
+	}
+
+	rejected(&OrderbookCancelMsg{PairName: "TOMO/WETH", OrderID: "1", Price: "101", Side: orderbook.Ask, Timestamp: 4, Nonce: 6, RequestID: 19}, owner)
+	if ack := accepted(&OrderbookMassCancelMsg{PairName: "TOMO/WETH", Timestamp: 4, Nonce: 7, RequestID: 20}, owner); ack.Cancelled != 1 {
+		t.Errorf("cancelled orders incorrect, got: %d", ack.Cancelled)
+	}
+	if getOrder("2") != nil {
+		t.Error("orders must be cancelled by the mass cancel")
+	}
+
+	// replies are only logged
+	if err := handler.handle(&OrderbookRejectMsg{RequestID: 10, Reason: "test"}); err != nil {
+		t.Error(err)
+	}
+	if err := handler.handle(newAck(10, ack.Hash, "1", nil)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOrderbookAckTrades(t *testing.T) {
+	var trades []map[string]string
+	for i := 0; i < 300; i++ {
+		trades = append(trades, map[string]string{"price": "100", "quantity": "1", "timestamp": "7"})
+	}
+	ack := newAck(1, crypto.Keccak256Hash(), "1", trades)
+	if len(ack.Trades) == 0 || len(ack.Trades) == len(trades) || ack.TradeCount != uint64(len(trades)) ||
+		ack.Trades[0].Timestamp != 7 {
+		t.Errorf("ack trades incorrect, got: %d of %d", len(ack.Trades), ack.TradeCount)
+	}
+	// the ack fits in the message size, one more trade would not
+	data, _ := rlp.EncodeToBytes(ack)
+	ack.Trades = append(ack.Trades, ack.Trades[0])
+	more, _ := rlp.EncodeToBytes(ack)
+	if len(data) > maxAckSize || len(more) <= maxAckSize {
+		t.Errorf("ack size incorrect, got: %d bytes", len(data))
+	}
+}
+
+func TestOrderbookHandshake(t *testing.T) {
+	engine := orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	local := newHandshake("local", engine)
+	if local.V != ProtocolVersion || len(local.Pairs) != 1 || local.Pairs[0] != "tomo/weth" || local.Sequence != 0 {
+		t.Fatalf("handshake incorrect, got: %v", local)
+	}
+	check := checkProtoHandshake(local)
+
+	remote := *local
+	if err := check(&remote); err != nil {
+		t.Errorf("same handshake must be accepted, got: %v", err)
+	}
+	// another sequence is accepted, the peer is behind or ahead
+	remote.Sequence, remote.PairRoots = 3, []common.Hash{crypto.Keccak256Hash([]byte("root"))}
+	remote.StateRoot = orderbook.PairsRoot(remote.Pairs, remote.PairRoots)
+	if err := check(&remote); err != nil {
+		t.Errorf("peer at another sequence must be accepted, got: %v", err)
+	}
+	// roots of the pairs must be the ones of the state root
+	remote.StateRoot = crypto.Keccak256Hash([]byte("root"))
+	if err := check(&remote); err == nil {
+		t.Error("pair roots of another state root must be rejected")
+	}
+
+	remote = *local
+	remote.V = ProtocolVersion - 1
+	if err := check(&remote); err == nil {
+		t.Error("another version must be rejected")
+	}
+	remote = *local
+	remote.Pairs = []string{"tomo/usdt", "tomo/weth"}
+	if err := check(&remote); err == nil {
+		t.Error("other pairs must be rejected")
+	}
+	remote = *local
+	remote.StateRoot = crypto.Keccak256Hash([]byte("root"))
+	if err := check(&remote); err == nil {
+		t.Error("other state at the same sequence must be rejected")
+	}
+	remote = *local
+	remote.Sequencer = common.HexToAddress("0x0a")
+	if err := check(&remote); err == nil {
+		t.Error("another sequencer must be rejected")
+	}
+	if err := check(&OrderbookAckMsg{}); err == nil {
+		t.Error("other message must be rejected")
+	}
+}
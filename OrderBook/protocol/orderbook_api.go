@@ -1,9 +1,11 @@
 package protocol
 
 import (
+	"fmt"
 	"math/big"
 	"strconv"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/tomochain/orderbook/orderbook"
 )
 
@@ -33,63 +35,201 @@ func (api *OrderbookAPI) getRecordFromOrder(order *orderbook.Order, ob *orderboo
 	// retrieve the input order_id, by default it is set when retrieving from orderbook
 	record["order_id"] = new(big.Int).SetBytes(order.Key).String()
 	record["trade_id"] = order.Item.TradeID
+	// human readable values when the pair is registered
+	if pair := api.Engine.GetPair(ob.Item.Name); pair != nil {
+		record["price_decimal"] = pair.FormatPrice(order.Item.Price)
+		record["quantity_decimal"] = pair.FormatQuantity(order.Item.Quantity)
+	}
 	return record
 }
 
 func (api *OrderbookAPI) GetBestAskList(pairName string) []map[string]string {
-	ob, _ := api.Engine.GetOrderBook(pairName)
-	if ob == nil {
-		return nil
-	}
-	orderList := ob.Asks.MaxPriceList()
-	if orderList == nil {
-		return nil
-	}
+	var results []map[string]string
+	api.Engine.ReadSnapshot(pairName, func(ob *orderbook.OrderBook) error {
+		orderList := ob.Asks.MaxPriceList()
+		if orderList == nil {
+			return nil
+		}
 
-	// t.Logf("Best ask List : %s", orderList.String(0))
-	cursor := orderList.Head()
-	// we have length
-	results := make([]map[string]string, orderList.Item.Length)
-	for cursor != nil {
-		record := api.getRecordFromOrder(cursor, ob)
-		results = append(results, record)
-		cursor = cursor.GetNextOrder(orderList)
-	}
+		// t.Logf("Best ask List : %s", orderList.String(0))
+		cursor := orderList.Head()
+		// we have length
+		results = make([]map[string]string, orderList.Item.Length)
+		for cursor != nil {
+			record := api.getRecordFromOrder(cursor, ob)
+			results = append(results, record)
+			cursor = cursor.GetNextOrder(orderList)
+		}
+		return nil
+	})
 	return results
 }
 
 func (api *OrderbookAPI) GetBestBidList(pairName string) []map[string]string {
-	ob, _ := api.Engine.GetOrderBook(pairName)
-	if ob == nil {
-		return nil
-	}
-	orderList := ob.Bids.MinPriceList()
-	// t.Logf("Best ask List : %s", orderList.String(0))
-	if orderList == nil {
+	var results []map[string]string
+	api.Engine.ReadSnapshot(pairName, func(ob *orderbook.OrderBook) error {
+		orderList := ob.Bids.MinPriceList()
+		// t.Logf("Best ask List : %s", orderList.String(0))
+		if orderList == nil {
+			return nil
+		}
+		cursor := orderList.Tail()
+		// we have length
+		results = make([]map[string]string, orderList.Item.Length)
+		for cursor != nil {
+			record := api.getRecordFromOrder(cursor, ob)
+			results = append(results, record)
+			cursor = cursor.GetPrevOrder(orderList)
+		}
 		return nil
-	}
-	cursor := orderList.Tail()
-	// we have length
-	results := make([]map[string]string, orderList.Item.Length)
-	for cursor != nil {
-		record := api.getRecordFromOrder(cursor, ob)
-		results = append(results, record)
-		cursor = cursor.GetPrevOrder(orderList)
-	}
+	})
 	return results
 
 }
 
 func (api *OrderbookAPI) GetOrder(pairName, orderID string) map[string]string {
 	var result map[string]string
-	ob, _ := api.Engine.GetOrderBook(pairName)
-	if ob == nil {
+	api.Engine.ReadSnapshot(pairName, func(ob *orderbook.OrderBook) error {
+		key := orderbook.GetKeyFromString(orderID)
+		order := ob.GetOrder(key)
+		if order != nil {
+			result = api.getRecordFromOrder(order, ob)
+		}
+		return nil
+	})
+	return result
+}
+
+// GetStateRoot : state root of the orderbook, for checking with other nodes
+func (api *OrderbookAPI) GetStateRoot(pairName string) (common.Hash, error) {
+	var root common.Hash
+	// state root updates the cached hashes of the orderbook
+	err := api.Engine.WithOrderBook(pairName, func(ob *orderbook.OrderBook) error {
+		root = ob.StateRoot()
+		return nil
+	})
+	return root, err
+}
+
+// GetEngineStateRoot : state root over all pairs of the engine
+func (api *OrderbookAPI) GetEngineStateRoot() common.Hash {
+	return api.Engine.StateRoot()
+}
+
+// GetOrderProof : merkle proof that the order exists at its price level
+func (api *OrderbookAPI) GetOrderProof(pairName, orderID string) (*orderbook.OrderProof, error) {
+	return api.Engine.GetOrderProof(pairName, orderID)
+}
+
+// GetPriceLevel : price and volume of the level at the index of a side, 0 is the best price
+func (api *OrderbookAPI) GetPriceLevel(pairName, side string, index uint64) map[string]string {
+	var result map[string]string
+	api.Engine.ReadSnapshot(pairName, func(ob *orderbook.OrderBook) error {
+		orderList := ob.PriceLevel(side, index)
+		if orderList != nil {
+			result = map[string]string{
+				"price":  orderList.Item.Price.String(),
+				"volume": orderList.Item.Volume.String(),
+				"length": strconv.FormatUint(orderList.Item.Length, 10),
+			}
+			if pair := api.Engine.GetPair(pairName); pair != nil {
+				result["price_decimal"] = pair.FormatPrice(orderList.Item.Price)
+				result["volume_decimal"] = pair.FormatQuantity(orderList.Item.Volume)
+			}
+		}
 		return nil
+	})
+	return result
+}
+
+// GetVolumeBetterThan : volume of a side with price better than the price
+func (api *OrderbookAPI) GetVolumeBetterThan(pairName, side, price string) string {
+	volume := "0"
+	api.Engine.ReadSnapshot(pairName, func(ob *orderbook.OrderBook) error {
+		volume = ob.VolumeBetterThan(side, orderbook.ToBigInt(price)).String()
+		return nil
+	})
+	return volume
+}
+
+// GetPairs : registered pairs with their tokens and status
+func (api *OrderbookAPI) GetPairs() []*orderbook.PairItem {
+	return api.Engine.ListPairs()
+}
+
+func (api *OrderbookAPI) getPair(pairName string) (*orderbook.PairItem, error) {
+	pair := api.Engine.GetPair(pairName)
+	if pair == nil {
+		return nil, fmt.Errorf("Pair is not registered :%s", pairName)
+	}
+	return pair, nil
+}
+
+// ToUnits : convert a decimal price in quote per base, or a decimal quantity of base token, to the
+// integer value used by orders. Field is price or quantity
+func (api *OrderbookAPI) ToUnits(pairName, field, value string) (string, error) {
+	pair, err := api.getPair(pairName)
+	if err != nil {
+		return "", err
 	}
-	key := orderbook.GetKeyFromString(orderID)
-	order := ob.GetOrder(key)
-	if order != nil {
-		result = api.getRecordFromOrder(order, ob)
+	var units *big.Int
+	switch field {
+	case "price":
+		units, err = pair.ParsePrice(value)
+	case "quantity":
+		units, err = pair.ParseQuantity(value)
+	default:
+		return "", fmt.Errorf("Field is not correct :%s", field)
 	}
-	return result
+	if err != nil {
+		return "", err
+	}
+	return units.String(), nil
+}
+
+// FromUnits : convert an integer price or quantity of the pair to a decimal string
+func (api *OrderbookAPI) FromUnits(pairName, field, value string) (string, error) {
+	pair, err := api.getPair(pairName)
+	if err != nil {
+		return "", err
+	}
+	units, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		return "", fmt.Errorf("Value is not correct :%s", value)
+	}
+	switch field {
+	case "price":
+		return pair.FormatPrice(units), nil
+	case "quantity":
+		return pair.FormatQuantity(units), nil
+	}
+	return "", fmt.Errorf("Field is not correct :%s", field)
+}
+
+// GetMarketImpact : estimate a market order of quantity in base units, cost is the notional in quote units
+func (api *OrderbookAPI) GetMarketImpact(pairName, side, quantity string) (map[string]string, error) {
+	pair, err := api.getPair(pairName)
+	if err != nil {
+		return nil, err
+	}
+	amount, ok := new(big.Int).SetString(quantity, 10)
+	if !ok {
+		return nil, fmt.Errorf("Quantity is not correct :%s", quantity)
+	}
+	var result map[string]string
+	err = api.Engine.ReadSnapshot(pairName, func(ob *orderbook.OrderBook) error {
+		filled, cost, lastPrice := ob.EstimateMarketImpact(side, amount)
+		// cost is price * quantity, price is for one whole base token
+		notional := orderbook.Div(cost, orderbook.DecimalScale(pair.BaseDecimals))
+		result = map[string]string{
+			"filled":             filled.String(),
+			"filled_decimal":     pair.FormatQuantity(filled),
+			"notional":           notional.String(),
+			"notional_decimal":   pair.FormatNotional(notional),
+			"last_price":         lastPrice.String(),
+			"last_price_decimal": pair.FormatPrice(lastPrice),
+		}
+		return nil
+	})
+	return result, err
 }
@@ -0,0 +1,233 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/protocols"
+	lru "github.com/hashicorp/golang-lru"
+
+	demo "github.com/tomochain/orderbook/common"
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+const (
+	// seenCacheLimit : hashes of the last processed messages, a message that comes back after is dropped
+	// by the nonce check of the engine
+	seenCacheLimit = 8192
+	// sendQueueSize : messages waiting to be sent to a peer, a peer that does not read them is dropped
+	sendQueueSize = 1024
+)
+
+var errSendQueueFull = errors.New("Peer does not read its messages")
+
+// peerSet : peers that completed the handshake. Messages of the node are sent to all peers, requests
+// accepted from a peer are relayed to the others, and each message is processed and relayed only once
+type peerSet struct {
+	lock  sync.RWMutex
+	peers map[discover.NodeID]*OrderbookHandler
+	seen  *lru.Cache
+	// pairs that are syncing from a peer
+	sync *syncer
+	// sequencer : order of the requests, nil when each node processes them on arrival
+	sequencer *sequencer
+	// requests forwarded and sequenced in the batch window
+	relayed relayQueue
+	// limits of each peer, and the peers banned until a time
+	limits PeerLimits
+	banned map[discover.NodeID]time.Time
+}
+
+func newPeerSet() *peerSet {
+	seen, _ := lru.New(seenCacheLimit)
+	return &peerSet{
+		peers:  make(map[discover.NodeID]*OrderbookHandler),
+		seen:   seen,
+		sync:   newSyncer(),
+		limits: DefaultPeerLimits,
+		banned: make(map[discover.NodeID]time.Time),
+	}
+}
+
+// register : add the peer of the handler, it is removed by unregister when the peer disconnects
+func (ps *peerSet) register(handler *OrderbookHandler) error {
+	id := handler.Peer.ID()
+	if ps.isBanned(id) {
+		return errPeerBanned
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if _, ok := ps.peers[id]; ok {
+		return fmt.Errorf("Peer is already registered :%s", id.TerminalString())
+	}
+	ps.peers[id] = handler
+	handler.peers = ps
+	if handler.limiter == nil {
+		handler.limiter = newPeerLimiter(ps.limits)
+	}
+	return nil
+}
+
+func (ps *peerSet) unregister(handler *OrderbookHandler) {
+	ps.lock.Lock()
+	id := handler.Peer.ID()
+	if ps.peers[id] == handler {
+		delete(ps.peers, id)
+	}
+	ps.lock.Unlock()
+	ps.sync.abort(handler)
+	if ps.sequencer != nil {
+		ps.sequencer.abort(handler)
+	}
+}
+
+// setSequencer : requests are ordered by the sequencer of the config, the ones of the node are processed
+// with the engine when it is the sequencer
+func (ps *peerSet) setSequencer(config *SequencerConfig, engine *orderbook.Engine) {
+	ps.sequencer = newSequencer(config, &OrderbookHandler{Engine: engine, peers: ps})
+}
+
+// Len : number of connected peers
+func (ps *peerSet) Len() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	return len(ps.peers)
+}
+
+// syncPeer : the peer that is the most ahead to sync from, but the one of the handler, nil if there is none
+func (ps *peerSet) syncPeer(handler *OrderbookHandler) *OrderbookHandler {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	var best *OrderbookHandler
+	for _, peer := range ps.peers {
+		if peer == handler || peer.Remote == nil {
+			continue
+		}
+		if best == nil || peer.Remote.Sequence > best.Remote.Sequence {
+			best = peer
+		}
+	}
+	return best
+}
+
+// markSeen : return false if the message was already seen
+func (ps *peerSet) markSeen(hash common.Hash) bool {
+	seen, _ := ps.seen.ContainsOrAdd(hash, struct{}{})
+	return !seen
+}
+
+// forget : the message was not accepted, it is processed when it is received again
+func (ps *peerSet) forget(hash common.Hash) {
+	ps.seen.Remove(hash)
+}
+
+// broadcast : send the message to all peers but the one it comes from, nil for messages of the node
+func (ps *peerSet) broadcast(msg interface{}, from *protocols.Peer) {
+	ps.lock.RLock()
+	handlers := make([]*OrderbookHandler, 0, len(ps.peers))
+	for _, handler := range ps.peers {
+		if handler.Peer != from {
+			handlers = append(handlers, handler)
+		}
+	}
+	ps.lock.RUnlock()
+
+	for _, handler := range handlers {
+		demo.LogDebug("Sending orderbook", "orderbook", msg, "peer", handler.Peer)
+		if err := handler.send(msg); err != nil {
+			demo.LogWarn("Send p2p message fail", "peer", handler.Peer, "err", err)
+		}
+	}
+}
+
+// send : queue the message for the peer of the handler, so the handler does not wait until the peer reads it
+// while the peer waits for the handler. Handlers without queue send it at once. A message is never skipped,
+// the peer is dropped when its queue is full and it syncs again when it reconnects
+func (handler *OrderbookHandler) send(msg interface{}) error {
+	if handler.sendC == nil {
+		return handler.Peer.Send(msg)
+	}
+	select {
+	case handler.sendC <- msg:
+		return nil
+	default:
+		handler.Peer.Drop(errSendQueueFull)
+		return errSendQueueFull
+	}
+}
+
+// sendLoop : send the queued messages until quit, the peer is dropped when a send fails
+func (handler *OrderbookHandler) sendLoop(quitC <-chan struct{}) {
+	for {
+		select {
+		case msg := <-handler.sendC:
+			if err := handler.Peer.Send(msg); err != nil {
+				demo.LogWarn("Send p2p message fail", "peer", handler.Peer, "err", err)
+				handler.Peer.Drop(err)
+				return
+			}
+		case <-quitC:
+			return
+		}
+	}
+}
+
+// run : send the messages of the node to all peers until quit. Requests sent in the batch window
+// are sent together
+func (ps *peerSet) run(inC <-chan interface{}, quitC <-chan struct{}) {
+	var batch []interface{}
+	var flushC <-chan time.Time
+	flush := func() {
+		ps.broadcastBatch(batch, nil)
+		batch, flushC = nil, nil
+	}
+	for {
+		select {
+		case payload := <-inC:
+			// any message of the protocol can be sent
+			if _, ok := OrderbookProtocol.GetCode(payload); !ok {
+				demo.LogWarn("Unknown orderbook message", "payload", payload)
+				continue
+			}
+			signed, ok := payload.(SignedMsg)
+			if !ok {
+				// messages are sent in order
+				flush()
+				ps.broadcast(payload, nil)
+				continue
+			}
+			// peers penalise the node for requests that are not correct
+			if err := validate(signed); err != nil {
+				demo.LogWarn("Request of the node is not correct", "payload", payload, "err", err)
+				continue
+			}
+			// the node already processed its own message, it must not be processed again when relayed back
+			ps.markSeen(signed.Hash())
+			// the sequencer orders its own requests with the ones of the peers, other nodes forward them
+			if ps.sequencer != nil && ps.sequencer.leader() {
+				reply := ps.sequencer.sequence(ps.sequencer.local, signed)
+				demo.LogInfo("Sequenced request of the node", "reply", reply)
+				continue
+			}
+			batch = append(batch, signed)
+			if flushC == nil {
+				flushC = time.After(batchWindow)
+			}
+			if len(batch) >= maxBatchItems {
+				flush()
+			}
+
+		case <-flushC:
+			flush()
+
+		// send quit command, stop this loop
+		case <-quitC:
+			flush()
+			return
+		}
+	}
+}
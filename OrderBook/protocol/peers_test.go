@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/protocols"
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+// testPeer : handler of a peer connected with a pipe, the codes of the messages sent to it are in received
+type testPeer struct {
+	handler  *OrderbookHandler
+	received chan uint64
+}
+
+func newTestPeer(t *testing.T, ps *peerSet, engine *orderbook.Engine, id byte) *testPeer {
+	local, remote := p2p.MsgPipe()
+	peer := protocols.NewPeer(p2p.NewPeer(discover.NodeID{id}, "test", nil), local, OrderbookProtocol)
+	tp := &testPeer{
+		handler:  &OrderbookHandler{Engine: engine, Peer: peer},
+		received: make(chan uint64, 16),
+	}
+	if err := ps.register(tp.handler); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			msg, err := remote.ReadMsg()
+			if err != nil {
+				return
+			}
+			msg.Discard()
+			tp.received <- msg.Code
+		}
+	}()
+	return tp
+}
+
+// expect : codes of the messages sent to the peer, in order, then nothing else
+func (tp *testPeer) expect(t *testing.T, codes ...interface{}) {
+	for _, msg := range codes {
+		want, _ := OrderbookProtocol.GetCode(msg)
+		select {
+		case code := <-tp.received:
+			if code != want {
+				t.Errorf("message code incorrect, got: %d, want: %d.", code, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %T is not received", msg)
+		}
+	}
+	select {
+	case code := <-tp.received:
+		t.Errorf("unexpected message, got: %d", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPeerSetGossip(t *testing.T) {
+	newEngine := func() *orderbook.Engine {
+		return orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	}
+	ps := newPeerSet()
+	engine := newEngine()
+	a, b, c := newTestPeer(t, ps, engine, 1), newTestPeer(t, ps, engine, 2), newTestPeer(t, ps, engine, 3)
+	if ps.Len() != 3 {
+		t.Fatalf("peers incorrect, got: %d", ps.Len())
+	}
+	if err := ps.register(&OrderbookHandler{Engine: engine, Peer: a.handler.Peer}); err == nil {
+		t.Error("peer must be registered once")
+	}
+	key, _ := crypto.GenerateKey()
+	order := func(nonce uint64) *OrderbookMsg {
+		msg := &OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Ask,
+			Quantity: "1", Price: "101", TradeID: "1", Timestamp: 1, Nonce: nonce}
+		if err := msg.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// order from a is acked to a and relayed to the others
+	msg := order(1)
+	if err := a.handler.handle(msg); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(t, &OrderbookAckMsg{})
+	b.expect(t, &OrderbookMsg{})
+	c.expect(t, &OrderbookMsg{})
+
+	// the same order relayed back by b is dropped
+	if err := b.handler.handle(msg); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t)
+	a.expect(t)
+
+	// rejected order is not relayed
+	if err := b.handler.handle(&OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", TradeID: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t, &OrderbookRejectMsg{})
+	a.expect(t)
+	c.expect(t)
+
+	// messages of the node are sent to all peers, and not processed again when they come back
+	inC, quitC := make(chan interface{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		ps.run(inC, quitC)
+		close(done)
+	}()
+	local := order(2)
+	inC <- local
+	a.expect(t, &OrderbookMsg{})
+	b.expect(t, &OrderbookMsg{})
+	c.expect(t, &OrderbookMsg{})
+	if err := c.handler.handle(local); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(t)
+
+	// disconnected peer does not receive messages
+	ps.unregister(c.handler)
+	inC <- order(3)
+	a.expect(t, &OrderbookMsg{})
+	b.expect(t, &OrderbookMsg{})
+	c.expect(t)
+	if ps.Len() != 2 {
+		t.Errorf("peers incorrect, got: %d", ps.Len())
+	}
+
+	close(quitC)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("send loop must stop on quit")
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	engine := orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	a := newTestPeer(t, newPeerSet(), engine, 1)
+	a.handler.sendC = make(chan interface{}, 1)
+
+	// a message is not skipped when the queue is full, the peer is dropped
+	if err := a.handler.send(&OrderbookAckMsg{RequestID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.handler.send(&OrderbookAckMsg{RequestID: 2}); err != errSendQueueFull {
+		t.Fatalf("full queue must drop the peer, got: %v", err)
+	}
+	quitC := make(chan struct{})
+	defer close(quitC)
+	go a.handler.sendLoop(quitC)
+	a.expect(t, &OrderbookAckMsg{})
+}
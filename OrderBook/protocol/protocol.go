@@ -1,12 +1,17 @@
 package protocol
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/protocols"
+	"github.com/ethereum/go-ethereum/rlp"
 
 	// "github.com/ethereum/go-ethereum/swarm/pss"
 
@@ -16,23 +21,46 @@ import (
 
 const (
 	OrderbookName = "orderbook"
+	// ProtocolVersion : version 43 has dedicated cancel, amend and mass cancel messages,
+	// version 44 replies to them with the request id, version 45 has the handshake with the engine state,
+	// version 46 has the sync of the books, version 47 has the sequencer, version 48 has the batches,
+	// version 49 has the state root of each pair in the handshake
+	ProtocolVersion = 49
+	// HandshakeTimeout : peers that do not complete the handshake in time are disconnected
+	HandshakeTimeout = 10 * time.Second
+	// maxAckSize : encoded size of an ack, it carries the trades that fit and the rest is only counted
+	maxAckSize = 1024
 )
 
 var (
+	// message codes are the indexes, new messages must be appended
 	OrderbookProtocol = &protocols.Spec{
-		Name:       OrderbookName,
-		Version:    42,
-		MaxMsgSize: 1024,
+		Name:    OrderbookName,
+		Version: ProtocolVersion,
+		// a sync message carries many orders or operations of a pair, a book would take thousands of
+		// messages of 1024 bytes
+		MaxMsgSize: 64 * 1024,
 		Messages: []interface{}{
 			&OrderbookHandshake{},
 			&OrderbookMsg{},
-			// &OrderbookCancelMsg{},
+			&OrderbookCancelMsg{},
+			&OrderbookAmendMsg{},
+			&OrderbookMassCancelMsg{},
+			&OrderbookAckMsg{},
+			&OrderbookRejectMsg{},
+			&OrderbookSyncRequestMsg{},
+			&OrderbookSnapshotMsg{},
+			&OrderbookJournalMsg{},
+			&OrderbookSequencedMsg{},
+			&OrderbookSequenceRequestMsg{},
+			&OrderbookBatchMsg{},
 		},
 	}
 
 	// OrderbookTopic = pss.ProtocolTopic(OrderbookProtocol)
 )
 
+// OrderbookMsg : new order, order id must be empty or 0
 type OrderbookMsg struct {
 	PairName  string
 	OrderID   string
@@ -42,15 +70,78 @@ type OrderbookMsg struct {
 	Timestamp uint64
 	TradeID   string
 	Type      string
+	// owner signs the hash of the order with the nonce, see Sign and Verify
+	Owner     common.Address
+	Nonce     uint64
+	Signature []byte
+	// chosen by the sender to match the reply, it is not signed
+	RequestID uint64
 }
 
-// type OrderbookCancelMsg struct {
-// 	PairName  string
-// 	OrderID   string
-// 	Price     string
-// 	Side      string
-// 	Timestamp uint64
-// }
+// OrderbookCancelMsg : cancel an order of the owner
+type OrderbookCancelMsg struct {
+	PairName  string
+	OrderID   string
+	Price     string
+	Side      string
+	Timestamp uint64
+	Owner     common.Address
+	Nonce     uint64
+	Signature []byte
+	RequestID uint64
+}
+
+// OrderbookAmendMsg : update the price or quantity of an order of the owner
+type OrderbookAmendMsg struct {
+	PairName  string
+	OrderID   string
+	Price     string
+	Quantity  string
+	Side      string
+	Timestamp uint64
+	TradeID   string
+	Type      string
+	Owner     common.Address
+	Nonce     uint64
+	Signature []byte
+	RequestID uint64
+}
+
+// OrderbookMassCancelMsg : cancel all orders of the owner signed with a lower nonce, in all pairs
+// when the pair name is empty
+type OrderbookMassCancelMsg struct {
+	PairName  string
+	Timestamp uint64
+	Owner     common.Address
+	Nonce     uint64
+	Signature []byte
+	RequestID uint64
+}
+
+// OrderbookTrade : trade of an accepted order
+type OrderbookTrade struct {
+	Price     string
+	Quantity  string
+	Timestamp uint64
+}
+
+// OrderbookAckMsg : reply to the request, the message with the hash is accepted. Order id is set for a new
+// order or an amend, trades are set when a new order is matched, cancelled is set for a mass cancel
+type OrderbookAckMsg struct {
+	RequestID  uint64
+	Hash       common.Hash
+	OrderID    string
+	Trades     []OrderbookTrade
+	TradeCount uint64
+	Cancelled  uint64
+}
+
+// OrderbookRejectMsg : reply to the request, the message with the hash is rejected
+type OrderbookRejectMsg struct {
+	RequestID uint64
+	Hash      common.Hash
+	Reason    string
+}
 
 func (msg *OrderbookMsg) ToQuote() map[string]string {
 	quote := make(map[string]string)
@@ -61,23 +152,74 @@ func (msg *OrderbookMsg) ToQuote() map[string]string {
 	quote["price"] = msg.Price
 	quote["trade_id"] = msg.TradeID
 	quote["pair_name"] = msg.PairName
-	// if insert id is not used, just for update
+	// new order, the engine assigns the id
+	quote["order_id"] = "0"
+	quote["owner"] = msg.Owner.Hex()
+	quote["nonce"] = strconv.FormatUint(msg.Nonce, 10)
+	return quote
+}
+
+func (msg *OrderbookCancelMsg) ToQuote() map[string]string {
+	quote := make(map[string]string)
+	quote["timestamp"] = strconv.FormatUint(msg.Timestamp, 10)
+	quote["side"] = msg.Side
+	quote["price"] = msg.Price
+	quote["pair_name"] = msg.PairName
 	quote["order_id"] = msg.OrderID
+	// owner is checked by the engine
+	quote["owner"] = msg.Owner.Hex()
+	quote["nonce"] = strconv.FormatUint(msg.Nonce, 10)
 	return quote
 }
 
-// func (msg *OrderbookCancelMsg) ToQuote() map[string]string {
-// 	quote := make(map[string]string)
-// 	quote["timestamp"] = strconv.FormatUint(msg.Timestamp, 10)
-// 	quote["side"] = msg.Side
-// 	quote["price"] = msg.Price
-// 	quote["pair_name"] = msg.PairName
-// 	quote["order_id"] = msg.OrderID
-// 	return quote
-// }
+func (msg *OrderbookAmendMsg) ToQuote() map[string]string {
+	quote := make(map[string]string)
+	quote["timestamp"] = strconv.FormatUint(msg.Timestamp, 10)
+	quote["type"] = msg.Type
+	quote["side"] = msg.Side
+	quote["quantity"] = msg.Quantity
+	quote["price"] = msg.Price
+	quote["trade_id"] = msg.TradeID
+	quote["pair_name"] = msg.PairName
+	quote["order_id"] = msg.OrderID
+	// owner is checked by the engine
+	quote["owner"] = msg.Owner.Hex()
+	quote["nonce"] = strconv.FormatUint(msg.Nonce, 10)
+	return quote
+}
+
+func (msg *OrderbookMassCancelMsg) ToQuote() map[string]string {
+	quote := make(map[string]string)
+	quote["timestamp"] = strconv.FormatUint(msg.Timestamp, 10)
+	quote["pair_name"] = msg.PairName
+	quote["owner"] = msg.Owner.Hex()
+	quote["nonce"] = strconv.FormatUint(msg.Nonce, 10)
+	return quote
+}
 
+// parse the common fields of a quote, nonce and request id are optional
+func parseQuote(quote map[string]string) (timestamp uint64, owner common.Address, nonce uint64, requestID uint64, err error) {
+	timestamp, err = strconv.ParseUint(quote["timestamp"], 10, 64)
+	if err != nil {
+		return
+	}
+	if quote["nonce"] != "" {
+		if nonce, err = strconv.ParseUint(quote["nonce"], 10, 64); err != nil {
+			return
+		}
+	}
+	if quote["request_id"] != "" {
+		requestID, err = strconv.ParseUint(quote["request_id"], 10, 64)
+	}
+	return timestamp, common.HexToAddress(quote["owner"]), nonce, requestID, err
+}
+
+// NewOrderbookMsg : message of the quote, it must be signed before sending
 func NewOrderbookMsg(quote map[string]string) (*OrderbookMsg, error) {
-	timestamp, err := strconv.ParseUint(quote["timestamp"], 10, 64)
+	timestamp, owner, nonce, requestID, err := parseQuote(quote)
+	if err != nil {
+		return nil, err
+	}
 	return &OrderbookMsg{
 		Timestamp: timestamp,
 		Type:      quote["type"],
@@ -87,48 +229,188 @@ func NewOrderbookMsg(quote map[string]string) (*OrderbookMsg, error) {
 		TradeID:   quote["trade_id"],
 		PairName:  quote["pair_name"],
 		OrderID:   quote["order_id"],
-	}, err
+		Owner:     owner,
+		Nonce:     nonce,
+		RequestID: requestID,
+	}, nil
 }
 
-// func NewOrderbookCancelMsg(quote map[string]string) (*OrderbookCancelMsg, error) {
-// 	timestamp, err := strconv.ParseUint(quote["timestamp"], 10, 64)
-// 	return &OrderbookCancelMsg{
-// 		Timestamp: timestamp,
-// 		Side:      quote["side"],
-// 		Price:     quote["price"],
-// 		PairName:  quote["pair_name"],
-// 		OrderID:   quote["order_id"],
-// 	}, err
-// }
+func NewOrderbookCancelMsg(quote map[string]string) (*OrderbookCancelMsg, error) {
+	timestamp, owner, nonce, requestID, err := parseQuote(quote)
+	if err != nil {
+		return nil, err
+	}
+	return &OrderbookCancelMsg{
+		Timestamp: timestamp,
+		Side:      quote["side"],
+		Price:     quote["price"],
+		PairName:  quote["pair_name"],
+		OrderID:   quote["order_id"],
+		Owner:     owner,
+		Nonce:     nonce,
+		RequestID: requestID,
+	}, nil
+}
 
+func NewOrderbookAmendMsg(quote map[string]string) (*OrderbookAmendMsg, error) {
+	timestamp, owner, nonce, requestID, err := parseQuote(quote)
+	if err != nil {
+		return nil, err
+	}
+	return &OrderbookAmendMsg{
+		Timestamp: timestamp,
+		Type:      quote["type"],
+		Side:      quote["side"],
+		Quantity:  quote["quantity"],
+		Price:     quote["price"],
+		TradeID:   quote["trade_id"],
+		PairName:  quote["pair_name"],
+		OrderID:   quote["order_id"],
+		Owner:     owner,
+		Nonce:     nonce,
+		RequestID: requestID,
+	}, nil
+}
+
+func NewOrderbookMassCancelMsg(quote map[string]string) (*OrderbookMassCancelMsg, error) {
+	timestamp, owner, nonce, requestID, err := parseQuote(quote)
+	if err != nil {
+		return nil, err
+	}
+	return &OrderbookMassCancelMsg{
+		Timestamp: timestamp,
+		PairName:  quote["pair_name"],
+		Owner:     owner,
+		Nonce:     nonce,
+		RequestID: requestID,
+	}, nil
+}
+
+// checkNewOrder : before version 43 cancel and update were sent as orders, they are rejected now
+// instead of being guessed from the fields
+func (msg *OrderbookMsg) checkNewOrder() error {
+	if msg.TradeID == "" {
+		return fmt.Errorf("Order without trade id is ambiguous, use a cancel message")
+	}
+	if msg.OrderID != "" && msg.OrderID != "0" {
+		return fmt.Errorf("Order with order id %s is ambiguous, use an amend message", msg.OrderID)
+	}
+	return nil
+}
+
+// OrderbookHandshake : first message of both peers, peers with another version or other pairs are disconnected.
+// State root and sequence tell whether the engines have applied the same operations, the books synced from
+// the peer are checked with the roots of the pairs. Sequencer is the address of the sequencer, zero when
+// the requests are processed on arrival
 type OrderbookHandshake struct {
-	Nick string
-	V    uint
+	Nick      string
+	V         uint
+	Pairs     []string
+	PairRoots []common.Hash
+	StateRoot common.Hash
+	Sequence  uint64
+	Sequencer common.Address
+}
+
+// newHandshake : handshake with the current state of the engine
+func newHandshake(nick string, engine *orderbook.Engine) *OrderbookHandshake {
+	pairs, roots := engine.PairRoots()
+	return &OrderbookHandshake{
+		Nick:      nick,
+		V:         ProtocolVersion,
+		Pairs:     pairs,
+		PairRoots: roots,
+		StateRoot: orderbook.PairsRoot(pairs, roots),
+		Sequence:  engine.Sequence(),
+	}
 }
 
 // the protocols abstraction enables use of an external handler function
 type OrderbookHandler struct {
 	Engine *orderbook.Engine
 	Peer   *protocols.Peer
-	InC    <-chan interface{}
-	QuitC  <-chan struct{}
+	// Remote : handshake of the peer
+	Remote *OrderbookHandshake
+	// peers : accepted requests are relayed to the other peers, nil if the handler is not registered
+	peers *peerSet
+	// limiter : limits and score of the peer
+	limiter *peerLimiter
+	// sendC : messages waiting to be sent to the peer, nil to send them at once
+	sendC chan interface{}
 }
 
 // checkProtoHandshake verifies local and remote protoHandshakes match
-func checkProtoHandshake(testVersion uint) func(interface{}) error {
+func checkProtoHandshake(local *OrderbookHandshake) func(interface{}) error {
 	return func(rhs interface{}) error {
 		remote, ok := rhs.(*OrderbookHandshake)
-
-		if ok && remote.V != testVersion {
-			return fmt.Errorf("%d (!= %d)", remote.V, testVersion)
+		if !ok {
+			return fmt.Errorf("Expected handshake, got :%T", rhs)
+		}
+		if remote.V != local.V {
+			return fmt.Errorf("Protocol version %d (!= %d)", remote.V, local.V)
+		}
+		// orders of a pair unknown by one of the peers would be rejected by it
+		if strings.Join(remote.Pairs, ",") != strings.Join(local.Pairs, ",") {
+			return fmt.Errorf("Pairs %v (!= %v)", remote.Pairs, local.Pairs)
+		}
+		// roots of the pairs are the ones of the state root
+		if root := orderbook.PairsRoot(remote.Pairs, remote.PairRoots); root != remote.StateRoot {
+			return fmt.Errorf("State root %s of the pairs (!= %s)", root.Hex(), remote.StateRoot.Hex())
+		}
+		// peers with another sequencer apply the requests in another order
+		if remote.Sequencer != local.Sequencer {
+			return fmt.Errorf("Sequencer %s (!= %s)", remote.Sequencer.Hex(), local.Sequencer.Hex())
+		}
+		// same operations must give the same books
+		if remote.Sequence == local.Sequence && remote.StateRoot != local.StateRoot {
+			return fmt.Errorf("State root %s (!= %s) at sequence %d", remote.StateRoot.Hex(), local.StateRoot.Hex(), local.Sequence)
 		}
 		return nil
 	}
 }
 
-func (orderbookHandler *OrderbookHandler) handleOrderbookMsg(message *OrderbookMsg) error {
-	if message.TradeID == "" {
-		return orderbookHandler.handleOrderbookCancelMsg(message)
+// newAck : accept the request, trades are converted from the records of the engine
+func newAck(requestID uint64, hash common.Hash, orderID string, trades []map[string]string) *OrderbookAckMsg {
+	ack := &OrderbookAckMsg{
+		RequestID:  requestID,
+		Hash:       hash,
+		OrderID:    orderID,
+		TradeCount: uint64(len(trades)),
+	}
+	for _, trade := range trades {
+		timestamp, _ := strconv.ParseUint(trade["timestamp"], 10, 64)
+		ack.Trades = append(ack.Trades, OrderbookTrade{
+			Price:     trade["price"],
+			Quantity:  trade["quantity"],
+			Timestamp: timestamp,
+		})
+	}
+	// keep the first trades that fit
+	all := ack.Trades
+	count := sort.Search(len(all)+1, func(i int) bool {
+		ack.Trades = all[:i]
+		data, err := rlp.EncodeToBytes(ack)
+		return err != nil || len(data) > maxAckSize
+	}) - 1
+	if count < 0 {
+		count = 0
+	}
+	ack.Trades = all[:count]
+	return ack
+}
+
+func newReject(requestID uint64, hash common.Hash, err error) *OrderbookRejectMsg {
+	return &OrderbookRejectMsg{
+		RequestID: requestID,
+		Hash:      hash,
+		Reason:    err.Error(),
+	}
+}
+
+func (orderbookHandler *OrderbookHandler) handleOrderbookMsg(message *OrderbookMsg) interface{} {
+	if err := message.checkNewOrder(); err != nil {
+		demo.LogWarn("Rejected order", "order", message, "peer", orderbookHandler.Peer, "err", err)
+		return newReject(message.RequestID, message.Hash(), err)
 	}
 	demo.LogDebug("Received order", "order", message, "peer", orderbookHandler.Peer)
 
@@ -136,12 +418,16 @@ func (orderbookHandler *OrderbookHandler) handleOrderbookMsg(message *OrderbookM
 	payload := message.ToQuote()
 	demo.LogInfo("-> Add order", "payload", payload)
 
-	trades, orderInBook := orderbookHandler.Engine.ProcessOrder(payload)
-	demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook)
-	return nil
+	trades, orderInBook, err := orderbookHandler.Engine.ProcessQuote(payload)
+	demo.LogInfo("Orderbook result", "Trade", trades, "OrderInBook", orderInBook, "err", err)
+	if err != nil {
+		return newReject(message.RequestID, message.Hash(), err)
+	}
+	// the engine sets the id even if the order is fully matched
+	return newAck(message.RequestID, message.Hash(), payload["order_id"], trades)
 }
 
-func (orderbookHandler *OrderbookHandler) handleOrderbookCancelMsg(message *OrderbookMsg) error {
+func (orderbookHandler *OrderbookHandler) handleOrderbookCancelMsg(message *OrderbookCancelMsg) interface{} {
 	demo.LogDebug("Received cancel order", "cancel_order", message, "peer", orderbookHandler.Peer)
 
 	// cancel Order
@@ -150,35 +436,178 @@ func (orderbookHandler *OrderbookHandler) handleOrderbookCancelMsg(message *Orde
 
 	err := orderbookHandler.Engine.CancelOrder(payload)
 	demo.LogInfo("Orderbook result", "err", err)
+	if err != nil {
+		return newReject(message.RequestID, message.Hash(), err)
+	}
+	return newAck(message.RequestID, message.Hash(), message.OrderID, nil)
+}
+
+func (orderbookHandler *OrderbookHandler) handleOrderbookAmendMsg(message *OrderbookAmendMsg) interface{} {
+	demo.LogDebug("Received amend order", "amend_order", message, "peer", orderbookHandler.Peer)
+	if message.OrderID == "" || message.OrderID == "0" {
+		demo.LogWarn("Rejected amend without order id", "amend_order", message, "peer", orderbookHandler.Peer)
+		return newReject(message.RequestID, message.Hash(), fmt.Errorf("Amend without order id"))
+	}
+
+	// update Order
+	payload := message.ToQuote()
+	demo.LogInfo("-> Update order", "payload", payload)
+
+	_, _, err := orderbookHandler.Engine.ProcessQuote(payload)
+	demo.LogInfo("Orderbook result", "err", err)
+	if err != nil {
+		return newReject(message.RequestID, message.Hash(), err)
+	}
+	return newAck(message.RequestID, message.Hash(), message.OrderID, nil)
+}
+
+func (orderbookHandler *OrderbookHandler) handleOrderbookMassCancelMsg(message *OrderbookMassCancelMsg) interface{} {
+	demo.LogDebug("Received mass cancel", "mass_cancel", message, "peer", orderbookHandler.Peer)
+
+	payload := message.ToQuote()
+	demo.LogInfo("-> Cancel orders below nonce", "payload", payload)
+
+	count, err := orderbookHandler.Engine.CancelOrdersBelowNonce(payload)
+	demo.LogInfo("Orderbook result", "cancelled", count, "err", err)
+	if err != nil {
+		return newReject(message.RequestID, message.Hash(), err)
+	}
+	ack := newAck(message.RequestID, message.Hash(), "", nil)
+	ack.Cancelled = count
+	return ack
+}
+
+func (orderbookHandler *OrderbookHandler) handleOrderbookAckMsg(message *OrderbookAckMsg) error {
+	demo.LogInfo("Order accepted", "request_id", message.RequestID, "hash", message.Hash.Hex(),
+		"order_id", message.OrderID, "trades", message.TradeCount, "cancelled", message.Cancelled, "peer", orderbookHandler.Peer)
 	return nil
 }
 
-func (orderbookHandler *OrderbookHandler) handleOrderbookHandshake(orderbookhs *OrderbookHandshake) error {
-	demo.LogDebug("Processing handshake", "from", orderbookhs.Nick, "version", orderbookhs.V)
-
-	// now protocol is ok, we can inject channel to receive message
-	go func() {
-		for {
-			select {
-			case payload := <-orderbookHandler.InC:
-				// demo.LogInfo("Internal received", "payload", payload)
-				inmsg, ok := payload.(*OrderbookMsg)
-				if ok {
-					// maybe we have to use map[]chan
-					// databytes, err := rlp.EncodeToBytes(inmsg)
-					// databytes, err := json.Marshal(inmsg)
-
-					demo.LogDebug("Sending orderbook", "orderbook", inmsg)
-					orderbookHandler.Peer.Send(inmsg)
-
-				}
-
-			// send quit command, break this loop
-			case <-orderbookHandler.QuitC:
-				break
-			}
+func (orderbookHandler *OrderbookHandler) handleOrderbookRejectMsg(message *OrderbookRejectMsg) error {
+	// sync requests are not signed, the peer can not send the journal or the book
+	if message.Hash == (common.Hash{}) && orderbookHandler.peers != nil {
+		s := orderbookHandler.peers.sync
+		if name, state := s.getByRequest(orderbookHandler, message.RequestID); state != nil {
+			s.retry(name, state, fmt.Errorf("%s", message.Reason))
+			return nil
+		}
+		// the peer does not have the missing sequenced requests anymore
+		if seq := orderbookHandler.peers.sequencer; seq != nil && seq.gapRejected(orderbookHandler, message.RequestID) {
+			demo.LogWarn("Sequence request rejected, sync the books", "reason", message.Reason, "peer", orderbookHandler.Peer)
+			s.start(orderbookHandler)
+			return nil
+		}
+	}
+	demo.LogInfo("Order rejected", "request_id", message.RequestID, "hash", message.Hash.Hex(),
+		"reason", message.Reason, "peer", orderbookHandler.Peer)
+	return nil
+}
+
+// process : process the signed request, return the ack or reject for the sender
+func (orderbookHandler *OrderbookHandler) process(msg SignedMsg) interface{} {
+	// anyone can send a message, only the ones signed by their owner are processed
+	if err := msg.Verify(); err != nil {
+		demo.LogWarn("Rejected message", "msg", msg, "peer", orderbookHandler.Peer, "err", err)
+		orderbookHandler.penalise(scoreInvalid, err)
+		return newReject(requestID(msg), msg.Hash(), err)
+	}
+	if err := validate(msg); err != nil {
+		demo.LogWarn("Rejected message", "msg", msg, "peer", orderbookHandler.Peer, "err", err)
+		orderbookHandler.penalise(scoreInvalid, err)
+		return newReject(requestID(msg), msg.Hash(), err)
+	}
+	// relayed messages come back from other peers, there is nothing to reply
+	if orderbookHandler.peers != nil && !orderbookHandler.peers.markSeen(msg.Hash()) {
+		demo.LogDebug("Message already seen", "hash", msg.Hash().Hex(), "peer", orderbookHandler.Peer)
+		return nil
+	}
+	// the sequencer processes the request, the other nodes forward it and apply it when it comes back sequenced
+	if peers := orderbookHandler.peers; peers != nil && peers.sequencer != nil {
+		if peers.sequencer.leader() {
+			return peers.sequencer.sequence(orderbookHandler, msg)
+		}
+		peers.relay(msg, orderbookHandler.Peer)
+		return nil
+	}
+	// messages of a pair that is syncing are processed when it goes live
+	if orderbookHandler.peers != nil {
+		buffered, err := orderbookHandler.peers.sync.buffer(orderbookHandler, msg)
+		if err != nil {
+			// the message can be sent again when the pair is live
+			orderbookHandler.peers.forget(msg.Hash())
+			return newReject(requestID(msg), msg.Hash(), err)
+		}
+		if buffered {
+			demo.LogDebug("Message buffered until sync", "hash", msg.Hash().Hex(), "peer", orderbookHandler.Peer)
+			return nil
 		}
-	}()
+	}
+	return orderbookHandler.dispatch(msg)
+}
+
+// dispatch : process the verified request
+func (orderbookHandler *OrderbookHandler) dispatch(msg SignedMsg) interface{} {
+	switch message := msg.(type) {
+	case *OrderbookMsg:
+		return orderbookHandler.handleOrderbookMsg(message)
+	case *OrderbookCancelMsg:
+		return orderbookHandler.handleOrderbookCancelMsg(message)
+	case *OrderbookAmendMsg:
+		return orderbookHandler.handleOrderbookAmendMsg(message)
+	case *OrderbookMassCancelMsg:
+		return orderbookHandler.handleOrderbookMassCancelMsg(message)
+	default:
+		return newReject(requestID(msg), msg.Hash(), fmt.Errorf("Unknown orderbook request type :%T", msg))
+	}
+}
+
+// requestID : request id of the signed message, 0 if it has none
+func requestID(msg SignedMsg) uint64 {
+	switch message := msg.(type) {
+	case *OrderbookMsg:
+		return message.RequestID
+	case *OrderbookCancelMsg:
+		return message.RequestID
+	case *OrderbookAmendMsg:
+		return message.RequestID
+	case *OrderbookMassCancelMsg:
+		return message.RequestID
+	}
+	return 0
+}
+
+// respond : relay the accepted request to the other peers, then reply to the sender
+func (orderbookHandler *OrderbookHandler) respond(msg SignedMsg, reply interface{}) error {
+	if orderbookHandler.relays(reply) {
+		orderbookHandler.peers.broadcast(msg, orderbookHandler.Peer)
+	}
+	return orderbookHandler.reply(reply)
+}
+
+// relays : the request with the reply is relayed to the other peers. The sequencer relays the sequenced
+// request instead
+func (orderbookHandler *OrderbookHandler) relays(reply interface{}) bool {
+	_, ok := reply.(*OrderbookAckMsg)
+	return ok && orderbookHandler.peers != nil && orderbookHandler.peers.sequencer == nil
+}
+
+// reply : send the reply back to the peer of the request
+func (orderbookHandler *OrderbookHandler) reply(msg interface{}) error {
+	if orderbookHandler.Peer == nil || msg == nil {
+		return nil
+	}
+	demo.LogDebug("Sending reply", "reply", msg, "peer", orderbookHandler.Peer)
+	return orderbookHandler.send(msg)
+}
+
+// handleOrderbookHandshake : the handshake is verified, keep the state of the peer
+func (orderbookHandler *OrderbookHandler) handleOrderbookHandshake(orderbookhs *OrderbookHandshake) error {
+	demo.LogDebug("Processing handshake", "from", orderbookhs.Nick, "version", orderbookhs.V,
+		"pairs", orderbookhs.Pairs, "root", orderbookhs.StateRoot.Hex(), "sequence", orderbookhs.Sequence)
+	orderbookHandler.Remote = orderbookhs
+	if local := orderbookHandler.Engine.Sequence(); orderbookhs.Sequence != local {
+		demo.LogWarn("Peer is at another sequence", "peer", orderbookHandler.Peer, "remote", orderbookhs.Sequence, "local", local)
+	}
 	return nil
 }
 
@@ -189,24 +618,59 @@ func (orderbookHandler *OrderbookHandler) handle(msg interface{}) error {
 
 	// demo.LogWarn("Inbout", "inbout", orderbookHandler.Peer.Inbound())
 
+	// requests are replied with an ack or a reject, the accepted ones are relayed
+	if signed, ok := msg.(SignedMsg); ok {
+		return orderbookHandler.respond(signed, orderbookHandler.process(signed))
+	}
+
 	switch messageType := msg.(type) {
-	case *OrderbookMsg:
-		return orderbookHandler.handleOrderbookMsg(msg.(*OrderbookMsg))
-	// case *OrderbookCancelMsg:
-	// 	return orderbookHandler.handleOrderbookCancelMsg(msg.(*OrderbookCancelMsg))
+	case *OrderbookSyncRequestMsg:
+		return orderbookHandler.handleOrderbookSyncRequestMsg(messageType)
+	case *OrderbookSnapshotMsg:
+		return orderbookHandler.handleOrderbookSnapshotMsg(messageType)
+	case *OrderbookJournalMsg:
+		return orderbookHandler.handleOrderbookJournalMsg(messageType)
+	case *OrderbookSequencedMsg:
+		return orderbookHandler.handleOrderbookSequencedMsg(messageType)
+	case *OrderbookSequenceRequestMsg:
+		return orderbookHandler.handleOrderbookSequenceRequestMsg(messageType)
+	case *OrderbookBatchMsg:
+		return orderbookHandler.handleOrderbookBatchMsg(messageType)
+	case *OrderbookAckMsg:
+		return orderbookHandler.handleOrderbookAckMsg(msg.(*OrderbookAckMsg))
+	case *OrderbookRejectMsg:
+		return orderbookHandler.handleOrderbookRejectMsg(msg.(*OrderbookRejectMsg))
 	case *OrderbookHandshake:
-		return orderbookHandler.handleOrderbookHandshake(msg.(*OrderbookHandshake))
+		// the handshake is done before the run loop
+		return fmt.Errorf("Unexpected handshake from :%s", messageType.Nick)
 	default:
 		return fmt.Errorf("Unknown orderbook message type :%v", messageType)
 	}
 
 }
 
-// create the protocol with the protocols extension
-func NewProtocol(inC <-chan interface{}, quitC <-chan struct{}, orderbookEngine *orderbook.Engine) *p2p.Protocol {
+// create the protocol with the protocols extension, requests are ordered by the sequencer of the config,
+// or processed on arrival when it is nil. Peers have the default limits when limits is nil
+func NewProtocol(inC <-chan interface{}, quitC <-chan struct{}, orderbookEngine *orderbook.Engine, sequencerConfig *SequencerConfig, limits *PeerLimits) *p2p.Protocol {
+	proto, _ := newProtocol(inC, quitC, orderbookEngine, sequencerConfig, limits)
+	return proto
+}
+
+// newProtocol : protocol and the set of its peers
+func newProtocol(inC <-chan interface{}, quitC <-chan struct{}, orderbookEngine *orderbook.Engine, sequencerConfig *SequencerConfig, limits *PeerLimits) (*p2p.Protocol, *peerSet) {
+	// messages of the node are sent to all connected peers
+	peers := newPeerSet()
+	if limits != nil {
+		peers.limits = *limits
+	}
+	if sequencerConfig != nil {
+		peers.setSequencer(sequencerConfig, orderbookEngine)
+	}
+	go peers.run(inC, quitC)
+
 	return &p2p.Protocol{
 		Name:    "Orderbook",
-		Version: 42,
+		Version: ProtocolVersion,
 		// we may use more 1 custom message code
 		Length: uint64(len(OrderbookProtocol.Messages)),
 		// Length: 2,
@@ -214,49 +678,55 @@ func NewProtocol(inC <-chan interface{}, quitC <-chan struct{}, orderbookEngine
 
 			// demo.LogWarn("running", "peer", p)
 
-			var err error
+			if peers.isBanned(p.ID()) {
+				demo.LogWarn("Banned peer", "peer", p)
+				return errPeerBanned
+			}
+
 			// create the enhanced peer, it will wrap p2p.Send with code from Message Spec
-			pp := protocols.NewPeer(p, rw, OrderbookProtocol)
-
-			// send the message, then handle it to make sure protocol success
-			go func() {
-				outmsg := &OrderbookHandshake{
-					V: 42,
-					// shortened hex string for terminal logging
-					Nick: p.Name(),
-				}
-
-				// check handshake, should sleep a little bit before sending handshake so that
-				// we can run handle first
-				// ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-				// defer cancel()
-				// hsCheck := checkProtoHandshake(outmsg.V)
-				// _, err = pp.Handshake(ctx, outmsg, hsCheck)
-				// if err != nil {
-				// 	return
-				// }
-
-				// sleep a second
-				time.Sleep(time.Second)
-
-				err = pp.Send(outmsg)
-				if err != nil {
-					demo.LogError("Send p2p message fail", "err", err)
-				}
-				demo.LogInfo("Sending handshake", "peer", p, "handshake", outmsg)
-			}()
+			// messages over the limits of the peer are dropped
+			limiter := newPeerLimiter(peers.limits)
+			pp := protocols.NewPeer(p, &limitedRW{MsgReadWriter: rw, limiter: limiter, peers: peers, id: p.ID()}, OrderbookProtocol)
+
+			// exchange the handshake, a peer that does not match is disconnected
+			outmsg := newHandshake(p.Name(), orderbookEngine)
+			if sequencerConfig != nil {
+				outmsg.Sequencer = sequencerConfig.Address
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), HandshakeTimeout)
+			defer cancel()
+			hs, err := pp.Handshake(ctx, outmsg, checkProtoHandshake(outmsg))
+			if err != nil {
+				demo.LogWarn("Orderbook handshake failed", "peer", p, "err", err)
+				return err
+			}
+			demo.LogInfo("Orderbook handshake", "peer", p, "handshake", hs)
 
 			// protocols abstraction provides a separate blocking run loop for the peer
 			// when this returns, the protocol will be terminated
 			run := &OrderbookHandler{
-				Engine: orderbookEngine,
-				Peer:   pp,
-				// assign channel
-				InC:   inC,
-				QuitC: quitC,
+				Engine:  orderbookEngine,
+				Peer:    pp,
+				limiter: limiter,
+				sendC:   make(chan interface{}, sendQueueSize),
+			}
+			sendQuitC := make(chan struct{})
+			defer close(sendQuitC)
+			go run.sendLoop(sendQuitC)
+			run.handleOrderbookHandshake(hs.(*OrderbookHandshake))
+			if err := peers.register(run); err != nil {
+				return err
 			}
-			err = pp.Run(run.handle)
-			return err
+			// the peer is removed when it disconnects
+			defer peers.unregister(run)
+			// the books are imported from a peer that is ahead
+			if local := orderbookEngine.Sequence(); run.Remote.Sequence > local {
+				peers.sync.start(run)
+			} else if run.Remote.Sequence == local {
+				// pairs left by a peer that failed sync from this one
+				peers.sync.adopt(run)
+			}
+			return pp.Run(run.handle)
 		},
-	}
+	}, peers
 }
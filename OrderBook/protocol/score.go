@@ -0,0 +1,229 @@
+package protocol
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	demo "github.com/tomochain/orderbook/common"
+)
+
+// Each peer has token buckets for the messages and the bytes it sends, messages over them are dropped before
+// they are decoded. Sequenced requests are signed by the sequencer and sync replies answer a request of the node,
+// they are not limited: a peer is disconnected for a sequenced request the sequencer did not sign, and only the
+// sync replies that answer no request are limited when they are handled. Dropped messages and requests that are
+// not correct add to the score of the peer, it is disconnected and banned when its score reaches the ban score.
+// The score decays with time, so a peer that relays a bad message now and then is not banned.
+
+// PeerLimits : limits of each peer, rates are per second and a zero rate is not limited. Byte burst should
+// not be lower than the max message size, a larger message takes all tokens
+type PeerLimits struct {
+	MsgRate    float64
+	MsgBurst   float64
+	ByteRate   float64
+	ByteBurst  float64
+	BanScore   float64
+	ScoreDecay float64
+	BanTime    time.Duration
+}
+
+// DefaultPeerLimits : a market maker can send a few full batches at once, a book of any size can be synced
+// from a peer as its replies are not limited
+var DefaultPeerLimits = PeerLimits{
+	MsgRate:    500,
+	MsgBurst:   2000,
+	ByteRate:   512 * 1024,
+	ByteBurst:  2 * 1024 * 1024,
+	BanScore:   100,
+	ScoreDecay: 1,
+	BanTime:    time.Hour,
+}
+
+// scores of the misbehaviours
+const (
+	// scoreRateLimited : message dropped by the limits
+	scoreRateLimited = 1
+	// scoreInvalid : request with a wrong signature or fields the engine can not parse
+	scoreInvalid = 10
+	// scoreMalformed : message that can not be decoded, or sequenced request not signed by the sequencer
+	scoreMalformed = 50
+)
+
+// handleLimitedCodes : messages that are limited when they are handled instead of when they are read, the items
+// of a batch are limited like they were sent alone
+var handleLimitedCodes = messageCodes(&OrderbookSequencedMsg{}, &OrderbookSnapshotMsg{}, &OrderbookJournalMsg{},
+	&OrderbookBatchMsg{})
+
+var (
+	errRateLimited = errors.New("Peer sends too many messages")
+	errPeerBanned  = errors.New("Peer is banned")
+)
+
+// tokenBucket : tokens are added at the rate up to the burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// take : take the tokens, return false if there are not enough
+func (bucket *tokenBucket) take(n float64, now time.Time) bool {
+	if bucket.rate <= 0 {
+		return true
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * bucket.rate
+		if bucket.tokens > bucket.burst {
+			bucket.tokens = bucket.burst
+		}
+	}
+	bucket.last = now
+	if n > bucket.burst {
+		n = bucket.burst
+	}
+	if bucket.tokens < n {
+		return false
+	}
+	bucket.tokens -= n
+	return true
+}
+
+// peerLimiter : limits and score of a peer
+type peerLimiter struct {
+	limits PeerLimits
+	// now : time of the buckets and the score decay
+	now    func() time.Time
+	lock   sync.Mutex
+	msgs   *tokenBucket
+	bytes  *tokenBucket
+	score  float64
+	scored time.Time
+	banned bool
+}
+
+func newPeerLimiter(limits PeerLimits) *peerLimiter {
+	now := time.Now()
+	return &peerLimiter{
+		limits: limits,
+		now:    time.Now,
+		msgs:   newTokenBucket(limits.MsgRate, limits.MsgBurst, now),
+		bytes:  newTokenBucket(limits.ByteRate, limits.ByteBurst, now),
+		scored: now,
+	}
+}
+
+// allow : take the tokens of the messages and their size, return false if the peer is over its limits
+func (limiter *peerLimiter) allow(msgs int, size uint32) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := limiter.now()
+	// both buckets are checked, a dropped message still uses the tokens of the first
+	return limiter.msgs.take(float64(msgs), now) && limiter.bytes.take(float64(size), now)
+}
+
+// penalise : add to the score, return the score and true the first time it reaches the ban score
+func (limiter *peerLimiter) penalise(points float64) (float64, bool) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := limiter.now()
+	if elapsed := now.Sub(limiter.scored).Seconds(); elapsed > 0 {
+		limiter.score -= elapsed * limiter.limits.ScoreDecay
+		if limiter.score < 0 {
+			limiter.score = 0
+		}
+	}
+	limiter.scored = now
+	limiter.score += points
+	if limiter.limits.BanScore <= 0 || limiter.score < limiter.limits.BanScore || limiter.banned {
+		return limiter.score, false
+	}
+	limiter.banned = true
+	return limiter.score, true
+}
+
+// limitedRW : messages over the limits of the peer are dropped before they are decoded
+type limitedRW struct {
+	p2p.MsgReadWriter
+	limiter *peerLimiter
+	peers   *peerSet
+	id      discover.NodeID
+}
+
+// ReadMsg : next message within the limits, an error when the peer is banned
+func (rw *limitedRW) ReadMsg() (p2p.Msg, error) {
+	for {
+		msg, err := rw.MsgReadWriter.ReadMsg()
+		if err != nil || handleLimitedCodes[msg.Code] || rw.limiter.allow(1, msg.Size) {
+			return msg, err
+		}
+		msg.Discard()
+		score, ban := rw.limiter.penalise(scoreRateLimited)
+		demo.LogDebug("Message dropped", "code", msg.Code, "size", msg.Size, "peer", rw.id.TerminalString(), "score", score)
+		if ban {
+			rw.peers.ban(rw.id, errRateLimited)
+			return msg, errRateLimited
+		}
+	}
+}
+
+// limit : take the tokens of messages limited when they are handled, return false and penalise the peer
+// when it is over its limits
+func (orderbookHandler *OrderbookHandler) limit(msgs int, size int) bool {
+	limiter := orderbookHandler.limiter
+	if limiter == nil || msgs == 0 || limiter.allow(msgs, uint32(size)) {
+		return true
+	}
+	orderbookHandler.penalise(scoreRateLimited*float64(msgs), errRateLimited)
+	return false
+}
+
+// messageCodes : codes of the messages of the protocol
+func messageCodes(msgs ...interface{}) map[uint64]bool {
+	codes := make(map[uint64]bool, len(msgs))
+	for _, msg := range msgs {
+		if code, ok := OrderbookProtocol.GetCode(msg); ok {
+			codes[code] = true
+		}
+	}
+	return codes
+}
+
+// penalise : add to the score of the peer, it is disconnected and banned when it reaches the ban score
+func (orderbookHandler *OrderbookHandler) penalise(points float64, err error) {
+	if orderbookHandler.peers == nil || orderbookHandler.limiter == nil {
+		return
+	}
+	score, ban := orderbookHandler.limiter.penalise(points)
+	demo.LogWarn("Peer misbehaves", "peer", orderbookHandler.Peer, "score", score, "err", err)
+	if ban {
+		orderbookHandler.peers.ban(orderbookHandler.Peer.ID(), err)
+		orderbookHandler.Peer.Drop(err)
+	}
+}
+
+// ban : the peer can not connect until the ban time is over
+func (ps *peerSet) ban(id discover.NodeID, err error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.banned[id] = time.Now().Add(ps.limits.BanTime)
+	demo.LogWarn("Peer banned", "peer", id.TerminalString(), "until", ps.banned[id], "err", err)
+}
+
+// isBanned : the ban of the peer is not over
+func (ps *peerSet) isBanned(id discover.NodeID) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	until, ok := ps.banned[id]
+	if ok && time.Now().After(until) {
+		delete(ps.banned, id)
+		return false
+	}
+	return ok
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1000, 0)
+	bucket := newTokenBucket(10, 20, now)
+	if !bucket.take(20, now) || bucket.take(1, now) {
+		t.Fatal("burst must be taken at once, then nothing")
+	}
+	// 10 tokens per second
+	if !bucket.take(5, now.Add(500*time.Millisecond)) || bucket.take(1, now.Add(500*time.Millisecond)) {
+		t.Error("tokens must be added at the rate")
+	}
+	// up to the burst
+	if !bucket.take(20, now.Add(time.Hour)) || bucket.take(1, now.Add(time.Hour)) {
+		t.Error("tokens must not be more than the burst")
+	}
+	// more than the burst takes all tokens
+	if !bucket.take(100, now.Add(2*time.Hour)) || bucket.take(1, now.Add(2*time.Hour)) {
+		t.Error("message larger than the burst must take all tokens")
+	}
+	if !newTokenBucket(0, 0, now).take(1000, now) {
+		t.Error("zero rate must not be limited")
+	}
+}
+
+func TestPeerScore(t *testing.T) {
+	engine := orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	ps := newPeerSet()
+	ps.limits.BanScore, ps.limits.ScoreDecay = 30, 10
+	a := newTestPeer(t, ps, engine, 1)
+	now := time.Unix(1000, 0)
+	a.handler.limiter.now = func() time.Time { return now }
+
+	key, _ := crypto.GenerateKey()
+	order := func(nonce uint64, price, quantity string) *OrderbookMsg {
+		msg := &OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Ask,
+			Quantity: quantity, Price: price, TradeID: "1", Timestamp: nonce, Nonce: nonce}
+		if err := msg.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	// the engine would read the price as 0
+	for i, msg := range []*OrderbookMsg{order(1, "1O1", "1"), order(2, "101", "-1")} {
+		if err := a.handler.handle(msg); err != nil {
+			t.Fatal(err)
+		}
+		a.expect(t, &OrderbookRejectMsg{})
+		if score := a.handler.limiter.score; score != float64(scoreInvalid*(i+1)) {
+			t.Errorf("score incorrect, got: %v", score)
+		}
+	}
+	if engine.Sequence() != 0 {
+		t.Fatal("request that is not correct must not be processed")
+	}
+	// correct requests are relayed, and not penalised when the engine rejects them
+	b := newTestPeer(t, ps, engine, 2)
+	if err := a.handler.handle(order(3, "101", "1")); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(t, &OrderbookAckMsg{})
+	b.expect(t, &OrderbookMsg{})
+	if err := a.handler.handle(order(3, "102", "1")); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(t, &OrderbookRejectMsg{})
+	b.expect(t)
+	if score := a.handler.limiter.score; score != 2*scoreInvalid {
+		t.Errorf("request rejected by the engine must not be penalised, got score: %v", score)
+	}
+
+	// the score decays with time
+	now = now.Add(time.Second)
+	if err := a.handler.handle(&OrderbookCancelMsg{PairName: "TOMO/WETH", OrderID: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(t, &OrderbookRejectMsg{})
+	if score := a.handler.limiter.score; score != 2*scoreInvalid {
+		t.Errorf("score must decay, got: %v", score)
+	}
+
+	// banned when the score reaches the threshold
+	if err := a.handler.handle(order(4, "", "1")); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(t, &OrderbookRejectMsg{})
+	if !ps.isBanned(a.handler.Peer.ID()) {
+		t.Fatal("peer must be banned")
+	}
+	ps.unregister(a.handler)
+	if err := ps.register(a.handler); err != errPeerBanned {
+		t.Errorf("banned peer must not be registered, got: %v", err)
+	}
+	ps.limits.BanTime = 0
+	ps.ban(a.handler.Peer.ID(), errRateLimited)
+	if ps.isBanned(a.handler.Peer.ID()) {
+		t.Error("ban must be over after the ban time")
+	}
+}
+
+func TestLimitedRW(t *testing.T) {
+	ps := newPeerSet()
+	limiter := newPeerLimiter(PeerLimits{MsgRate: 1, MsgBurst: 2, ByteRate: 1, ByteBurst: 1024, BanScore: 3})
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+	local, remote := p2p.MsgPipe()
+	defer local.Close()
+	rw := &limitedRW{MsgReadWriter: local, limiter: limiter, peers: ps, id: discover.NodeID{1}}
+
+	go func() {
+		for i := 0; i < 8; i++ {
+			if err := p2p.Send(remote, 1, []uint{uint(i)}); err != nil {
+				return
+			}
+		}
+	}()
+	// the burst is read, then messages over the rate are dropped until the peer is banned
+	for i := 0; i < 2; i++ {
+		msg, err := rw.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Discard()
+	}
+	if _, err := rw.ReadMsg(); err != errRateLimited {
+		t.Fatalf("peer over the limits must be disconnected, got: %v", err)
+	}
+	if !ps.isBanned(discover.NodeID{1}) {
+		t.Error("peer over the limits must be banned")
+	}
+}
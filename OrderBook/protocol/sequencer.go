@@ -0,0 +1,355 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	demo "github.com/tomochain/orderbook/common"
+)
+
+// Requests racing on the network arrive in another order on each node, so the books diverge when each node
+// matches them on arrival. With a sequencer, nodes forward the signed requests to it, it processes them one
+// by one and sends each accepted one to all nodes, signed with the sequence of its engine after it. Nodes apply
+// the sequenced requests in the order of their sequence only, so all engines apply the same operations. A node
+// that misses sequences requests them from the peer that sent the next one, or syncs the books when the peer
+// does not have them anymore.
+
+const (
+	// sequencedLogLimit : sequenced requests kept to fill the gaps of peers
+	sequencedLogLimit = 4096
+	// sequencedPendingLimit : sequenced requests received ahead of the engine, a node further behind syncs the books
+	sequencedPendingLimit = 4096
+)
+
+var (
+	sequencedTypeHash = crypto.Keccak256Hash([]byte("Sequenced(uint256 sequence,uint256 code,bytes payload)"))
+
+	errSequencerSyncing = errors.New("Sequencer is syncing")
+	errNotSequencer     = errors.New("Message is not signed by the sequencer")
+)
+
+// SequencerConfig : the node with the key of the address orders the requests, the other nodes forward them to it
+// and have no key
+type SequencerConfig struct {
+	Address common.Address
+	Key     *ecdsa.PrivateKey
+}
+
+// OrderbookSequencedMsg : request accepted by the sequencer, the engine is at the sequence after applying it.
+// Payload is the rlp of the signed request, code is its message code
+type OrderbookSequencedMsg struct {
+	Sequence  uint64
+	Code      uint64
+	Payload   []byte
+	Signature []byte
+}
+
+// OrderbookSequenceRequestMsg : request the sequenced requests from a sequence to another, both included
+type OrderbookSequenceRequestMsg struct {
+	RequestID uint64
+	From      uint64
+	To        uint64
+}
+
+// Hash : hash of the sequenced request, it is what the sequencer signs
+func (msg *OrderbookSequencedMsg) Hash() common.Hash {
+	return typedHash(sequencedTypeHash, uintField(msg.Sequence), uintField(msg.Code), crypto.Keccak256(msg.Payload))
+}
+
+// Verify : the signature must be recovered to the sequencer
+func (msg *OrderbookSequencedMsg) Verify(sequencer common.Address) error {
+	if err := verifyHash(msg.Hash(), sequencer, msg.Signature); err != nil {
+		if err == errWrongSigner {
+			return errNotSequencer
+		}
+		return err
+	}
+	return nil
+}
+
+// request : decode the signed request, its owner signature is verified too
+func (msg *OrderbookSequencedMsg) request() (SignedMsg, error) {
+	val, ok := OrderbookProtocol.NewMsg(msg.Code)
+	if !ok {
+		return nil, fmt.Errorf("Unknown sequenced message code :%d", msg.Code)
+	}
+	request, ok := val.(SignedMsg)
+	if !ok {
+		return nil, fmt.Errorf("Sequenced message is not a request :%T", val)
+	}
+	if err := rlp.DecodeBytes(msg.Payload, request); err != nil {
+		return nil, err
+	}
+	return request, request.Verify()
+}
+
+// sequencer : order of the requests, shared by the handlers of all peers
+type sequencer struct {
+	config *SequencerConfig
+	// local : handler of the requests of the node
+	local *OrderbookHandler
+	// lock orders the requests on the sequencer, and the sequenced requests on the other nodes
+	lock sync.Mutex
+	// log : last sequenced requests, by sequence
+	log []*OrderbookSequencedMsg
+	// pending : sequenced requests received ahead of the engine
+	pending map[uint64]*OrderbookSequencedMsg
+	// requested : last sequence of the gap requested, the handler and the request id of the request
+	requested uint64
+	gapPeer   *OrderbookHandler
+	gapID     uint64
+}
+
+func newSequencer(config *SequencerConfig, local *OrderbookHandler) *sequencer {
+	return &sequencer{
+		config:  config,
+		local:   local,
+		pending: make(map[uint64]*OrderbookSequencedMsg),
+	}
+}
+
+// leader : the node orders the requests
+func (seq *sequencer) leader() bool {
+	return seq.config.Key != nil
+}
+
+// record : keep the sequenced request for the peers, the oldest ones are dropped
+func (seq *sequencer) record(msg *OrderbookSequencedMsg) {
+	seq.log = append(seq.log, msg)
+	if len(seq.log) > sequencedLogLimit {
+		seq.log = append([]*OrderbookSequencedMsg(nil), seq.log[len(seq.log)-sequencedLogLimit:]...)
+	}
+}
+
+// logged : sequenced requests of the log between the sequences, an error is returned when the first one
+// is not in the log anymore
+func (seq *sequencer) logged(from, to uint64) ([]*OrderbookSequencedMsg, error) {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	if len(seq.log) == 0 || seq.log[0].Sequence > from {
+		return nil, fmt.Errorf("Sequenced requests from %d are pruned", from)
+	}
+	var msgs []*OrderbookSequencedMsg
+	for _, msg := range seq.log {
+		if msg.Sequence >= from && msg.Sequence <= to {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// sequence : process the request on the sequencer, the accepted one is signed with the sequence of the engine
+// and sent to all peers. Requests are processed one by one, so the sequences are in the order of the engine
+func (seq *sequencer) sequence(handler *OrderbookHandler, msg SignedMsg) interface{} {
+	// the sequence of the engine is not the one of the peers until the books are synced
+	if handler.peers != nil && handler.peers.sync.syncing() {
+		return newReject(requestID(msg), msg.Hash(), errSequencerSyncing)
+	}
+	seq.lock.Lock()
+	reply := handler.dispatch(msg)
+	var sequenced *OrderbookSequencedMsg
+	if _, ok := reply.(*OrderbookAckMsg); ok {
+		var err error
+		if sequenced, err = seq.sign(handler.Engine.Sequence(), msg); err != nil {
+			demo.LogError("Sign sequenced request fail", "msg", msg, "err", err)
+		} else {
+			seq.record(sequenced)
+		}
+	}
+	seq.lock.Unlock()
+
+	// followers put them back in order if the sends race
+	if sequenced != nil && handler.peers != nil {
+		handler.peers.relay(sequenced, nil)
+	}
+	return reply
+}
+
+func (seq *sequencer) sign(sequence uint64, msg SignedMsg) (*OrderbookSequencedMsg, error) {
+	code, ok := OrderbookProtocol.GetCode(msg)
+	if !ok {
+		return nil, fmt.Errorf("Unknown orderbook request type :%T", msg)
+	}
+	payload, err := rlp.EncodeToBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	sequenced := &OrderbookSequencedMsg{Sequence: sequence, Code: code, Payload: payload}
+	sequenced.Signature, err = signHash(sequenced.Hash(), seq.config.Key)
+	return sequenced, err
+}
+
+// receive : keep the sequenced request from the peer of the handler, then apply the ones that are next
+func (seq *sequencer) receive(handler *OrderbookHandler, msg *OrderbookSequencedMsg) {
+	seq.lock.Lock()
+	next := handler.Engine.Sequence() + 1
+	if msg.Sequence < next {
+		// applied already, sent again by another peer
+		seq.lock.Unlock()
+		return
+	}
+	if msg.Sequence-next >= sequencedPendingLimit {
+		// too far behind, the books are imported
+		seq.pending = make(map[uint64]*OrderbookSequencedMsg)
+		seq.lock.Unlock()
+		demo.LogWarn("Sequenced request too far ahead", "sequence", msg.Sequence, "next", next, "peer", handler.Peer)
+		handler.peers.sync.start(handler)
+		return
+	}
+	seq.pending[msg.Sequence] = msg
+	seq.lock.Unlock()
+	seq.resume(handler)
+}
+
+// resume : apply the pending requests that are next, relay them, then request the missing ones from the peer
+// of the handler. The books are synced from the peer when the engine does not apply a request like the sequencer
+func (seq *sequencer) resume(handler *OrderbookHandler) {
+	peers := handler.peers
+	if peers.sync.syncing() {
+		return
+	}
+	var applied []*OrderbookSequencedMsg
+	var diverged error
+	var gap *OrderbookSequenceRequestMsg
+
+	seq.lock.Lock()
+	engine := handler.Engine
+	for sequence := range seq.pending {
+		if sequence <= engine.Sequence() {
+			delete(seq.pending, sequence)
+		}
+	}
+	for {
+		next := engine.Sequence() + 1
+		msg, ok := seq.pending[next]
+		if !ok {
+			break
+		}
+		delete(seq.pending, next)
+		request, err := msg.request()
+		if err == nil {
+			if reply, ok := handler.dispatch(request).(*OrderbookRejectMsg); ok {
+				err = errors.New(reply.Reason)
+			}
+		}
+		if err == nil && engine.Sequence() != msg.Sequence {
+			err = fmt.Errorf("Sequence is %d after sequenced request %d", engine.Sequence(), msg.Sequence)
+		}
+		if err != nil {
+			diverged = err
+			seq.pending = make(map[uint64]*OrderbookSequencedMsg)
+			break
+		}
+		seq.record(msg)
+		applied = append(applied, msg)
+	}
+	if diverged == nil && len(seq.pending) > 0 {
+		// requested once, the replies fill the gap
+		first := uint64(0)
+		for sequence := range seq.pending {
+			if first == 0 || sequence < first {
+				first = sequence
+			}
+		}
+		if first-1 > seq.requested {
+			seq.requested = first - 1
+			seq.gapPeer = handler
+			seq.gapID = peers.sync.nextRequestID()
+			gap = &OrderbookSequenceRequestMsg{RequestID: seq.gapID, From: engine.Sequence() + 1, To: first - 1}
+		}
+	}
+	seq.lock.Unlock()
+
+	for _, msg := range applied {
+		peers.relay(msg, handler.Peer)
+	}
+	if diverged != nil {
+		demo.LogError("Sequenced request not applied, sync the books", "peer", handler.Peer, "err", diverged)
+		peers.sync.start(handler)
+		return
+	}
+	if gap != nil {
+		demo.LogInfo("Request sequenced requests", "from", gap.From, "to", gap.To, "peer", handler.Peer)
+		if err := handler.reply(gap); err != nil {
+			demo.LogWarn("Send sequence request fail", "peer", handler.Peer, "err", err)
+		}
+	}
+}
+
+// gapRejected : the peer of the handler rejected the gap request, it does not have the sequenced requests
+func (seq *sequencer) gapRejected(handler *OrderbookHandler, requestID uint64) bool {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	if seq.gapPeer != handler || seq.gapID != requestID {
+		return false
+	}
+	seq.gapPeer, seq.requested = nil, 0
+	return true
+}
+
+// abort : the peer of the handler is gone, the gap is requested again from the peer of the next request
+func (seq *sequencer) abort(handler *OrderbookHandler) {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	if seq.gapPeer == handler {
+		seq.gapPeer, seq.requested = nil, 0
+	}
+}
+
+// pendingSequences : sequences received ahead of the engine, in order
+func (seq *sequencer) pendingSequences() []uint64 {
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+	sequences := make([]uint64, 0, len(seq.pending))
+	for sequence := range seq.pending {
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	return sequences
+}
+
+// handleOrderbookSequencedMsg : the sequenced request must be signed by the sequencer, a peer that sends
+// another one is disconnected
+func (orderbookHandler *OrderbookHandler) handleOrderbookSequencedMsg(message *OrderbookSequencedMsg) error {
+	peers := orderbookHandler.peers
+	if peers == nil || peers.sequencer == nil {
+		return fmt.Errorf("Unexpected sequenced request :%d", message.Sequence)
+	}
+	if err := message.Verify(peers.sequencer.config.Address); err != nil {
+		orderbookHandler.penalise(scoreMalformed, err)
+		return err
+	}
+	demo.LogDebug("Received sequenced request", "sequence", message.Sequence, "peer", orderbookHandler.Peer)
+	// the requests of the sequencer come back from the peers
+	if peers.sequencer.leader() {
+		return nil
+	}
+	peers.sequencer.receive(orderbookHandler, message)
+	return nil
+}
+
+// handleOrderbookSequenceRequestMsg : send the sequenced requests of the log, the peer syncs the books
+// when they are pruned
+func (orderbookHandler *OrderbookHandler) handleOrderbookSequenceRequestMsg(message *OrderbookSequenceRequestMsg) error {
+	demo.LogDebug("Received sequence request", "from", message.From, "to", message.To, "peer", orderbookHandler.Peer)
+	peers := orderbookHandler.peers
+	if peers == nil || peers.sequencer == nil {
+		return orderbookHandler.reply(&OrderbookRejectMsg{RequestID: message.RequestID, Reason: "Requests are not sequenced"})
+	}
+	msgs, err := peers.sequencer.logged(message.From, message.To)
+	if err != nil {
+		return orderbookHandler.reply(&OrderbookRejectMsg{RequestID: message.RequestID, Reason: err.Error()})
+	}
+	for _, msg := range msgs {
+		if err := orderbookHandler.reply(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+func TestSequencerOrdering(t *testing.T) {
+	newEngine := func() *orderbook.Engine {
+		return orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	}
+	sequencerKey, _ := crypto.GenerateKey()
+	config := &SequencerConfig{Address: crypto.PubkeyToAddress(sequencerKey.PublicKey), Key: sequencerKey}
+
+	// a is a peer of the sequencer, b and c are peers of the follower
+	leader, follower := newEngine(), newEngine()
+	leaderPeers, followerPeers := newPeerSet(), newPeerSet()
+	leaderPeers.setSequencer(config, leader)
+	followerPeers.setSequencer(&SequencerConfig{Address: config.Address}, follower)
+	a := newTestPeer(t, leaderPeers, leader, 1)
+	b, c := newTestPeer(t, followerPeers, follower, 2), newTestPeer(t, followerPeers, follower, 3)
+
+	alice, _ := crypto.GenerateKey()
+	bob, _ := crypto.GenerateKey()
+	order := func(key *ecdsa.PrivateKey, nonce uint64, side, price string) *OrderbookMsg {
+		msg := &OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: side,
+			Quantity: "1", Price: price, TradeID: "1", Timestamp: nonce, Nonce: nonce}
+		if err := msg.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	// the sequencer processes the requests, the accepted ones are sent sequenced to all peers
+	for _, msg := range []*OrderbookMsg{order(alice, 1, orderbook.Ask, "101"), order(bob, 1, orderbook.Bid, "101"),
+		order(alice, 2, orderbook.Ask, "102")} {
+		if err := a.handler.handle(msg); err != nil {
+			t.Fatal(err)
+		}
+		// the sequenced request is sent in the batch window
+		a.expect(t, &OrderbookAckMsg{}, &OrderbookSequencedMsg{})
+	}
+	if err := a.handler.handle(order(alice, 2, orderbook.Ask, "103")); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(t, &OrderbookRejectMsg{})
+	sequenced, err := leaderPeers.sequencer.logged(1, 3)
+	if err != nil || len(sequenced) != 3 || sequenced[2].Sequence != leader.Sequence() {
+		t.Fatalf("sequenced requests incorrect, got: %d, %v", len(sequenced), err)
+	}
+
+	// requests are forwarded by the follower, not applied
+	if err := b.handler.handle(order(bob, 2, orderbook.Bid, "90")); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t)
+	c.expect(t, &OrderbookMsg{})
+	if follower.Sequence() != 0 {
+		t.Fatalf("forwarded request must not be applied, got sequence: %d", follower.Sequence())
+	}
+
+	// sequenced requests received out of order wait for the missing ones, which are requested
+	if err := b.handler.handle(sequenced[2]); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t, &OrderbookSequenceRequestMsg{})
+	c.expect(t)
+	if pending := followerPeers.sequencer.pendingSequences(); len(pending) != 1 || pending[0] != 3 {
+		t.Fatalf("pending sequences incorrect, got: %v", pending)
+	}
+	if err := b.handler.handle(sequenced[0]); err != nil {
+		t.Fatal(err)
+	}
+	c.expect(t, &OrderbookSequencedMsg{})
+	if err := b.handler.handle(sequenced[1]); err != nil {
+		t.Fatal(err)
+	}
+	// the requests applied together are relayed in a batch
+	c.expect(t, &OrderbookBatchMsg{})
+	if follower.Sequence() != leader.Sequence() || follower.StateRoot() != leader.StateRoot() {
+		t.Errorf("follower incorrect, got: %s at %d, want: %s at %d",
+			follower.StateRoot().Hex(), follower.Sequence(), leader.StateRoot().Hex(), leader.Sequence())
+	}
+	// sent again by another peer
+	if err := c.handler.handle(sequenced[1]); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t)
+	if follower.Sequence() != leader.Sequence() {
+		t.Errorf("sequenced request must be applied once, got sequence: %d", follower.Sequence())
+	}
+
+	// only the sequencer signs the sequenced requests
+	forged := *sequenced[0]
+	forged.Sequence = 4
+	if err := b.handler.handle(&forged); err == nil {
+		t.Error("forged sequenced request must be rejected")
+	}
+
+	// the gaps of the peers are filled from the log
+	if err := a.handler.handle(&OrderbookSequenceRequestMsg{RequestID: 1, From: 2, To: 3}); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(t, &OrderbookSequencedMsg{}, &OrderbookSequencedMsg{})
+	if err := a.handler.handle(&OrderbookSequenceRequestMsg{RequestID: 2, From: 0, To: 3}); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(t, &OrderbookRejectMsg{})
+
+	// the books are synced when the peer does not have the missing requests
+	followerPeers.sequencer.lock.Lock()
+	gapID := followerPeers.sequencer.gapID
+	followerPeers.sequencer.lock.Unlock()
+	if err := b.handler.handle(&OrderbookRejectMsg{RequestID: gapID, Reason: "pruned"}); err != nil {
+		t.Fatal(err)
+	}
+	b.expect(t, &OrderbookSyncRequestMsg{})
+	if !followerPeers.sync.syncing() {
+		t.Error("books must be synced")
+	}
+}
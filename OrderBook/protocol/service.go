@@ -13,6 +13,8 @@ type OrderbookService struct {
 	V      int
 	Engine *orderbook.Engine
 	protos []p2p.Protocol
+	// peers : peers of the protocol
+	peers *peerSet
 }
 
 // APIs : api service
@@ -21,7 +23,7 @@ func (service *OrderbookService) APIs() []rpc.API {
 	return []rpc.API{
 		{
 			Namespace: "orderbook",
-			Version:   "0.42",
+			Version:   "0.48",
 			Service:   NewOrderbookAPI(service.V, service.Engine),
 			Public:    true,
 		},
@@ -42,9 +44,10 @@ func (service *OrderbookService) Stop() error {
 	return nil
 }
 
-// NewService: wrapper function for servicenode to start the service, both APIs and Protocols
-func NewService(inC <-chan interface{}, quitC <-chan struct{}, orderbookEngine *orderbook.Engine) func(ctx *node.ServiceContext) (node.Service, error) {
-	proto := NewProtocol(inC, quitC, orderbookEngine)
+// NewService: wrapper function for servicenode to start the service, both APIs and Protocols.
+// Sequencer config is nil when the requests are processed on arrival, limits are the default ones when nil
+func NewService(inC <-chan interface{}, quitC <-chan struct{}, orderbookEngine *orderbook.Engine, sequencerConfig *SequencerConfig, limits *PeerLimits) func(ctx *node.ServiceContext) (node.Service, error) {
+	proto, peers := newProtocol(inC, quitC, orderbookEngine, sequencerConfig, limits)
 	var protocolArr []p2p.Protocol
 	if proto != nil {
 		protocolArr = []p2p.Protocol{*proto}
@@ -52,9 +55,10 @@ func NewService(inC <-chan interface{}, quitC <-chan struct{}, orderbookEngine *
 
 	return func(ctx *node.ServiceContext) (node.Service, error) {
 		return &OrderbookService{
-			V:      42,
+			V:      ProtocolVersion,
 			Engine: orderbookEngine,
 			protos: protocolArr,
+			peers:  peers,
 		}, nil
 	}
 }
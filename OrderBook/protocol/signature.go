@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// the message hash is built like EIP-712, a domain separator and the hash of the typed message,
+// so a signature can not be replayed on another network, protocol version or message type
+var (
+	orderTypeHash = crypto.Keccak256Hash([]byte("Order(string pairName,string orderID,uint256 price,uint256 quantity," +
+		"string side,string type,string tradeID,address owner,uint256 nonce,uint256 timestamp)"))
+	cancelTypeHash = crypto.Keccak256Hash([]byte("Cancel(string pairName,string orderID,uint256 price," +
+		"string side,address owner,uint256 nonce,uint256 timestamp)"))
+	amendTypeHash = crypto.Keccak256Hash([]byte("Amend(string pairName,string orderID,uint256 price,uint256 quantity," +
+		"string side,string type,string tradeID,address owner,uint256 nonce,uint256 timestamp)"))
+	massCancelTypeHash = crypto.Keccak256Hash([]byte("MassCancel(string pairName,address owner,uint256 nonce,uint256 timestamp)"))
+	domainTypeHash     = crypto.Keccak256Hash([]byte("EIP712Domain(string name,string version)"))
+	// DomainSeparator : domain of the orderbook protocol
+	DomainSeparator = crypto.Keccak256Hash(domainTypeHash.Bytes(), crypto.Keccak256([]byte(OrderbookName)),
+		crypto.Keccak256([]byte(fmt.Sprintf("%d", OrderbookProtocol.Version))))
+)
+
+var (
+	errMissingSignature = errors.New("Message is not signed")
+	errWrongSigner      = errors.New("Message is not signed by the owner")
+)
+
+// SignedMsg : message that must be signed by its owner
+type SignedMsg interface {
+	Hash() common.Hash
+	Sign(key *ecdsa.PrivateKey) error
+	Verify() error
+}
+
+// uint256 field of the message hash, value that is not a number is hashed as 0
+func bigField(value string) []byte {
+	number, ok := new(big.Int).SetString(value, 10)
+	if !ok {
+		number = new(big.Int)
+	}
+	return common.BigToHash(number).Bytes()
+}
+
+func stringField(value string) []byte {
+	return crypto.Keccak256([]byte(value))
+}
+
+func uintField(value uint64) []byte {
+	return common.BigToHash(new(big.Int).SetUint64(value)).Bytes()
+}
+
+func addressField(value common.Address) []byte {
+	return common.BytesToHash(value.Bytes()).Bytes()
+}
+
+// typedHash : hash of the typed message in the domain
+func typedHash(typeHash common.Hash, fields ...[]byte) common.Hash {
+	structHash := crypto.Keccak256(append([][]byte{typeHash.Bytes()}, fields...)...)
+	return crypto.Keccak256Hash([]byte("\x19\x01"), DomainSeparator.Bytes(), structHash)
+}
+
+func signHash(hash common.Hash, key *ecdsa.PrivateKey) ([]byte, error) {
+	return crypto.Sign(hash.Bytes(), key)
+}
+
+// verifyHash : the signature must be recovered to the owner
+func verifyHash(hash common.Hash, owner common.Address, signature []byte) error {
+	if len(signature) != 65 {
+		return errMissingSignature
+	}
+	pubkey, err := crypto.SigToPub(hash.Bytes(), signature)
+	if err != nil {
+		return fmt.Errorf("Signature is not correct :%v", err)
+	}
+	if crypto.PubkeyToAddress(*pubkey) != owner {
+		return errWrongSigner
+	}
+	return nil
+}
+
+// Hash : canonical hash of the order, it is what the owner signs
+func (msg *OrderbookMsg) Hash() common.Hash {
+	return typedHash(orderTypeHash, stringField(msg.PairName), stringField(msg.OrderID), bigField(msg.Price),
+		bigField(msg.Quantity), stringField(msg.Side), stringField(msg.Type), stringField(msg.TradeID),
+		addressField(msg.Owner), uintField(msg.Nonce), uintField(msg.Timestamp))
+}
+
+// Sign : set the owner to the address of the key and sign the order hash
+func (msg *OrderbookMsg) Sign(key *ecdsa.PrivateKey) (err error) {
+	msg.Owner = crypto.PubkeyToAddress(key.PublicKey)
+	msg.Signature, err = signHash(msg.Hash(), key)
+	return err
+}
+
+// Verify : the signature must be recovered to the owner of the order
+func (msg *OrderbookMsg) Verify() error {
+	return verifyHash(msg.Hash(), msg.Owner, msg.Signature)
+}
+
+// Hash : canonical hash of the cancel
+func (msg *OrderbookCancelMsg) Hash() common.Hash {
+	return typedHash(cancelTypeHash, stringField(msg.PairName), stringField(msg.OrderID), bigField(msg.Price),
+		stringField(msg.Side), addressField(msg.Owner), uintField(msg.Nonce), uintField(msg.Timestamp))
+}
+
+func (msg *OrderbookCancelMsg) Sign(key *ecdsa.PrivateKey) (err error) {
+	msg.Owner = crypto.PubkeyToAddress(key.PublicKey)
+	msg.Signature, err = signHash(msg.Hash(), key)
+	return err
+}
+
+func (msg *OrderbookCancelMsg) Verify() error {
+	return verifyHash(msg.Hash(), msg.Owner, msg.Signature)
+}
+
+// Hash : canonical hash of the amend, it differs from the order with the same fields
+func (msg *OrderbookAmendMsg) Hash() common.Hash {
+	return typedHash(amendTypeHash, stringField(msg.PairName), stringField(msg.OrderID), bigField(msg.Price),
+		bigField(msg.Quantity), stringField(msg.Side), stringField(msg.Type), stringField(msg.TradeID),
+		addressField(msg.Owner), uintField(msg.Nonce), uintField(msg.Timestamp))
+}
+
+func (msg *OrderbookAmendMsg) Sign(key *ecdsa.PrivateKey) (err error) {
+	msg.Owner = crypto.PubkeyToAddress(key.PublicKey)
+	msg.Signature, err = signHash(msg.Hash(), key)
+	return err
+}
+
+func (msg *OrderbookAmendMsg) Verify() error {
+	return verifyHash(msg.Hash(), msg.Owner, msg.Signature)
+}
+
+// Hash : canonical hash of the mass cancel
+func (msg *OrderbookMassCancelMsg) Hash() common.Hash {
+	return typedHash(massCancelTypeHash, stringField(msg.PairName), addressField(msg.Owner), uintField(msg.Nonce),
+		uintField(msg.Timestamp))
+}
+
+func (msg *OrderbookMassCancelMsg) Sign(key *ecdsa.PrivateKey) (err error) {
+	msg.Owner = crypto.PubkeyToAddress(key.PublicKey)
+	msg.Signature, err = signHash(msg.Hash(), key)
+	return err
+}
+
+func (msg *OrderbookMassCancelMsg) Verify() error {
+	return verifyHash(msg.Hash(), msg.Owner, msg.Signature)
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestOrderbookMsgSignature(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	quote := map[string]string{
+		"timestamp": "1000", "type": "limit", "side": "ask", "quantity": "10", "price": "100",
+		"trade_id": "1", "pair_name": "TOMO/WETH", "order_id": "0", "nonce": "7",
+	}
+	msg, err := NewOrderbookMsg(quote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Verify(); err == nil {
+		t.Error("unsigned message must be rejected")
+	}
+
+	if err := msg.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Verify(); err != nil {
+		t.Errorf("signed message must be verified, got: %v", err)
+	}
+	result := msg.ToQuote()
+	if result["owner"] != crypto.PubkeyToAddress(key.PublicKey).Hex() || result["nonce"] != "7" {
+		t.Errorf("quote owner incorrect, got: %v", result)
+	}
+
+	// any change of the order breaks the signature
+	msg.Quantity = "11"
+	if err := msg.Verify(); err == nil {
+		t.Error("changed message must be rejected")
+	}
+	msg.Quantity = "10"
+
+	// signed by another key for the owner
+	msg.Owner = crypto.PubkeyToAddress(other.PublicKey)
+	if err := msg.Verify(); err == nil {
+		t.Error("message must be signed by its owner")
+	}
+
+	// the signature of an order can not be used for an amend with the same fields
+	amend, _ := NewOrderbookAmendMsg(quote)
+	amend.Owner = msg.Owner
+	if amend.Hash() == msg.Hash() {
+		t.Error("amend must not have the hash of the order")
+	}
+}
+
+func TestOrderbookMsgAmbiguous(t *testing.T) {
+	msgs := []*OrderbookMsg{
+		{PairName: "TOMO/WETH", OrderID: "1", Price: "100", Side: "ask", TradeID: ""},
+		{PairName: "TOMO/WETH", OrderID: "1", Price: "100", Quantity: "5", Side: "ask", TradeID: "1"},
+	}
+	for _, msg := range msgs {
+		if err := msg.checkNewOrder(); err == nil {
+			t.Errorf("legacy message must be rejected, got: %v", msg)
+		}
+	}
+	msg := &OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Price: "100", Quantity: "5", Side: "ask", TradeID: "1"}
+	if err := msg.checkNewOrder(); err != nil {
+		t.Errorf("new order must be accepted, got: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package protocol
+
+import (
+	"crypto/ecdsa"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/simulations"
+	"github.com/ethereum/go-ethereum/p2p/simulations/adapters"
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+// simNode : service of a node of the simulation and the channel of its requests
+type simNode struct {
+	engine  *orderbook.Engine
+	inC     chan interface{}
+	service *OrderbookService
+}
+
+// simTrader : requests of a trader are sent by the same node, with increasing nonces
+type simTrader struct {
+	key   *ecdsa.PrivateKey
+	node  int
+	nonce uint64
+}
+
+// TestOrderbookSimulation : nodes in memory connected in a ring get random requests, the engines of all
+// nodes must end with the same books and the same trades
+func TestOrderbookSimulation(t *testing.T) {
+	const nodeCount, traderCount, requestCount = 5, 8, 400
+	sequencerKey, _ := crypto.GenerateKey()
+	sequencer := crypto.PubkeyToAddress(sequencerKey.PublicKey)
+
+	var lock sync.Mutex
+	var leader discover.NodeID
+	nodes := make(map[discover.NodeID]*simNode)
+	quitC := make(chan struct{})
+	services := adapters.Services{
+		"orderbook": func(ctx *adapters.ServiceContext) (node.Service, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			engine := orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+			config := &SequencerConfig{Address: sequencer}
+			if ctx.Config.ID == leader {
+				config.Key = sequencerKey
+			}
+			inC := make(chan interface{})
+			service, err := NewService(inC, quitC, engine, config, nil)(ctx.NodeContext)
+			if err != nil {
+				return nil, err
+			}
+			nodes[ctx.Config.ID] = &simNode{engine: engine, inC: inC, service: service.(*OrderbookService)}
+			return service, nil
+		},
+	}
+	net := simulations.NewNetwork(adapters.NewSimAdapter(services), &simulations.NetworkConfig{DefaultService: "orderbook"})
+	defer net.Shutdown()
+	defer close(quitC)
+
+	ids := make([]discover.NodeID, nodeCount)
+	for i := range ids {
+		n, err := net.NewNodeWithConfig(adapters.RandomNodeConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = n.ID()
+	}
+	leader = ids[0]
+	for _, id := range ids {
+		if err := net.Start(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range ids {
+		if err := net.Connect(ids[i], ids[(i+1)%nodeCount]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// requests of a node are only sent to the peers that are registered
+	waitFor(t, "peers to connect", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, id := range ids {
+			if nodes[id].service.peers.Len() != 2 {
+				return false
+			}
+		}
+		return true
+	})
+
+	// orders cross the spread often, so there are trades
+	random := rand.New(rand.NewSource(47))
+	traders := make([]*simTrader, traderCount)
+	for i := range traders {
+		key, _ := crypto.GenerateKey()
+		traders[i] = &simTrader{key: key, node: i % nodeCount}
+	}
+	for i := 0; i < requestCount; i++ {
+		trader := traders[random.Intn(traderCount)]
+		trader.nonce++
+		var msg SignedMsg
+		if random.Intn(20) == 0 {
+			msg = &OrderbookMassCancelMsg{PairName: "TOMO/WETH", Timestamp: uint64(i + 1), Nonce: trader.nonce}
+		} else {
+			side, price := orderbook.Bid, 95+random.Intn(10)
+			if random.Intn(2) == 0 {
+				side, price = orderbook.Ask, price+1
+			}
+			msg = &OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: side,
+				Quantity: strconv.Itoa(1 + random.Intn(5)), Price: strconv.Itoa(price), TradeID: strconv.Itoa(i),
+				Timestamp: uint64(i + 1), Nonce: trader.nonce}
+		}
+		if err := msg.Sign(trader.key); err != nil {
+			t.Fatal(err)
+		}
+		nodes[ids[trader.node]].inC <- msg
+	}
+
+	// the engines are done when they are all at the same sequence for a while
+	last := uint64(0)
+	waitFor(t, "engines to converge", func() bool {
+		sequence := nodes[leader].engine.Sequence()
+		for _, id := range ids {
+			if nodes[id].engine.Sequence() != sequence {
+				return false
+			}
+		}
+		done := sequence > 0 && sequence == last
+		last = sequence
+		return done
+	})
+
+	expected, root, err := nodes[leader].engine.Journal("tomo/weth", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// requests of a trader are sent in nonce order from one node, none is rejected
+	if sequence := nodes[leader].engine.Sequence(); sequence != requestCount || len(expected) != requestCount {
+		t.Fatalf("leader must apply all requests, got: %d operations at sequence %d, want: %d", len(expected), sequence, requestCount)
+	}
+	trades := 0
+	for _, entry := range expected {
+		trades += len(entry.Trades)
+	}
+	if trades == 0 {
+		t.Fatalf("requests must make trades, got %d operations", len(expected))
+	}
+	for i, id := range ids[1:] {
+		entries, nodeRoot, err := nodes[id].engine.Journal("tomo/weth", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeRoot != root || nodes[id].engine.StateRoot() != nodes[leader].engine.StateRoot() {
+			t.Errorf("book of node %d incorrect, got root: %s, expected: %s", i+1, nodeRoot.Hex(), root.Hex())
+		}
+		if !reflect.DeepEqual(entries, expected) {
+			t.Errorf("operations of node %d incorrect, got: %d, expected: %d", i+1, len(entries), len(expected))
+		}
+	}
+	t.Logf("%d operations, %d trades at sequence %d", len(expected), trades, nodes[leader].engine.Sequence())
+}
+
+// waitFor : check the condition until it is true, the test fails after a while
+func waitFor(t *testing.T, what string, condition func() bool) {
+	timeout := time.After(30 * time.Second)
+	for !condition() {
+		select {
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s", what)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,591 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+	demo "github.com/tomochain/orderbook/common"
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+// A node behind its peer after the handshake requests the book of each pair, imports it, then requests
+// the operations journaled by the peer after the book until there is none left. The pair goes live when
+// its root is the one advertised by the peer, orders received for it meanwhile are processed then.
+// A pair that fails to sync from a peer syncs from another one, it never goes live without sync.
+
+const (
+	// syncChunkSize : orders or operations in a sync message
+	syncChunkSize = 200
+	// syncMsgSize : encoded size of the orders or operations in a sync message, a message has fewer of them
+	// when they do not fit. The rest of the max message size is for the envelope
+	syncMsgSize = 60 * 1024
+	// syncTimeout : time without reply to a sync request before it is sent again
+	syncTimeout = 30 * time.Second
+	// syncRetries : snapshots requested again before the peer is dropped
+	syncRetries = 3
+	// syncSnapshotLimit : orders in the book of a pair, a bigger snapshot is rejected
+	syncSnapshotLimit = 100000
+	// syncBufferLimit : orders buffered for a pair that is syncing, the next ones are rejected
+	syncBufferLimit = 4096
+)
+
+var errSyncBufferFull = errors.New("Pair is syncing, too many requests are waiting")
+
+// OrderbookSyncRequestMsg : request the book of the pair, or the operations after the sequence
+type OrderbookSyncRequestMsg struct {
+	RequestID uint64
+	PairName  string
+	Snapshot  bool
+	Sequence  uint64
+}
+
+// OrderbookSnapshotMsg : part of the book of the pair at the sequence, the book is complete with the last one
+type OrderbookSnapshotMsg struct {
+	RequestID   uint64
+	PairName    string
+	Sequence    uint64
+	Timestamp   uint64
+	NextOrderID uint64
+	Root        common.Hash
+	Orders      []*orderbook.SnapshotOrder
+	Last        bool
+}
+
+// OrderbookJournalEntry : operation of the journal, the quote is sorted by key
+type OrderbookJournalEntry struct {
+	Sequence uint64
+	PairName string
+	Kind     string
+	Keys     []string
+	Values   []string
+}
+
+// OrderbookJournalMsg : operations on the pair after the requested sequence. When there are more, they must be
+// requested again, otherwise root is the one of the pair after the operations
+type OrderbookJournalMsg struct {
+	RequestID uint64
+	PairName  string
+	Entries   []OrderbookJournalEntry
+	More      bool
+	Root      common.Hash
+}
+
+func newJournalEntry(entry *orderbook.JournalEntry) OrderbookJournalEntry {
+	keys := make([]string, 0, len(entry.Quote))
+	for key := range entry.Quote {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = entry.Quote[key]
+	}
+	return OrderbookJournalEntry{
+		Sequence: entry.Sequence,
+		PairName: entry.PairName,
+		Kind:     entry.Kind,
+		Keys:     keys,
+		Values:   values,
+	}
+}
+
+func (entry *OrderbookJournalEntry) toJournalEntry() (*orderbook.JournalEntry, error) {
+	if len(entry.Keys) != len(entry.Values) {
+		return nil, fmt.Errorf("Journal entry %d has %d keys and %d values", entry.Sequence, len(entry.Keys), len(entry.Values))
+	}
+	quote := make(map[string]string, len(entry.Keys))
+	for i, key := range entry.Keys {
+		quote[key] = entry.Values[i]
+	}
+	return &orderbook.JournalEntry{
+		Sequence: entry.Sequence,
+		PairName: entry.PairName,
+		Kind:     entry.Kind,
+		Quote:    quote,
+	}, nil
+}
+
+type bufferedMsg struct {
+	handler *OrderbookHandler
+	msg     SignedMsg
+}
+
+// pairSync : state of a pair that is syncing from the peer of the handler, nil when it waits for a peer
+type pairSync struct {
+	handler   *OrderbookHandler
+	requestID uint64
+	snapshot  *orderbook.BookSnapshot
+	retries   int
+	buffered  []bufferedMsg
+	// replied : time of the request or of the last reply to it
+	replied time.Time
+}
+
+// syncer : pairs that are syncing, shared by the handlers of all peers
+type syncer struct {
+	lock      sync.Mutex
+	pairs     map[string]*pairSync
+	requestID uint64
+	// timeout : time without reply before a request is sent again
+	timeout time.Duration
+}
+
+func newSyncer() *syncer {
+	return &syncer{
+		pairs:   make(map[string]*pairSync),
+		timeout: syncTimeout,
+	}
+}
+
+// start : sync the pairs from the peer of the handler, pairs that are already syncing from a peer are skipped
+func (s *syncer) start(handler *OrderbookHandler) {
+	s.assign(handler, true)
+}
+
+// adopt : sync the pairs that wait for a peer from the peer of the handler
+func (s *syncer) adopt(handler *OrderbookHandler) {
+	s.assign(handler, false)
+}
+
+func (s *syncer) assign(handler *OrderbookHandler, all bool) {
+	for _, name := range handler.Engine.PairNames() {
+		s.lock.Lock()
+		state, ok := s.pairs[name]
+		if (ok && state.handler != nil) || (!ok && !all) {
+			s.lock.Unlock()
+			continue
+		}
+		if !ok {
+			state = &pairSync{}
+			s.pairs[name] = state
+		}
+		state.handler = handler
+		s.lock.Unlock()
+		s.request(name, state, true, 0)
+	}
+}
+
+// nextRequestID : id of a new request to a peer, the rejects of the peer are matched with it
+func (s *syncer) nextRequestID() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requestID++
+	return s.requestID
+}
+
+// syncing : some pairs are not live
+func (s *syncer) syncing() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.pairs) > 0
+}
+
+// request : request the snapshot or the journal, the replies with another request id are ignored
+func (s *syncer) request(name string, state *pairSync, snapshot bool, sequence uint64) {
+	id := s.nextRequestID()
+	s.lock.Lock()
+	handler := state.handler
+	state.requestID = id
+	state.snapshot = nil
+	state.replied = time.Now()
+	msg := &OrderbookSyncRequestMsg{RequestID: id, PairName: name, Snapshot: snapshot, Sequence: sequence}
+	s.lock.Unlock()
+	if handler == nil {
+		return
+	}
+
+	demo.LogInfo("Request sync", "pair", name, "snapshot", snapshot, "sequence", sequence, "peer", handler.Peer)
+	if err := handler.send(msg); err != nil {
+		// the peer is dropped
+		s.reassign(name, state, handler, err)
+		return
+	}
+	s.watch(name, state, id, s.timeout)
+}
+
+// watch : the request is sent again when the peer does not reply to it in time, the time is counted
+// from the last reply as a book is sent in many messages
+func (s *syncer) watch(name string, state *pairSync, requestID uint64, wait time.Duration) {
+	time.AfterFunc(wait, func() {
+		s.lock.Lock()
+		pending := s.pairs[name] == state && state.requestID == requestID
+		idle := time.Since(state.replied)
+		s.lock.Unlock()
+		if !pending {
+			return
+		}
+		if idle < s.timeout {
+			s.watch(name, state, requestID, s.timeout-idle)
+			return
+		}
+		s.retry(name, state, fmt.Errorf("Sync request %d of %s timed out", requestID, name))
+	})
+}
+
+// replied : the peer replied to the request of the pair
+func (s *syncer) replied(state *pairSync) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state.replied = time.Now()
+}
+
+// get : state of the pair if it is syncing from the handler with the request
+func (s *syncer) get(handler *OrderbookHandler, name string, requestID uint64) *pairSync {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	state, ok := s.pairs[name]
+	if !ok || state.handler != handler || state.requestID != requestID {
+		return nil
+	}
+	return state
+}
+
+// getByRequest : name and state of the pair with the pending request of the handler
+func (s *syncer) getByRequest(handler *OrderbookHandler, requestID uint64) (string, *pairSync) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name, state := range s.pairs {
+		if state.handler == handler && state.requestID == requestID {
+			return name, state
+		}
+	}
+	return "", nil
+}
+
+// buffer : keep the message until its pair is synced, return false if its pair is live. An error is returned
+// when the buffer of the pair is full
+func (s *syncer) buffer(handler *OrderbookHandler, msg SignedMsg) (bool, error) {
+	name := pairName(msg)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var state *pairSync
+	if name == "" {
+		// mass cancel of all pairs waits for the first pair that is syncing
+		for _, pair := range s.pairs {
+			state = pair
+			break
+		}
+	} else {
+		state = s.pairs[name]
+	}
+	if state == nil {
+		return false, nil
+	}
+	if len(state.buffered) >= syncBufferLimit {
+		demo.LogWarn("Sync buffer is full", "pair", name, "msg", msg)
+		return false, errSyncBufferFull
+	}
+	state.buffered = append(state.buffered, bufferedMsg{handler: handler, msg: msg})
+	return true, nil
+}
+
+// retry : request the snapshot again, drop the peer after too many failures and sync from another one
+func (s *syncer) retry(name string, state *pairSync, err error) {
+	s.lock.Lock()
+	handler := state.handler
+	retries := state.retries
+	state.retries++
+	s.lock.Unlock()
+	if handler == nil {
+		return
+	}
+
+	demo.LogWarn("Sync failed", "pair", name, "peer", handler.Peer, "retries", retries, "err", err)
+	if retries >= syncRetries {
+		handler.Peer.Drop(err)
+		s.reassign(name, state, handler, err)
+		return
+	}
+	s.request(name, state, true, 0)
+}
+
+// reassign : the pair syncs from another peer than the one of the handler, it waits for a new peer
+// when there is none
+func (s *syncer) reassign(name string, state *pairSync, handler *OrderbookHandler, err error) {
+	var next *OrderbookHandler
+	if handler.peers != nil {
+		next = handler.peers.syncPeer(handler)
+	}
+	s.lock.Lock()
+	if s.pairs[name] != state || state.handler != handler {
+		s.lock.Unlock()
+		return
+	}
+	state.handler = next
+	state.requestID = 0
+	state.retries = 0
+	state.snapshot = nil
+	s.lock.Unlock()
+
+	if next == nil {
+		demo.LogWarn("Pair waits for a peer to sync", "pair", name, "err", err)
+		return
+	}
+	demo.LogInfo("Sync from another peer", "pair", name, "peer", next.Peer, "err", err)
+	s.request(name, state, true, 0)
+}
+
+// finish : the pair is synced and goes live, the buffered messages are processed and replied. The engine
+// continues from the sequence of the pairs and the sequenced requests received meanwhile are applied
+// when all pairs are live
+func (s *syncer) finish(name string) {
+	s.lock.Lock()
+	state, ok := s.pairs[name]
+	delete(s.pairs, name)
+	live := len(s.pairs) == 0
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	engine := state.handler.Engine
+	if live {
+		if err := engine.FinishSync(); err != nil {
+			demo.LogError("Finish sync failed", "err", err)
+		}
+	}
+	demo.LogInfo("Pair is synced", "pair", name, "sequence", engine.Sequence())
+	for _, buffered := range state.buffered {
+		buffered.handler.respond(buffered.msg, buffered.handler.dispatch(buffered.msg))
+	}
+	if peers := state.handler.peers; live && peers != nil && peers.sequencer != nil && !peers.sequencer.leader() {
+		peers.sequencer.resume(state.handler)
+	}
+}
+
+// abort : the peer of the handler is gone, its pairs sync from another peer
+func (s *syncer) abort(handler *OrderbookHandler) {
+	var names []string
+	var states []*pairSync
+	s.lock.Lock()
+	for name, state := range s.pairs {
+		if state.handler == handler {
+			names = append(names, name)
+			states = append(states, state)
+		}
+	}
+	s.lock.Unlock()
+	for i, name := range names {
+		s.reassign(name, states[i], handler, fmt.Errorf("Peer disconnected"))
+	}
+}
+
+// pairName : pair of the signed message, empty for all pairs
+func pairName(msg SignedMsg) string {
+	switch message := msg.(type) {
+	case *OrderbookMsg:
+		return strings.ToLower(message.PairName)
+	case *OrderbookCancelMsg:
+		return strings.ToLower(message.PairName)
+	case *OrderbookAmendMsg:
+		return strings.ToLower(message.PairName)
+	case *OrderbookMassCancelMsg:
+		return strings.ToLower(message.PairName)
+	}
+	return ""
+}
+
+// handleOrderbookSyncRequestMsg : send the book in parts, or the journal after the sequence
+func (orderbookHandler *OrderbookHandler) handleOrderbookSyncRequestMsg(message *OrderbookSyncRequestMsg) error {
+	demo.LogDebug("Received sync request", "request", message, "peer", orderbookHandler.Peer)
+	engine := orderbookHandler.Engine
+
+	if message.Snapshot {
+		snapshot, err := engine.ExportBook(message.PairName)
+		if err != nil {
+			return orderbookHandler.reply(&OrderbookRejectMsg{RequestID: message.RequestID, Reason: err.Error()})
+		}
+		orders := snapshot.Orders
+		for {
+			end := syncChunkEnd(len(orders), func(i int) interface{} { return orders[i] })
+			err := orderbookHandler.reply(&OrderbookSnapshotMsg{
+				RequestID:   message.RequestID,
+				PairName:    snapshot.PairName,
+				Sequence:    snapshot.Sequence,
+				Timestamp:   snapshot.Timestamp,
+				NextOrderID: snapshot.NextOrderID,
+				Root:        snapshot.Root,
+				Orders:      orders[:end],
+				Last:        end == len(orders),
+			})
+			orders = orders[end:]
+			if err != nil || len(orders) == 0 {
+				return err
+			}
+		}
+	}
+
+	entries, root, err := engine.Journal(message.PairName, message.Sequence)
+	if err != nil {
+		// the peer requests the book instead
+		return orderbookHandler.reply(&OrderbookRejectMsg{RequestID: message.RequestID, Reason: err.Error()})
+	}
+	end := syncChunkEnd(len(entries), func(i int) interface{} { return newJournalEntry(entries[i]) })
+	reply := &OrderbookJournalMsg{
+		RequestID: message.RequestID,
+		PairName:  strings.ToLower(message.PairName),
+		More:      end < len(entries),
+	}
+	if reply.More {
+		entries = entries[:end]
+	} else {
+		reply.Root = root
+	}
+	for _, entry := range entries {
+		reply.Entries = append(reply.Entries, newJournalEntry(entry))
+	}
+	return orderbookHandler.reply(reply)
+}
+
+// syncChunkEnd : number of the first items in a sync message, up to syncChunkSize items that fit in syncMsgSize,
+// at least one
+func syncChunkEnd(count int, item func(int) interface{}) int {
+	size := 0
+	for i := 0; i < count && i < syncChunkSize; i++ {
+		data, _ := rlp.EncodeToBytes(item(i))
+		if size += len(data); size > syncMsgSize && i > 0 {
+			return i
+		}
+	}
+	if count > syncChunkSize {
+		return syncChunkSize
+	}
+	return count
+}
+
+// handleOrderbookSnapshotMsg : import the book when all parts are received, then request the journal after it
+func (orderbookHandler *OrderbookHandler) handleOrderbookSnapshotMsg(message *OrderbookSnapshotMsg) error {
+	if orderbookHandler.peers == nil {
+		return nil
+	}
+	s := orderbookHandler.peers.sync
+	state := s.get(orderbookHandler, message.PairName, message.RequestID)
+	if state == nil {
+		demo.LogWarn("Unexpected snapshot", "pair", message.PairName, "request_id", message.RequestID, "peer", orderbookHandler.Peer)
+		// only the replies to the requests of the node are not limited
+		if payload, err := rlp.EncodeToBytes(message); err == nil {
+			orderbookHandler.limit(1, len(payload))
+		}
+		return nil
+	}
+
+	if err := orderbookHandler.checkSnapshot(message); err != nil {
+		s.retry(message.PairName, state, err)
+		return nil
+	}
+	s.lock.Lock()
+	state.replied = time.Now()
+	if state.snapshot == nil {
+		state.snapshot = &orderbook.BookSnapshot{
+			PairName:    message.PairName,
+			Sequence:    message.Sequence,
+			Timestamp:   message.Timestamp,
+			NextOrderID: message.NextOrderID,
+			Root:        message.Root,
+		}
+	}
+	snapshot := state.snapshot
+	var err error
+	if snapshot.Sequence != message.Sequence || snapshot.Root != message.Root || snapshot.NextOrderID != message.NextOrderID {
+		err = fmt.Errorf("Snapshot of %s changed at sequence %d", message.PairName, message.Sequence)
+	} else if len(snapshot.Orders)+len(message.Orders) > syncSnapshotLimit {
+		err = fmt.Errorf("Snapshot of %s has more than %d orders", message.PairName, syncSnapshotLimit)
+	} else {
+		snapshot.Orders = append(snapshot.Orders, message.Orders...)
+	}
+	s.lock.Unlock()
+	if err != nil {
+		s.retry(message.PairName, state, err)
+		return nil
+	}
+	if !message.Last {
+		return nil
+	}
+
+	if err := orderbookHandler.Engine.ImportBook(snapshot); err != nil {
+		s.retry(message.PairName, state, err)
+		return nil
+	}
+	s.request(message.PairName, state, false, snapshot.Sequence)
+	return nil
+}
+
+// handleOrderbookJournalMsg : apply the operations, the pair goes live when there is none left
+// and its root is the one of the peer
+func (orderbookHandler *OrderbookHandler) handleOrderbookJournalMsg(message *OrderbookJournalMsg) error {
+	if orderbookHandler.peers == nil {
+		return nil
+	}
+	s := orderbookHandler.peers.sync
+	state := s.get(orderbookHandler, message.PairName, message.RequestID)
+	if state == nil {
+		demo.LogWarn("Unexpected journal", "pair", message.PairName, "request_id", message.RequestID, "peer", orderbookHandler.Peer)
+		// only the replies to the requests of the node are not limited
+		if payload, err := rlp.EncodeToBytes(message); err == nil {
+			orderbookHandler.limit(1, len(payload))
+		}
+		return nil
+	}
+	s.replied(state)
+
+	var sequence uint64
+	for _, item := range message.Entries {
+		entry, err := item.toJournalEntry()
+		if err != nil {
+			s.retry(message.PairName, state, err)
+			return nil
+		}
+		// the book is synced again when an operation of the peer fails
+		if err := orderbookHandler.Engine.ApplyJournal(message.PairName, entry); err != nil {
+			s.retry(message.PairName, state, err)
+			return nil
+		}
+		sequence = entry.Sequence
+	}
+	if message.More {
+		s.request(message.PairName, state, false, sequence)
+		return nil
+	}
+
+	root, err := orderbookHandler.Engine.PairRoot(message.PairName)
+	if err == nil && root != message.Root {
+		err = fmt.Errorf("State root of %s is %s, peer root is %s", message.PairName, root.Hex(), message.Root.Hex())
+	}
+	if err != nil {
+		s.retry(message.PairName, state, err)
+		return nil
+	}
+	s.finish(message.PairName)
+	return nil
+}
+
+// checkSnapshot : the snapshot is not behind the handshake of the peer, and at the same sequence its root
+// is the one of the pair in the handshake
+func (orderbookHandler *OrderbookHandler) checkSnapshot(message *OrderbookSnapshotMsg) error {
+	remote := orderbookHandler.Remote
+	if remote == nil {
+		return nil
+	}
+	if message.Sequence < remote.Sequence {
+		return fmt.Errorf("Snapshot of %s at sequence %d is behind the peer at %d", message.PairName, message.Sequence, remote.Sequence)
+	}
+	if message.Sequence > remote.Sequence {
+		// operations after the handshake are checked with the root of the journal
+		return nil
+	}
+	for i, name := range remote.Pairs {
+		if name == strings.ToLower(message.PairName) && i < len(remote.PairRoots) {
+			if remote.PairRoots[i] != message.Root {
+				return fmt.Errorf("Snapshot root %s of %s (!= %s)", message.Root.Hex(), message.PairName, remote.PairRoots[i].Hex())
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("Pair %s is not in the handshake", message.PairName)
+}
@@ -0,0 +1,153 @@
+package protocol
+
+import (
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/p2p/protocols"
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+func TestOrderbookSync(t *testing.T) {
+	newEngine := func() *orderbook.Engine {
+		return orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	}
+	source, target := newEngine(), newEngine()
+	// more orders than a sync message
+	for i := 1; i <= syncChunkSize+50; i++ {
+		source.ProcessOrder(map[string]string{
+			"pair_name": "TOMO/WETH", "order_id": "0", "type": orderbook.Limit, "side": orderbook.Ask,
+			"quantity": "1", "price": strconv.Itoa(100 + i), "trade_id": strconv.Itoa(i), "timestamp": strconv.Itoa(i),
+		})
+	}
+	// the target has an order that the source does not have
+	target.ProcessOrder(map[string]string{
+		"pair_name": "TOMO/WETH", "order_id": "0", "type": orderbook.Limit, "side": orderbook.Bid,
+		"quantity": "1", "price": "50", "trade_id": "1", "timestamp": "1",
+	})
+
+	sourceRW, targetRW := p2p.MsgPipe()
+	defer sourceRW.Close()
+	sourceHandler := &OrderbookHandler{Engine: source,
+		Peer: protocols.NewPeer(p2p.NewPeer(discover.NodeID{2}, "target", nil), sourceRW, OrderbookProtocol)}
+	sourcePeers, targetPeers := newPeerSet(), newPeerSet()
+	// the book is larger than the limits of the source, the replies to the sync requests are not limited
+	limiter := newPeerLimiter(PeerLimits{MsgRate: 0.001, MsgBurst: 1, ByteRate: 0.001, ByteBurst: 1024, BanScore: 100})
+	limitedTargetRW := &limitedRW{MsgReadWriter: targetRW, limiter: limiter, peers: targetPeers, id: discover.NodeID{1}}
+	targetHandler := &OrderbookHandler{Engine: target, Remote: newHandshake("source", source), limiter: limiter,
+		Peer: protocols.NewPeer(p2p.NewPeer(discover.NodeID{1}, "source", nil), limitedTargetRW, OrderbookProtocol)}
+	if err := sourcePeers.register(sourceHandler); err != nil {
+		t.Fatal(err)
+	}
+	if err := targetPeers.register(targetHandler); err != nil {
+		t.Fatal(err)
+	}
+	go sourceHandler.Peer.Run(sourceHandler.handle)
+	go targetHandler.Peer.Run(targetHandler.handle)
+
+	// order received while the pair is syncing is processed after
+	state := &pairSync{handler: targetHandler}
+	targetPeers.sync.pairs["tomo/weth"] = state
+	key, _ := crypto.GenerateKey()
+	msg := &OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Bid,
+		Quantity: "1", Price: "90", TradeID: "1", Timestamp: 1000, Nonce: 1}
+	if err := msg.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if reply := targetHandler.process(msg); reply != nil {
+		t.Fatalf("order must be buffered, got: %v", reply)
+	}
+	sourceRoot, _ := source.PairRoot("TOMO/WETH")
+	targetPeers.sync.request("tomo/weth", state, true, 0)
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		targetPeers.sync.lock.Lock()
+		syncing := len(targetPeers.sync.pairs)
+		targetPeers.sync.lock.Unlock()
+		if syncing == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pair must be synced")
+		}
+	}
+
+	if target.Sequence() != source.Sequence()+1 {
+		t.Errorf("sequence incorrect, got: %d, want: %d.", target.Sequence(), source.Sequence()+1)
+	}
+	if target.GetOrder("TOMO/WETH", "1") == nil || target.GetOrder("TOMO/WETH", strconv.Itoa(syncChunkSize+50)) == nil {
+		t.Error("orders of the source must be imported")
+	}
+	if order := target.GetOrder("TOMO/WETH", strconv.Itoa(syncChunkSize+51)); order == nil || order.Item.Price.Cmp(big.NewInt(90)) != 0 {
+		t.Errorf("buffered order must be processed after the sync, got: %v", order)
+	}
+	if score, _ := limiter.penalise(0); score != 0 {
+		t.Errorf("source must not be penalised for the sync, got score: %v", score)
+	}
+
+	// the book without the buffered order is the one of the source
+	if err := target.CancelOrder(map[string]string{"pair_name": "TOMO/WETH", "order_id": strconv.Itoa(syncChunkSize + 51),
+		"side": orderbook.Bid, "price": "90", "timestamp": "1000"}); err != nil {
+		t.Fatal(err)
+	}
+	if root, _ := target.PairRoot("TOMO/WETH"); root != sourceRoot {
+		t.Errorf("root incorrect, got: %s, want: %s.", root.Hex(), sourceRoot.Hex())
+	}
+
+	// pair of a peer that is gone waits for another peer, it does not go live
+	waiting := &pairSync{handler: targetHandler}
+	targetPeers.sync.pairs["tomo/weth"] = waiting
+	targetPeers.unregister(targetHandler)
+	if !targetPeers.sync.syncing() || waiting.handler != nil {
+		t.Error("pair must keep syncing when its peer is gone")
+	}
+}
+
+func TestOrderbookSyncTimeout(t *testing.T) {
+	engine := orderbook.NewEngineWithBackend(orderbook.NewMemBackend(), map[string]*big.Int{"tomo/weth": big.NewInt(1)})
+	ps := newPeerSet()
+	ps.sync.timeout = 20 * time.Millisecond
+	// the peer reads the requests and never replies
+	tp := newTestPeer(t, ps, engine, 1)
+	ps.sync.start(tp.handler)
+
+	// the snapshot is requested again, then the pair waits for another peer
+	requests := make([]interface{}, syncRetries+1)
+	for i := range requests {
+		requests[i] = &OrderbookSyncRequestMsg{}
+	}
+	tp.expect(t, requests...)
+	var state *pairSync
+	for i := 0; i < 100 && state == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		ps.sync.lock.Lock()
+		if pair := ps.sync.pairs["tomo/weth"]; pair != nil && pair.handler == nil {
+			state = pair
+		}
+		ps.sync.lock.Unlock()
+	}
+	if state == nil {
+		t.Fatal("pair must wait for another peer when its peer does not reply")
+	}
+
+	// requests are rejected when the buffer of the pair is full, and accepted again when there is room
+	key, _ := crypto.GenerateKey()
+	msg := &OrderbookMsg{PairName: "TOMO/WETH", OrderID: "0", Type: orderbook.Limit, Side: orderbook.Bid,
+		Quantity: "1", Price: "90", TradeID: "1", Timestamp: 1, Nonce: 1}
+	if err := msg.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	state.buffered = make([]bufferedMsg, syncBufferLimit)
+	if _, ok := tp.handler.process(msg).(*OrderbookRejectMsg); !ok {
+		t.Fatal("request must be rejected when the sync buffer is full")
+	}
+	state.buffered = nil
+	if reply := tp.handler.process(msg); reply != nil || len(state.buffered) != 1 {
+		t.Errorf("rejected request must be buffered when it is sent again, got: %v", reply)
+	}
+}
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+
+	"github.com/tomochain/orderbook/orderbook"
+)
+
+// The engine reads numbers with ToBigInt, which turns a value that is not a number into 0, so a request with
+// such a value would be processed as another request. Requests are validated before the engine, and the peer
+// that sends a request that is not correct is penalised.
+
+// validate : fields of the request must be the ones the engine can parse
+func validate(msg SignedMsg) error {
+	// the engine uses its own clock for a request without timestamp, each node would give it another one
+	if requestTimestamp(msg) == 0 {
+		return fmt.Errorf("Timestamp is not set")
+	}
+	switch message := msg.(type) {
+	case *OrderbookMsg:
+		return validateOrder(message.Type, message.Side, message.Price, message.Quantity)
+	case *OrderbookAmendMsg:
+		if err := validateID(message.OrderID); err != nil {
+			return err
+		}
+		return validateOrder(message.Type, message.Side, message.Price, message.Quantity)
+	case *OrderbookCancelMsg:
+		if err := validateID(message.OrderID); err != nil {
+			return err
+		}
+		if err := validateSide(message.Side); err != nil {
+			return err
+		}
+		return validatePositive("Price", message.Price)
+	}
+	return nil
+}
+
+// requestTimestamp : timestamp of the signed message, 0 if it has none
+func requestTimestamp(msg SignedMsg) uint64 {
+	switch message := msg.(type) {
+	case *OrderbookMsg:
+		return message.Timestamp
+	case *OrderbookCancelMsg:
+		return message.Timestamp
+	case *OrderbookAmendMsg:
+		return message.Timestamp
+	case *OrderbookMassCancelMsg:
+		return message.Timestamp
+	}
+	return 0
+}
+
+func validateOrder(orderType, side, price, quantity string) error {
+	if err := validateSide(side); err != nil {
+		return err
+	}
+	switch orderType {
+	case orderbook.Limit:
+		if err := validatePositive("Price", price); err != nil {
+			return err
+		}
+	case orderbook.Market:
+	default:
+		return fmt.Errorf("Order type is not correct :%s", orderType)
+	}
+	return validatePositive("Quantity", quantity)
+}
+
+func validateSide(side string) error {
+	if side != orderbook.Bid && side != orderbook.Ask {
+		return fmt.Errorf("Side is not correct :%s", side)
+	}
+	return nil
+}
+
+func validateID(orderID string) error {
+	if _, err := strconv.ParseUint(orderID, 10, 64); err != nil {
+		return fmt.Errorf("Order id is not correct :%s", orderID)
+	}
+	return nil
+}
+
+// validatePositive : the value must be an integer greater than 0
+func validatePositive(name, value string) error {
+	number, ok := new(big.Int).SetString(value, 10)
+	if !ok || number.Sign() <= 0 {
+		return fmt.Errorf("%s is not correct :%s", name, value)
+	}
+	return nil
+}